@@ -247,3 +247,46 @@ func TestList(t *testing.T) {
 		t.Error("expected output in the writer, got 0")
 	}
 }
+
+func TestRestrict(t *testing.T) {
+	const serverURL = "https://registry.example.com/v1/"
+	h := newMemoryStore()
+	if err := h.Add(&Credentials{ServerURL: serverURL, Username: "foo", Secret: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	r := Restrict(h, ActionGet, ActionList)
+
+	b, err := json.Marshal(&Credentials{ServerURL: serverURL, Username: "foo", Secret: "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = HandleCommand(r, ActionStore, bytes.NewReader(b), new(bytes.Buffer))
+	if !IsErrActionNotAllowed(err) {
+		t.Fatalf("expected store to be rejected, got %v", err)
+	}
+	if !IsErrActionNotAllowedMessage(err.Error()) {
+		t.Errorf("expected the message to be recognized, got %q", err.Error())
+	}
+	if h.creds[serverURL].Secret != "bar" {
+		t.Errorf("expected the credentials to be left untouched, got %s", h.creds[serverURL].Secret)
+	}
+
+	if err := HandleCommand(r, ActionErase, strings.NewReader(serverURL), new(bytes.Buffer)); !IsErrActionNotAllowed(err) {
+		t.Errorf("expected erase to be rejected, got %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	if err := HandleCommand(r, ActionGet, strings.NewReader(serverURL), out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"Secret":"bar"`) {
+		t.Errorf("expected the credentials to be returned, got %s", out.String())
+	}
+
+	if err := HandleCommand(r, ActionList, strings.NewReader(""), new(bytes.Buffer)); err != nil {
+		t.Errorf("expected list to be allowed, got %v", err)
+	}
+	if err := HandleCommand(Restrict(h), ActionVersion, strings.NewReader(""), new(bytes.Buffer)); err != nil {
+		t.Errorf("expected version to be allowed, got %v", err)
+	}
+}
@@ -14,6 +14,10 @@ const (
 	// invalid credentials or credentials management operations
 	errCredentialsMissingServerURLMessage = "no credentials server URL"
 	errCredentialsMissingUsernameMessage  = "no credentials username"
+
+	// errActionNotAllowedMessage standardizes the error returned for actions
+	// a restricted helper does not perform.
+	errActionNotAllowedMessage = "action not allowed by this credentials helper"
 )
 
 // errCredentialsNotFound represents an error
@@ -122,3 +126,38 @@ func IsCredentialsMissingUsername(err error) bool {
 func IsCredentialsMissingUsernameMessage(err string) bool {
 	return strings.TrimSpace(err) == errCredentialsMissingUsernameMessage
 }
+
+// errActionNotAllowed represents an error raised when a helper
+// created with Restrict is asked to perform an action it does
+// not allow.
+type errActionNotAllowed struct {
+	action Action
+}
+
+func (e errActionNotAllowed) Error() string {
+	return errActionNotAllowedMessage + ": " + e.action
+}
+
+// Forbidden implements the [ErrForbidden][errdefs.ErrForbidden] interface.
+//
+// [errdefs.ErrForbidden]: https://pkg.go.dev/github.com/docker/docker@v24.0.1+incompatible/errdefs#ErrForbidden
+func (errActionNotAllowed) Forbidden() {}
+
+// NewErrActionNotAllowed creates a new error for when the
+// given action is not allowed.
+func NewErrActionNotAllowed(action Action) error {
+	return errActionNotAllowed{action: action}
+}
+
+// IsErrActionNotAllowed returns true if the error
+// was caused by an action not being allowed.
+func IsErrActionNotAllowed(err error) bool {
+	var target errActionNotAllowed
+	return errors.As(err, &target)
+}
+
+// IsErrActionNotAllowedMessage checks for an
+// errActionNotAllowed in the error message.
+func IsErrActionNotAllowedMessage(err string) bool {
+	return strings.HasPrefix(strings.TrimSpace(err), errActionNotAllowedMessage+": ")
+}
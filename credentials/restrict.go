@@ -0,0 +1,49 @@
+package credentials
+
+// Restrict returns a Helper that only performs the given actions through
+// helper, such as only ActionGet and ActionList for a helper embedded in a
+// tool that must never modify the store. Other actions fail with an error for
+// which IsErrActionNotAllowed returns true. ActionVersion is always allowed,
+// as it does not reach the helper.
+func Restrict(helper Helper, allowed ...Action) Helper {
+	r := &restrictedHelper{helper: helper, allowed: make(map[Action]bool, len(allowed))}
+	for _, action := range allowed {
+		r.allowed[action] = true
+	}
+	return r
+}
+
+// restrictedHelper is a Helper performing a subset of the actions of another
+// Helper.
+type restrictedHelper struct {
+	helper  Helper
+	allowed map[Action]bool
+}
+
+func (r *restrictedHelper) Add(creds *Credentials) error {
+	if !r.allowed[ActionStore] {
+		return NewErrActionNotAllowed(ActionStore)
+	}
+	return r.helper.Add(creds)
+}
+
+func (r *restrictedHelper) Delete(serverURL string) error {
+	if !r.allowed[ActionErase] {
+		return NewErrActionNotAllowed(ActionErase)
+	}
+	return r.helper.Delete(serverURL)
+}
+
+func (r *restrictedHelper) Get(serverURL string) (string, string, error) {
+	if !r.allowed[ActionGet] {
+		return "", "", NewErrActionNotAllowed(ActionGet)
+	}
+	return r.helper.Get(serverURL)
+}
+
+func (r *restrictedHelper) List() (map[string]string, error) {
+	if !r.allowed[ActionList] {
+		return nil, NewErrActionNotAllowed(ActionList)
+	}
+	return r.helper.List()
+}
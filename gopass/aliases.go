@@ -0,0 +1,51 @@
+package gopass
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// gopassResolveAliasesEnv is the environment variable used to look up
+// credentials through gopass only, so that the aliases and templates it
+// resolves paths with are honored.
+const gopassResolveAliasesEnv = "GOPASS_RESOLVE_ALIASES"
+
+// entryNotFoundMessage is the error output of gopass when showing a secret
+// that is not in the store.
+const entryNotFoundMessage = "entry is not in the password store"
+
+// resolveAliases reports whether credentials are looked up through gopass
+// only, rather than by reading the store directory.
+func (g Gopass) resolveAliases() bool {
+	return g.config().resolveAliases || os.Getenv(gopassResolveAliasesEnv) == "1"
+}
+
+// isEntryNotFound reports whether gopass failed because the secret it was
+// asked for is not in the store.
+func isEntryNotFound(err error) bool {
+	var gopassErr *GopassError
+	return errors.As(err, &gopassErr) && strings.Contains(gopassErr.Stderr, entryNotFoundMessage)
+}
+
+// getAliased returns the secret of username for serverURL by showing the
+// path its credentials are stored at, which gopass may resolve to another
+// one. It returns credentials.NewErrCredentialsNotFound if gopass reports
+// the secret is not in the store.
+func (g Gopass) getAliased(serverURL, username string) (string, string, error) {
+	loc, err := g.serverLocation(serverURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err := g.showSecret(loc.secretPath(usernameName(username)))
+	if isEntryNotFound(err) {
+		return "", "", credentials.NewErrCredentialsNotFound()
+	}
+	if err != nil {
+		return "", "", &ReadError{ServerURL: serverURL, Username: username, err: err}
+	}
+	return username, secret, nil
+}
@@ -0,0 +1,240 @@
+package gopass
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gopassCacheTTLEnv is the environment variable used to cache the
+// credentials returned by Get in memory for the given duration, parsed as a
+// time.Duration. The cache is disabled when unset or zero.
+const gopassCacheTTLEnv = "GOPASS_CACHE_TTL"
+
+// gopassCacheSizeEnv is the environment variable used to override how many
+// credentials the cache holds at most.
+const gopassCacheSizeEnv = "GOPASS_CACHE_SIZE"
+
+// defaultGopassCacheSize is the cache size used when gopassCacheSizeEnv is
+// unset.
+const defaultGopassCacheSize = 64
+
+// credentialCache is a least recently used cache of the credentials returned
+// by Get, by requested server URL. Secrets are held as bytes so that they are
+// zeroed once evicted. generation is incremented whenever credentials are
+// evicted because they changed, so that credentials read before the change
+// are not cached afterwards.
+type credentialCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+}
+
+// cacheEntry is a credential held by credentialCache. server identifies where
+// the credentials of the server URL are stored, so that every entry of a
+// server URL is invalidated when its credentials change, however the server
+// URL was spelled. expires is when the entry expires, and credsExpire when
+// the credentials themselves expire, if they are hidden once expired.
+type cacheEntry struct {
+	key         string
+	server      string
+	username    string
+	secret      []byte
+	expires     time.Time
+	credsExpire time.Time
+}
+
+// cacheSettings returns the TTL and size of the cache, from the configuration
+// or the environment. A zero TTL disables the cache.
+func (g Gopass) cacheSettings() (time.Duration, int, error) {
+	cfg := g.config()
+	if cfg.hasCache {
+		if cfg.cacheSize <= 0 {
+			return cfg.cacheTTL, defaultGopassCacheSize, nil
+		}
+		return cfg.cacheTTL, cfg.cacheSize, nil
+	}
+
+	var ttl time.Duration
+	if v := os.Getenv(gopassCacheTTLEnv); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassCacheTTLEnv, v)
+		}
+	}
+
+	size := defaultGopassCacheSize
+	if v := os.Getenv(gopassCacheSizeEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be a positive integer", gopassCacheSizeEnv, v)
+		}
+		size = n
+	}
+	return ttl, size, nil
+}
+
+// cacheServer returns where the credentials of the requested server URL are
+// stored, ignoring the requested username.
+func (g Gopass) cacheServer(serverURL string) (string, error) {
+	base, _, _ := strings.Cut(serverURL, "#")
+	h, err := g.routed(base)
+	if err != nil {
+		return "", err
+	}
+	loc, err := h.serverLocation(base)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(loc.secrets, loc.dir), nil
+}
+
+// cachedGet implements Get, returning the cached credentials of serverURL if
+// the cache is enabled and holds them, and caching them otherwise.
+func (g Gopass) cachedGet(serverURL string) (username, secret string, err error) {
+	ttl, size, err := g.cacheSettings()
+	if err != nil {
+		return "", "", err
+	}
+	if ttl == 0 {
+		return g.getFragment(serverURL)
+	}
+
+	c := &g.config().cache
+	if username, secret, ok := c.get(serverURL); ok {
+		if logf := g.config().logf; logf != nil {
+			logf("gopass credentials served from cache", "serverURL", serverURL)
+		}
+		return username, secret, nil
+	}
+
+	// Credentials modified while they are read are not cached.
+	generation := c.currentGeneration()
+	username, secret, credsExpire, err := g.getExpiring(serverURL)
+	if err != nil {
+		return "", "", err
+	}
+	server, err := g.cacheServer(serverURL)
+	if err != nil {
+		return "", "", err
+	}
+	c.put(cacheEntry{
+		key:         serverURL,
+		server:      server,
+		username:    username,
+		secret:      []byte(secret),
+		expires:     time.Now().Add(ttl),
+		credsExpire: credsExpire,
+	}, size, generation)
+	return username, secret, nil
+}
+
+// invalidateCache evicts the cached credentials of serverURL, requested with
+// any username, once they are modified. Writers call it while holding
+// writeMutex, so that the credentials are evicted before another writer
+// modifies them again.
+func (g Gopass) invalidateCache(serverURL string) {
+	server, err := g.cacheServer(serverURL)
+	if err != nil {
+		// The location cannot be told, so nothing may be left behind.
+		g.config().cache.clear()
+		return
+	}
+	g.config().cache.invalidate(server)
+}
+
+// get returns the unexpired credentials cached for key, marking them as the
+// most recently used. Expired entries, and entries of credentials that have
+// expired themselves, are evicted.
+func (c *credentialCache) get(key string) (string, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires) || (!entry.credsExpire.IsZero() && !now.Before(entry.credsExpire)) {
+		c.remove(elem)
+		return "", "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.username, string(entry.secret), true
+}
+
+// currentGeneration returns the generation credentials read from now on are
+// cached with.
+func (c *credentialCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// put caches entry, replacing the credentials cached for its key, and evicts
+// the least recently used credentials beyond size. Nothing is cached if
+// credentials were evicted since generation, as entry may have been read
+// before they changed.
+func (c *credentialCache) put(entry cacheEntry, size int, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.order = list.New()
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.order.PushFront(&entry)
+	for c.order.Len() > size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate evicts every credential cached for server.
+func (c *credentialCache) invalidate(server string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, elem := range c.entries {
+		if elem.Value.(*cacheEntry).server == server {
+			c.remove(elem)
+		}
+	}
+}
+
+// clear evicts every cached credential.
+func (c *credentialCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, elem := range c.entries {
+		c.remove(elem)
+	}
+}
+
+// remove evicts the cached credential elem, zeroing its secret. c.mu must be
+// held.
+func (c *credentialCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	for i := range entry.secret {
+		entry.secret[i] = 0
+	}
+	delete(c.entries, entry.key)
+	c.order.Remove(elem)
+}
@@ -0,0 +1,35 @@
+package gopass
+
+import (
+	"errors"
+	"os"
+)
+
+// gopassUseCatEnv is the environment variable used to store and read secrets
+// byte for byte through `gopass cat`.
+const gopassUseCatEnv = "GOPASS_USE_CAT"
+
+// rawOutputs are the gopass subcommands whose standard output is returned
+// untrimmed, as it holds a secret byte for byte.
+var rawOutputs = map[string]bool{
+	"cat": true,
+}
+
+// useCat reports whether secrets are stored and read through `gopass cat`
+// rather than `gopass insert` and `gopass show`.
+func (g Gopass) useCat() bool {
+	return g.config().useCat || os.Getenv(gopassUseCatEnv) == "1"
+}
+
+// checkCatSecret rejects credentials that cannot be stored through
+// `gopass cat`, which stores the secret alone: metadata is not supported, and
+// an empty secret would make gopass print the secret rather than store it.
+func checkCatSecret(secret string, metadata map[string]string) error {
+	if len(metadata) > 0 {
+		return errors.New("metadata cannot be stored through gopass cat")
+	}
+	if secret == "" {
+		return errors.New("empty secrets cannot be stored through gopass cat")
+	}
+	return nil
+}
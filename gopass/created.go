@@ -0,0 +1,97 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// metadataCreatedAt is the metadata key holding the time at which
+// credentials were added, formatted as RFC 3339.
+const metadataCreatedAt = "created_at"
+
+// gopassCreatedAtEnv is the environment variable used to make Add record the
+// time at which credentials are added.
+const gopassCreatedAtEnv = "GOPASS_CREATED_AT"
+
+// CredentialInfo describes the credentials reported for a server URL by
+// ListWithMetadata.
+type CredentialInfo struct {
+	// ServerURL is the server URL the credentials are stored for.
+	ServerURL string
+	// Username is the username of the credentials.
+	Username string
+	// CreatedAt is the time at which the credentials were added, or the
+	// modification time of their secret if it was not recorded. It is zero if
+	// neither is known, such as when listing the store through gopass.
+	CreatedAt time.Time
+}
+
+// recordCreatedAt reports whether Add records the time at which credentials
+// are added.
+func (g Gopass) recordCreatedAt() bool {
+	return g.config().createdAt || os.Getenv(gopassCreatedAtEnv) == "1"
+}
+
+// ListWithMetadata is like List, but also reports when the credentials of
+// every server URL were added, from their created_at field, so that stale
+// credentials can be found. Credentials added without it, such as before
+// GOPASS_CREATED_AT was set, fall back to the modification time of their
+// secret. It decrypts the secret of every server URL listed.
+func (g Gopass) ListWithMetadata() (infos map[string]CredentialInfo, err error) {
+	defer g.observe("ListWithMetadata", time.Now(), &err)
+
+	searched, err := g.listedFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := map[string]CredentialInfo{}
+	for _, h := range searched {
+		err = h.walkServers(true, func(serverURL string, loc serverLocation, usernames []string) error {
+			if _, ok := resp[serverURL]; ok {
+				return nil
+			}
+			name, err := h.listUsername(loc, usernames)
+			if err != nil {
+				return err
+			}
+
+			_, metadata, err := h.showSecretWithMetadata(loc.secretPath(name))
+			if err != nil {
+				return &ReadError{ServerURL: serverURL, Username: name, err: err}
+			}
+			username := usernameFromMetadata(name, metadata)
+
+			createdAt, err := h.createdAt(loc, name, metadata)
+			if err != nil {
+				return &ReadError{ServerURL: serverURL, Username: username, err: err}
+			}
+			resp[serverURL] = CredentialInfo{ServerURL: serverURL, Username: username, CreatedAt: createdAt}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// createdAt returns the time at which the credentials of the username stored
+// under the secret name were added, given their metadata, falling back to the
+// modification time of the secret.
+func (g Gopass) createdAt(loc serverLocation, name string, metadata map[string]string) (time.Time, error) {
+	if v, ok := metadata[metadataCreatedAt]; ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q: must be an RFC 3339 time", metadataCreatedAt, v)
+		}
+		return t, nil
+	}
+
+	modTimes, err := g.usernameModTimes(loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return modTimes[name], nil
+}
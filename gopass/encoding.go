@@ -0,0 +1,157 @@
+package gopass
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// gopassReadablePathsEnv is the environment variable used to store
+// credentials under readable folder names rather than base64-url encoded ones.
+const gopassReadablePathsEnv = "GOPASS_READABLE_PATHS"
+
+// readableMarkers are the characters of which readable folder names contain
+// at least one, and which base64-url encoded names never contain.
+const readableMarkers = ".%~"
+
+// readablePaths reports whether credentials are stored under readable folder
+// names.
+func (g Gopass) readablePaths() bool {
+	return g.config().readablePaths || os.Getenv(gopassReadablePathsEnv) == "1"
+}
+
+// encodeServerURL returns the name of the folder the credentials of serverURL
+// are stored under.
+func (g Gopass) encodeServerURL(serverURL string) (string, error) {
+	n, err := g.normalization()
+	if err != nil {
+		return "", err
+	}
+
+	serverURL = normalizeServerURL(serverURL, n)
+	name := EncodeServerURL(serverURL)
+	if g.readablePaths() {
+		name = encodeReadable(serverURL)
+	}
+	if len(name) > maxEncodedLength {
+		return hashServerURL(serverURL), nil
+	}
+	return name, nil
+}
+
+// maxEncodedLength is the length of the longest folder name a server URL is
+// encoded to, the file name limit of common filesystems. Longer names are
+// replaced by a hash of the server URL.
+const maxEncodedLength = 255
+
+// hashedPrefix prefixes the folder names of server URLs too long to encode.
+// Neither base64-url encoded nor readable names ever contain "+".
+const hashedPrefix = "+sha256-"
+
+// hashServerURL returns the folder name of a server URL too long to encode:
+// hashedPrefix followed by the hex encoded SHA-256 hash of the server URL.
+// The server URL is only recovered from the server_url metadata of the
+// credentials stored in the folder.
+func hashServerURL(serverURL string) string {
+	sum := sha256.Sum256([]byte(serverURL))
+	return hashedPrefix + hex.EncodeToString(sum[:])
+}
+
+// isHashedName reports whether name was returned by hashServerURL.
+func isHashedName(name string) bool {
+	digest := strings.TrimPrefix(name, hashedPrefix)
+	if digest == name || len(digest) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil && strings.ToLower(digest) == digest
+}
+
+// encodeReadable returns a readable folder name for serverURL: "/" is replaced
+// by "~", and every character but ASCII letters, digits, ".", "-" and "_" is
+// percent-encoded, such as "https%3A~~registry.example.com%3A5000~v1". A
+// leading "." is percent-encoded so that the folder is not hidden, and so is
+// the first character of names that would otherwise contain none of
+// readableMarkers, so that they are never mistaken for base64-url encoded
+// names.
+func encodeReadable(serverURL string) string {
+	var b strings.Builder
+	for i := 0; i < len(serverURL); i++ {
+		c := serverURL[i]
+		switch {
+		case c == '/':
+			b.WriteByte('~')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	name := b.String()
+	if name != "" && !strings.ContainsAny(name, readableMarkers) {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	return name
+}
+
+// EncodeServerURL returns the base64-url encoding of serverURL, the name of
+// the folder its credentials are stored under by default. The server URL is
+// encoded as is: neither normalized, nor hashed as the server URLs too long
+// to encode are when storing credentials.
+func EncodeServerURL(serverURL string) string {
+	return base64.URLEncoding.EncodeToString([]byte(serverURL))
+}
+
+// DecodeServerURL decodes the name of a folder holding the credentials of a
+// server URL, either base64-url encoded or readable. It returns an error for
+// names that are not the canonical encoding of a non-empty UTF-8 server URL,
+// such as the .git folder of a git-backed store, or names that are not valid
+// UTF-8 themselves.
+func DecodeServerURL(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid encoded server url %q: not valid UTF-8", name)
+	}
+	if strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid encoded server url %q: hidden names are never encoded server urls", name)
+	}
+
+	if strings.ContainsAny(name, readableMarkers) {
+		serverURL, ok := decodeReadable(name)
+		if !ok {
+			return "", fmt.Errorf("invalid encoded server url %q: not a canonical readable name", name)
+		}
+		return serverURL, nil
+	}
+
+	serverURL, err := base64.URLEncoding.DecodeString(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid encoded server url %q: %v", name, err)
+	}
+	if len(serverURL) == 0 || !utf8.Valid(serverURL) {
+		return "", fmt.Errorf("invalid encoded server url %q: must encode a non-empty UTF-8 string", name)
+	}
+	if EncodeServerURL(string(serverURL)) != name {
+		return "", fmt.Errorf("invalid encoded server url %q: not a canonical base64-url encoding", name)
+	}
+	return string(serverURL), nil
+}
+
+// decodeReadable decodes a folder name returned by encodeReadable.
+func decodeReadable(name string) (string, bool) {
+	serverURL, err := url.PathUnescape(strings.ReplaceAll(name, "~", "/"))
+	if err != nil || serverURL == "" || !utf8.ValidString(serverURL) {
+		return "", false
+	}
+	if encodeReadable(serverURL) != name {
+		return "", false
+	}
+	return serverURL, true
+}
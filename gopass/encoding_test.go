@@ -0,0 +1,46 @@
+package gopass
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzServerURLEncoding(f *testing.F) {
+	for _, serverURL := range []string{
+		"https://index.docker.io/v1/",
+		"registry.example.com:5000",
+		"https://registry.example.com/a/b/c",
+		"ünïcode.example",
+		"null\x00byte",
+		".hidden",
+		"~%.",
+		"+sha256-",
+	} {
+		f.Add(serverURL)
+	}
+
+	f.Fuzz(func(t *testing.T, serverURL string) {
+		if serverURL == "" || !utf8.ValidString(serverURL) {
+			// Server URLs are non-empty UTF-8 strings, the only ones
+			// listed back.
+			if _, err := DecodeServerURL(EncodeServerURL(serverURL)); err == nil {
+				t.Fatalf("expected %q not to decode", serverURL)
+			}
+			return
+		}
+
+		for name, encoded := range map[string]string{"base64-url": EncodeServerURL(serverURL), "readable": encodeReadable(serverURL)} {
+			if strings.ContainsAny(encoded, "/\\\x00") || strings.HasPrefix(encoded, ".") {
+				t.Fatalf("%s: expected %q to be a visible file name, actual %q", name, serverURL, encoded)
+			}
+			decoded, err := DecodeServerURL(encoded)
+			if err != nil {
+				t.Fatalf("%s: expected %q to decode, actual: %v", name, encoded, err)
+			}
+			if decoded != serverURL {
+				t.Fatalf("%s: expected %q to round-trip, actual %q", name, serverURL, decoded)
+			}
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// gopassEnvAllowListEnv is the environment variable holding comma or
+// whitespace separated names of the environment variables passed to gopass,
+// in addition to requiredEnv.
+const gopassEnvAllowListEnv = "GOPASS_ENV_ALLOWLIST"
+
+// requiredEnv are the environment variables always passed to gopass when the
+// environment is restricted to an allow-list, as gopass and gpg cannot find
+// the store or keys without them.
+var requiredEnv = []string{"HOME", "GNUPGHOME", "GOPASS_HOMEDIR", "PATH"}
+
+// envAllowList returns the names of the environment variables passed to
+// gopass, or nil if gopass inherits the whole environment of the helper.
+func (g Gopass) envAllowList() ([]string, error) {
+	names := g.config().envAllowList
+	if names == nil {
+		v := os.Getenv(gopassEnvAllowListEnv)
+		if v == "" {
+			return nil, nil
+		}
+		names = strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		})
+	}
+
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, fmt.Errorf("invalid %s entry %q: must be the name of an environment variable", gopassEnvAllowListEnv, name)
+		}
+	}
+	return append(append([]string{}, requiredEnv...), names...), nil
+}
+
+// gopassEnv returns the environment gopass is run with, followed by extra,
+// or nil if gopass inherits the environment of the helper unchanged. Only the
+// allowed environment variables of the helper are passed if an allow-list is
+// configured.
+func (g Gopass) gopassEnv(extra ...string) ([]string, error) {
+	allowed, err := g.envAllowList()
+	if err != nil {
+		return nil, err
+	}
+	if allowed == nil {
+		if len(extra) == 0 {
+			return nil, nil
+		}
+		return append(os.Environ(), extra...), nil
+	}
+
+	env := []string{}
+	seen := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env, extra...), nil
+}
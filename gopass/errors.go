@@ -0,0 +1,190 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// redacted replaces secret content in errors.
+const redacted = "[REDACTED]"
+
+// ErrReadOnly is returned when adding or deleting credentials while the
+// helper is in read-only mode.
+var ErrReadOnly = errors.New("gopass credentials helper is read-only")
+
+// ErrCredentialsExist is returned when adding credentials for a username that
+// is already stored for the server URL, while overwriting is disabled.
+var ErrCredentialsExist = errors.New("credentials already exist")
+
+// ErrStoreBusy is returned when adding or deleting credentials while another
+// writer holds the lock file of the store for longer than the lock timeout.
+var ErrStoreBusy = errors.New("gopass store is busy")
+
+// ErrStoreNotFound is returned when listing credentials while the store
+// directory reported by gopass does not exist.
+var ErrStoreNotFound = errors.New("gopass store directory does not exist")
+
+// ErrPassphraseRequired is returned when gopass fails to decrypt a secret
+// because the gpg key is locked while no passphrase can be prompted for.
+var ErrPassphraseRequired = errors.New("passphrase required but no interactive input available")
+
+// ErrGopassNotInstalled is returned when the gopass binary cannot be found,
+// in which case gopass needs to be installed.
+var ErrGopassNotInstalled = errors.New("gopass is not installed") //nolint:revive
+
+// ErrGopassNotInitialized is returned when gopass is installed but fails to
+// list the store, typically because `gopass init` has not been run yet.
+var ErrGopassNotInitialized = errors.New("gopass is not initialized") //nolint:revive
+
+// GopassError is returned when a gopass invocation fails. It never contains
+// the secret written to, or read from, gopass.
+type GopassError struct { //nolint:revive
+	// Args are the arguments gopass was invoked with.
+	Args []string
+	// ExitCode is the exit code of gopass, or -1 if it did not exit.
+	ExitCode int
+	// Stderr is the trimmed standard error output of gopass.
+	Stderr string
+	// Stdout is the trimmed standard output of gopass, for diagnostics. It
+	// is replaced by "[REDACTED]" for subcommands whose output may hold a
+	// secret, such as show.
+	Stdout string
+	// Prompt is the question gopass asked interactively before failing, if
+	// any. The helper never answers such questions.
+	Prompt string
+
+	err error
+}
+
+// newGopassError creates a GopassError for a failed invocation, redacting
+// the secret sent on stdin from args and stderr.
+func newGopassError(err error, exitCode int, stdin, stderr string, args []string) *GopassError {
+	return &GopassError{
+		Args:     redactArgs(args, stdin),
+		ExitCode: exitCode,
+		Stderr:   redact(strings.TrimSpace(stderr), stdin),
+		err:      err,
+	}
+}
+
+// Error returns the failed command, its exit code, its error output and its
+// output, if any.
+func (e *GopassError) Error() string {
+	msg := fmt.Sprintf("gopass %s failed with exit code %d", strings.Join(e.Args, " "), e.ExitCode)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	if e.Stdout != "" && e.Stdout != e.Prompt {
+		msg += " (output: " + e.Stdout + ")"
+	}
+	if e.Prompt != "" {
+		msg += fmt.Sprintf(" (gopass asked %q, which cannot be answered non-interactively)", e.Prompt)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error returned when running gopass.
+func (e *GopassError) Unwrap() error {
+	return e.err
+}
+
+// ReadError is returned when credentials are stored for a server URL but
+// their secret cannot be read, such as when gpg fails to decrypt it. Unlike
+// credentials not found, it means the credentials exist.
+type ReadError struct {
+	// ServerURL is the server URL whose credentials could not be read.
+	ServerURL string
+	// Username is the username whose secret could not be read.
+	Username string
+
+	err error
+}
+
+// Error returns the credentials that could not be read and the reason.
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("unable to read the credentials of %s for %s: %v", e.Username, e.ServerURL, e.err)
+}
+
+// Unwrap returns the error returned when reading the secret.
+func (e *ReadError) Unwrap() error {
+	return e.err
+}
+
+// secretOutputs are the gopass subcommands whose standard output may hold a
+// secret, and must never end up in an error.
+var secretOutputs = map[string]bool{
+	"cat":  true,
+	"show": true,
+}
+
+// safeStdout returns the standard output of gopass invoked with args, or an
+// empty string if it may hold a secret.
+func safeStdout(args []string, stdout string) string {
+	if secretOutputs[operation(args)] {
+		return ""
+	}
+	return stdout
+}
+
+// diagnosticStdout returns the trimmed standard output of gopass invoked with
+// args for a GopassError, with the secret sent on stdin redacted, or redacted
+// as a whole if it may hold a secret.
+func diagnosticStdout(args []string, stdin, stdout string) string {
+	stdout = strings.TrimSpace(stdout)
+	if stdout == "" {
+		return ""
+	}
+	if safeStdout(args, stdout) == "" {
+		return redacted
+	}
+	return redact(stdout, stdin)
+}
+
+// redact replaces every occurrence of secret in s. Each line of a multi-line
+// secret is redacted on its own, so partial echoes are caught as well.
+func redact(s, secret string) string {
+	for _, line := range strings.Split(secret, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			s = strings.ReplaceAll(s, line, redacted)
+		}
+	}
+	return s
+}
+
+// redactArgs returns a copy of args with secret redacted.
+func redactArgs(args []string, secret string) []string {
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		redactedArgs[i] = redact(arg, secret)
+	}
+	return redactedArgs
+}
+
+// joinedError aggregates the errors of operations that carry on after
+// individual failures.
+type joinedError struct {
+	errs []error
+}
+
+// joinErrors returns an error aggregating errs, or nil if errs is empty.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &joinedError{errs: errs}
+}
+
+// Error returns the messages of the aggregated errors, one per line.
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the aggregated errors.
+func (e *joinedError) Unwrap() []error {
+	return e.errs
+}
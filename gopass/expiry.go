@@ -0,0 +1,175 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// metadataExpiresAt is the metadata key holding the time at which
+// credentials added by AddWithExpiry expire, formatted as RFC 3339.
+const metadataExpiresAt = "expires_at"
+
+// gopassHideExpiredEnv is the environment variable used to make Get treat
+// expired credentials as not found.
+const gopassHideExpiredEnv = "GOPASS_HIDE_EXPIRED"
+
+// AddWithExpiry adds new credentials to the keychain along with the time at
+// which they expire, stored in their expires_at field. Expired credentials
+// are deleted by Prune, and are not found by Get if configured.
+func (g Gopass) AddWithExpiry(creds *credentials.Credentials, expiresAt time.Time) (err error) {
+	defer g.observe("AddWithExpiry", time.Now(), &err)
+
+	if expiresAt.IsZero() {
+		return errors.New("missing expiry")
+	}
+	return g.add(creds, map[string]string{metadataExpiresAt: expiresAt.UTC().Format(time.RFC3339)})
+}
+
+// hideExpired reports whether Get treats expired credentials as not found.
+func (g Gopass) hideExpired() bool {
+	return g.config().hideExpired || os.Getenv(gopassHideExpiredEnv) == "1"
+}
+
+// expired reports whether the credentials holding metadata have expired.
+// Credentials stored without expiry never expire.
+func expired(metadata map[string]string, now time.Time) (bool, error) {
+	expiresAt, err := expiry(metadata)
+	if err != nil || expiresAt.IsZero() {
+		return false, err
+	}
+	return !now.Before(expiresAt), nil
+}
+
+// expiry returns the time at which the credentials holding metadata expire,
+// or the zero time if they were stored without expiry.
+func expiry(metadata map[string]string) (time.Time, error) {
+	v, ok := metadata[metadataExpiresAt]
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: must be an RFC 3339 time", metadataExpiresAt, v)
+	}
+	return expiresAt, nil
+}
+
+// showUnexpiredSecret returns the secret stored at the given gopass path, as
+// showSecret does, reading the secret once, along with the time at which the
+// credentials expire, if any. It reports false if they have expired. The
+// whole secret is read to find its expiry, so no show template may be
+// configured.
+func (g Gopass) showUnexpiredSecret(p string) (string, time.Time, bool, error) {
+	_, custom, err := g.showTemplate()
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	if custom {
+		return "", time.Time{}, false, fmt.Errorf("%s cannot be combined with %s", gopassShowTemplateEnv, gopassHideExpiredEnv)
+	}
+
+	field, err := g.secretField()
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+
+	secret, metadata, err := g.showSecretWithMetadata(p)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	if field != "" {
+		var ok bool
+		if secret, ok = metadata[field]; !ok {
+			return "", time.Time{}, false, fmt.Errorf("field %q is not stored in %s", field, p)
+		}
+	}
+
+	expiresAt, err := expiry(metadata)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return secret, expiresAt, expiresAt.IsZero() || time.Now().Before(expiresAt), nil
+}
+
+// Prune deletes every credential whose expiry is in the past, and returns how
+// many were deleted. It decrypts every secret in every folder List lists to
+// read its expiry. Credentials stored without expiry are never deleted.
+// Failing to read or delete a credential does not stop the pruning: the
+// errors are returned together once every credential has been tried.
+func (g Gopass) Prune() (pruned int, err error) {
+	defer g.observe("Prune", time.Now(), &err)
+
+	if err := g.checkWritable("prune"); err != nil {
+		return 0, err
+	}
+
+	listed, err := g.listedFolders()
+	if err != nil {
+		return 0, err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.config().cache.clear()
+
+	unlock, err := lockStores(listed)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	var errs []error
+	for _, h := range listed {
+		n, folderErrs := h.prune(now)
+		pruned += n
+		errs = append(errs, folderErrs...)
+	}
+	return pruned, joinErrors(errs)
+}
+
+// prune deletes the expired credentials of the folder of g, as Prune does,
+// and returns how many were deleted along with the errors met.
+func (g Gopass) prune(now time.Time) (pruned int, errs []error) {
+	err := g.walkServers(false, func(_ string, loc serverLocation, usernames []string) error {
+		removed := 0
+		for _, username := range usernames {
+			p := loc.secretPath(username)
+			_, metadata, err := g.showSecretWithMetadata(p)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to read the expiry of %s: %w", p, err))
+				continue
+			}
+
+			isExpired, err := expired(metadata, now)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to read the expiry of %s: %w", p, err))
+				continue
+			}
+			if !isExpired {
+				continue
+			}
+
+			if _, err := g.runGopass("", "rm", "-f", p); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete %s: %w", p, err))
+				continue
+			}
+			removed++
+		}
+
+		pruned += removed
+		if removed == len(usernames) {
+			return g.removeEmptyServerDir(loc)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return pruned, errs
+}
@@ -0,0 +1,83 @@
+package gopass
+
+import (
+	"os"
+	"strings"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// gopassFallbackFoldersEnv is the environment variable holding comma or
+// whitespace separated folders Get and List fall back to, in order, after the
+// credentials folder.
+const gopassFallbackFoldersEnv = "GOPASS_FALLBACK_FOLDERS"
+
+// fallbackFolders returns the cleaned folders searched after the credentials
+// folder, in priority order.
+func (g Gopass) fallbackFolders() ([]string, error) {
+	name, folders := "fallback folder", g.config().fallbackFolders
+	if folders == nil {
+		name = gopassFallbackFoldersEnv
+		folders = strings.FieldsFunc(os.Getenv(gopassFallbackFoldersEnv), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		})
+	}
+
+	cleaned := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		folder, err := cleanStorePath(name, folder)
+		if err != nil {
+			return nil, err
+		}
+		cleaned = append(cleaned, folder)
+	}
+	return cleaned, nil
+}
+
+// searchedFolders returns g, which reads and writes the credentials folder,
+// followed by a copy of g reading each fallback folder, in priority order.
+// Folders are searched once, even if configured several times.
+func (g Gopass) searchedFolders() ([]Gopass, error) {
+	fallbacks, err := g.fallbackFolders()
+	if err != nil {
+		return nil, err
+	}
+	if len(fallbacks) == 0 {
+		return []Gopass{g}, nil
+	}
+
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	searched := []Gopass{g}
+	seen := map[string]bool{folder: true}
+	for _, fallback := range fallbacks {
+		if seen[fallback] {
+			continue
+		}
+		seen[fallback] = true
+
+		h := g
+		h.folder = fallback
+		searched = append(searched, h)
+	}
+	return searched, nil
+}
+
+// searchFolders calls fn with every searched folder in priority order, until
+// fn returns anything but credentials not found.
+func (g Gopass) searchFolders(fn func(h Gopass) error) error {
+	searched, err := g.searchedFolders()
+	if err != nil {
+		return err
+	}
+
+	for _, h := range searched {
+		if err = fn(h); !credentials.IsErrCredentialsNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -4,20 +4,63 @@
 // "$GOPASS_FOLDER/base64-url(serverURL)/username"
 //
 // We base64-url encode the serverURL, because under the hood gopass uses files
-// and folders, so /s will get translated into additional folders.
+// and folders, so /s will get translated into additional folders. Server URLs
+// whose encoding is longer than 255 bytes, the file name limit of common
+// filesystems, are stored under "+sha256-" followed by the hex encoded
+// SHA-256 hash of the server URL instead. Listing them decrypts one of their
+// secrets to read back the server URL.
+//
+// The secret is stored on the first line of the gopass secret, followed by
+// "key: value" metadata lines. Secrets spanning several lines, such as PEM
+// blobs, are stored base64 encoded with a "secret_encoding: base64" metadata
+// line, and decoded when read back. Usernames that cannot be used as the name
+// of a secret, such as usernames containing "/" or starting with ".", are
+// stored under "+b64-" followed by their base64-url encoding instead, with
+// the username in the "username" field.
+//
+// The helper is configured through environment variables, such as
+// GOPASS_MOUNT, or programmatically by creating it with New, in which case
+// the options take precedence over the environment. Each Option documents
+// the environment variable it stands for, if any.
+//
+// gopass is run with the environment of the helper, so that it honors
+// GOPASS_HOMEDIR and its other environment variables, and with its standard
+// input closed once the secret is written to it, so that questions gopass
+// asks unexpectedly fail rather than wait for an answer. The store is read
+// from the directory reported by `gopass config mounts.path`, in which a
+// leading "~" is expanded to GOPASS_HOMEDIR if set, as gopass does. If gopass
+// fails to report the directory of the root store, or reports an empty one,
+// "$GOPASS_HOMEDIR/.local/share/gopass/stores/root" is read instead if it
+// exists, and "$XDG_DATA_HOME/gopass/stores/root" otherwise, or
+// "~/.local/share/gopass/stores/root" if XDG_DATA_HOME is unset.
+//
+// gopass 1.10.0 or later is required. Before the first operation, and again
+// once the result is stale, the helper checks that gopass is initialized and
+// recent enough, reporting ErrGopassNotInitialized otherwise.
+//
+// Adding and deleting credentials is serialized within the process, as gopass
+// does not tolerate concurrent writes to the store, and does not trigger the
+// git autosync of gopass unless configured.
 package gopass
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/docker/docker-credential-helpers/credentials"
 )
@@ -25,207 +68,2046 @@ import (
 // GOPASS_FOLDER contains the directory where credentials are stored
 const GOPASS_FOLDER = "docker-credential-helpers" //nolint:revive
 
-// Gopass handles secrets using gopass as a store.
-type Gopass struct{}
+// gopassFolderEnv is the environment variable used to override GOPASS_FOLDER.
+const gopassFolderEnv = "DOCKER_CREDENTIAL_GOPASS_FOLDER"
+
+// gopassMountEnv is the environment variable used to select the gopass mount
+// credentials are stored in.
+const gopassMountEnv = "GOPASS_MOUNT"
+
+// gopassReadOnlyEnv is the environment variable used to refuse modifications
+// of the store.
+const gopassReadOnlyEnv = "GOPASS_READ_ONLY"
+
+// gopassNoOverwriteEnv is the environment variable used to refuse
+// overwriting the credentials already stored for a username.
+const gopassNoOverwriteEnv = "GOPASS_NO_OVERWRITE"
+
+// gopassGlobalArgsEnv is the environment variable holding whitespace
+// separated global flags passed to every gopass invocation.
+const gopassGlobalArgsEnv = "GOPASS_GLOBAL_ARGS"
+
+// gopassAutoSyncEnv is the environment variable used to let gopass autosync
+// after adding or deleting credentials.
+const gopassAutoSyncEnv = "DOCKER_CREDENTIAL_GOPASS_AUTOSYNC"
+
+// writeOperations are the gopass subcommands modifying the store, for which
+// autosync is disabled unless enabled through gopassAutoSyncEnv.
+var writeOperations = map[string]bool{
+	// cat only modifies the store when given a secret on stdin, but reading
+	// it is neither affected by autosync nor retried unless failing
+	// transiently.
+	"cat": true,
+	// fsck re-encrypts secrets when run by Rekey.
+	"fsck":   true,
+	"insert": true,
+	"rm":     true,
+}
+
+// gopassFullInitCheckEnv is the environment variable used to list the whole
+// store, rather than the credentials folder only, when checking that gopass is
+// initialized.
+const gopassFullInitCheckEnv = "GOPASS_FULL_INIT_CHECK"
+
+// gopassInitCheckArgsEnv is the environment variable holding the whitespace
+// separated gopass arguments run to check that gopass is initialized, instead
+// of listing the store.
+const gopassInitCheckArgsEnv = "GOPASS_INIT_CHECK_ARGS"
+
+// gopassSkipInitCheckEnv is the environment variable used to treat gopass as
+// initialized without checking it.
+const gopassSkipInitCheckEnv = "GOPASS_SKIP_INIT_CHECK"
+
+// gopassFieldEnv is the environment variable naming the field of gopass
+// secrets holding the secret, instead of their first line.
+const gopassFieldEnv = "DOCKER_CREDENTIAL_GOPASS_FIELD"
+
+// gopassLegacyFallbackEnv is the environment variable used to let Get fall back
+// to credentials stored under the plain server URL.
+const gopassLegacyFallbackEnv = "GOPASS_LEGACY_FALLBACK"
+
+// gopassBinaryEnv is the environment variable used to override the gopass
+// binary that is executed.
+const gopassBinaryEnv = "GOPASS_BINARY"
+
+// gopassTimeoutEnv is the environment variable used to override the timeout
+// applied to gopass invocations, parsed as a time.Duration.
+const gopassTimeoutEnv = "GOPASS_TIMEOUT"
+
+// defaultGopassTimeout is the timeout used when gopassTimeoutEnv is unset. It
+// leaves enough room for gpg-agent to prompt for a passphrase.
+const defaultGopassTimeout = time.Minute
+
+// gopassInitTimeoutEnv is the environment variable used to override the
+// deadline of the check that gopass is initialized, parsed as a
+// time.Duration.
+const gopassInitTimeoutEnv = "GOPASS_INIT_TIMEOUT"
+
+// gopassInitTTLEnv is the environment variable used to override how long
+// gopass is known to be initialized once checked, parsed as a time.Duration.
+const gopassInitTTLEnv = "GOPASS_INIT_TTL"
+
+// defaultGopassInitTTL is the initialization TTL used when gopassInitTTLEnv
+// is unset.
+const defaultGopassInitTTL = 5 * time.Minute
+
+// defaultGopassBinary is the gopass binary used when gopassBinaryEnv is unset.
+const defaultGopassBinary = "gopass"
+
+// Gopass handles secrets using gopass as a store. The zero value is
+// configured through the environment; use New to configure it otherwise.
+type Gopass struct {
+	cfg *config
+
+	// folder and mount are the cleaned folder and mount used instead of the
+	// configured ones, if set, by fallback folders and routes.
+	folder string
+	mount  string
+	// batch makes gpg fail rather than prompt for a passphrase, whatever
+	// the configuration, as IsLocked requires.
+	batch bool
+}
+
+// defaultGopass is the instance the zero value of Gopass, and every copy of
+// it, operates as. It is configured through the environment only, and its
+// initialization state is shared for the lifetime of the process.
+var defaultGopass = New()
+
+// writeMutex serializes the modifications of the store made by the process,
+// as concurrent gopass and git writes may corrupt it. Reads do not take it, so
+// Get and List are never blocked by a modification in progress.
+var writeMutex sync.Mutex
+
+// config returns the configuration and state of g.
+func (g Gopass) config() *config {
+	if g.cfg == nil {
+		return defaultGopass.cfg
+	}
+	return g.cfg
+}
+
+// resetCache clears the cached initialization state and store directories of
+// the zero value of Gopass, so that they are resolved again on next use.
+func resetCache() {
+	defaultGopass.cfg.reset()
+}
 
-// Ideally these would be stored as members of Gopass, but since all of Gopass's
-// methods have value receivers, not pointer receivers, and changing that is
-// backwards incompatible, we assume that all Gopass instances share the same
-// configuration
+// Close releases the state held by the helper: the cached initialization
+// check and store directories, which are resolved again if the helper is used
+// afterwards, and the cached credentials, whose secrets are zeroed. gopass
+// and pinentry are run anew for every operation, so no process outlives the
+// call that spawned it. Close may be called several times, and on the zero
+// value of Gopass, in which case the state shared by every zero value is
+// released.
+func (g Gopass) Close() (err error) {
+	defer g.observe("Close", time.Now(), &err)
 
-// initializationMutex is held while initializing so that only one 'gopass'
-// round-tripping is done to check that gopass is functioning.
-var initializationMutex sync.Mutex
-var gopassInitialized bool
+	g.config().reset()
+	return nil
+}
 
 // CheckInitialized checks whether the password helper can be used. It
 // internally caches and so may be safely called multiple times with no impact
-// on performance, though the first call may take longer.
+// on performance, though the first call may take longer. The cache is held
+// per instance: a Gopass created with New checks initialization again.
 func (g Gopass) CheckInitialized() bool {
-	return g.checkInitialized() == nil
+	start := time.Now()
+	err := g.checkInitialized()
+	g.observe("CheckInitialized", start, &err)
+	return err == nil
 }
 
 func (g Gopass) checkInitialized() error {
-	initializationMutex.Lock()
-	defer initializationMutex.Unlock()
-	if gopassInitialized {
+	ttl, err := g.initTTL()
+	if err != nil {
+		return err
+	}
+
+	cfg := g.config()
+	cfg.initializationMutex.Lock()
+	defer cfg.initializationMutex.Unlock()
+	if cfg.initialized && (ttl == 0 || time.Since(cfg.initializedAt) < ttl) {
+		return nil
+	}
+	cfg.initialized = false
+
+	if cfg.runner == nil {
+		r, err := g.resolveGopassRunner()
+		if err != nil {
+			return err
+		}
+		cfg.resolvedRunner = r
+	}
+
+	if g.skipInitCheck() {
+		cfg.initialized = true
+		cfg.initializedAt = time.Now()
 		return nil
 	}
 
+	// The whole check shares a deadline, so that a hanging gpg-agent or
+	// pinentry fails it rather than blocking the caller.
+	timeout, err := g.initTimeout()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
 	// We just run a `gopass ls`, if it fails then gopass is not initialized.
-	_, err := g.runGopassHelper("", "ls", "--flat")
+	err = g.probeGopass(func(args ...string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := g.runGopassHelperContext(ctx, "", args...)
+		return err
+	})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: check timed out after %s", ErrGopassNotInitialized, timeout)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// The binary was removed since it was looked up.
+		return fmt.Errorf("%w: %v", ErrGopassNotInstalled, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrGopassNotInitialized, err)
+	}
+
+	// Releases whose version cannot be parsed, such as development builds,
+	// are assumed to be recent enough.
+	out, err := g.runGopassHelperContext(ctx, "", "version")
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: check timed out after %s", ErrGopassNotInitialized, timeout)
+	}
 	if err != nil {
-		return fmt.Errorf("gopass is not initialized: %v", err)
+		return fmt.Errorf("unable to get gopass version: %v", err)
+	}
+	if version, err := parseGopassVersion(out); err == nil {
+		if err := checkGopassVersion(version); err != nil {
+			return err
+		}
 	}
-	gopassInitialized = true
+
+	cfg.initialized = true
+	cfg.initializedAt = time.Now()
 	return nil
 }
 
-func (g Gopass) runGopass(stdinContent string, args ...string) (string, error) {
-	if err := g.checkInitialized(); err != nil {
-		return "", err
+// initTimeout returns the deadline of the check that gopass is initialized:
+// the configured timeout or value of gopassInitTimeoutEnv if set, the timeout
+// applied to gopass invocations otherwise. A zero timeout disables the
+// deadline.
+func (g Gopass) initTimeout() (time.Duration, error) {
+	if cfg := g.config(); cfg.hasInitTimeout {
+		return cfg.initTimeout, nil
+	}
+
+	v := os.Getenv(gopassInitTimeoutEnv)
+	if v == "" {
+		return g.gopassTimeout()
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassInitTimeoutEnv, v)
 	}
-	return g.runGopassHelper(stdinContent, args...)
+	return timeout, nil
 }
 
-func (g Gopass) runGopassHelper(stdinContent string, args ...string) (string, error) {
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("gopass", args...)
-	cmd.Stdin = strings.NewReader(stdinContent)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// initTTL returns how long gopass is known to be initialized once checked:
+// the configured TTL or value of gopassInitTTLEnv if set,
+// defaultGopassInitTTL otherwise. A zero TTL never expires.
+func (g Gopass) initTTL() (time.Duration, error) {
+	if cfg := g.config(); cfg.hasInitTTL {
+		return cfg.initTTL, nil
+	}
 
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("%s: %s", err, stderr.String())
+	v := os.Getenv(gopassInitTTLEnv)
+	if v == "" {
+		return defaultGopassInitTTL, nil
 	}
 
-	// trim newlines; gopass includes a newline at the end of `show` output
-	return strings.TrimRight(stdout.String(), "\n\r"), nil
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassInitTTLEnv, v)
+	}
+	return ttl, nil
 }
 
-// Add adds new credentials to the keychain.
-func (g Gopass) Add(creds *credentials.Credentials) error {
-	if creds == nil {
-		return errors.New("missing credentials")
+// probeGopass checks that gopass is functioning by listing the credentials
+// folder through run, so that large shared stores are not listed as a whole.
+// As the folder does not exist until credentials are first added, the whole
+// store is listed if listing the folder fails, or if configured. The
+// configured init check arguments are run instead, if any.
+func (g Gopass) probeGopass(run func(args ...string) error) error {
+	args, err := g.initCheckArgs()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return run(args...)
 	}
 
-	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	if g.fullInitCheck() {
+		return run("ls", "--flat")
+	}
 
-	_, err := g.runGopass(creds.Secret, "insert", "-f", path.Join(GOPASS_FOLDER, encoded, creds.Username))
-	return err
+	folder, err := g.secretFolder()
+	if err != nil {
+		return err
+	}
+	if err := run("ls", "--flat", folder); err == nil {
+		return nil
+	}
+	return run("ls", "--flat")
 }
 
-// Delete removes credentials from the store.
-func (g Gopass) Delete(serverURL string) error {
-	if serverURL == "" {
-		return errors.New("missing server url")
+// fullInitCheck reports whether the whole store is listed to check that
+// gopass is functioning.
+func (g Gopass) fullInitCheck() bool {
+	return g.config().fullInitCheck || os.Getenv(gopassFullInitCheckEnv) == "1"
+}
+
+// initCheckArgs returns the configured gopass arguments, or value of
+// gopassInitCheckArgsEnv, run to check that gopass is initialized, if any.
+func (g Gopass) initCheckArgs() ([]string, error) {
+	args := g.config().initCheckArgs
+	if args == nil {
+		args = strings.Fields(os.Getenv(gopassInitCheckArgsEnv))
+	}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, "\x00\r\n") {
+			return nil, fmt.Errorf("invalid %s argument %q: must be a single line", gopassInitCheckArgsEnv, arg)
+		}
 	}
+	return args, nil
+}
 
-	encoded := base64.URLEncoding.EncodeToString([]byte(serverURL))
-	_, err := g.runGopass("", "rm", "-rf", path.Join(GOPASS_FOLDER, encoded))
-	return err
+// skipInitCheck reports whether gopass is treated as initialized without
+// checking it.
+func (g Gopass) skipInitCheck() bool {
+	return g.config().skipInitCheck || os.Getenv(gopassSkipInitCheckEnv) == "1"
 }
 
-func (g Gopass) getGopassDir() (string, error) {
-	gopassDir, err := g.runGopass("", "config", "mounts.path")
+// HealthCheck checks whether gopass is currently functioning by running a
+// fresh `gopass ls`. Unlike CheckInitialized, which remains cached for the
+// fast path of the credential helper protocol, it neither consults nor
+// updates the initialization cache, so it may be used to probe liveness.
+func (g Gopass) HealthCheck() (err error) {
+	defer g.observe("HealthCheck", time.Now(), &err)
 
-	if err != nil {
-		return "", fmt.Errorf("error getting gopass dir: %v", err)
+	r := g.config().runner
+	if r == nil {
+		resolved, err := g.resolveGopassRunner()
+		if err != nil {
+			return err
+		}
+		r = resolved
 	}
 
-	ret := os.ExpandEnv(gopassDir)
-
-	if strings.HasPrefix(ret, "~/") {
-		d, err := os.UserHomeDir()
+	ctx, cancel, err := g.timeoutContext()
+	if err != nil {
+		return err
+	}
+	defer cancel()
 
+	err = g.probeGopass(func(args ...string) error {
+		args, err := g.gopassArgs(args...)
 		if err != nil {
-			message := fmt.Sprintf("unable to get user home directory: %v", err.Error())
-			return "", errors.New(message)
+			return err
 		}
+		_, err = r.run(ctx, nil, "", args...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("gopass is not functioning: %w", err)
+	}
+	return nil
+}
 
-		ret = path.Join(d, ret[2:])
+// resolveGopassRunner returns the runner executing the configured wrapper, if
+// any, or the gopass binary otherwise.
+func (g Gopass) resolveGopassRunner() (execRunner, error) {
+	wrapper, err := g.wrapper()
+	if err != nil {
+		return execRunner{}, err
+	}
+	if wrapper != nil {
+		binary, err := exec.LookPath(wrapper[0])
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return execRunner{}, fmt.Errorf("%w: gopass wrapper %q was not found: %v", ErrGopassNotInstalled, wrapper[0], err)
+		}
+		if err != nil {
+			return execRunner{}, fmt.Errorf("gopass wrapper %q is not usable: %v", wrapper[0], err)
+		}
+		return execRunner{binary: binary, prefix: wrapper[1:]}, nil
 	}
 
-	return ret, nil
+	binary, err := g.resolveGopassBinary()
+	if err != nil {
+		return execRunner{}, err
+	}
+	return execRunner{binary: binary}, nil
 }
 
-// listGopassDir lists all the contents of a directory in the password store.
-// Gopass uses fancy unicode to emit stuff to stdout, so rather than try
-// and parse this, let's just look at the directory structure instead.
-func (g Gopass) listGopassDir(args ...string) ([]os.FileInfo, error) {
-	gopassDir, err := g.getGopassDir()
+// resolveGopassBinary returns the path of the gopass binary to execute, taken
+// from the configuration or gopassBinaryEnv if set. It fails if the binary
+// cannot be found, with ErrGopassNotInstalled, or is not executable.
+func (g Gopass) resolveGopassBinary() (string, error) {
+	name := g.config().binary
+	if name == "" {
+		name = os.Getenv(gopassBinaryEnv)
+	}
+	if name == "" {
+		name = defaultGopassBinary
+	}
+
+	binary, err := exec.LookPath(name)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: gopass binary %q was not found: %v", ErrGopassNotInstalled, name, err)
+	}
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("gopass binary %q is not usable: %v", name, err)
 	}
+	return binary, nil
+}
 
-	p := os.ExpandEnv(path.Join(append([]string{gopassDir, GOPASS_FOLDER}, args...)...))
+// gopassFolder returns the folder credentials are stored under: the cleaned
+// configured folder or value of gopassFolderEnv if set, GOPASS_FOLDER
+// otherwise, followed by the current OS user if credentials are stored per
+// user. The folders of fallback folders and routes are used as configured,
+// without the user.
+func (g Gopass) gopassFolder() (string, error) {
+	if g.folder != "" {
+		return g.folder, nil
+	}
 
-	entries, err := os.ReadDir(p)
+	folder, err := g.baseFolder()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []os.FileInfo{}, nil
-		}
-		return nil, err
+		return "", err
 	}
+	return g.userFolder(folder)
+}
 
-	infos := make([]fs.FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
-			return nil, err
+// baseFolder returns the cleaned configured folder or value of
+// gopassFolderEnv if set, GOPASS_FOLDER otherwise.
+func (g Gopass) baseFolder() (string, error) {
+	if folder := g.config().folder; folder != "" {
+		return cleanStorePath("folder", folder)
+	}
+	folder := os.Getenv(gopassFolderEnv)
+	if folder == "" {
+		return GOPASS_FOLDER, nil
+	}
+	return cleanStorePath(gopassFolderEnv, folder)
+}
+
+// gopassMount returns the cleaned mount of the route in use, the configured
+// mount or value of gopassMountEnv, or an empty string for the root store.
+func (g Gopass) gopassMount() (string, error) {
+	if g.mount != "" {
+		return g.mount, nil
+	}
+	if mount := g.config().mount; mount != "" {
+		return cleanStorePath("mount", mount)
+	}
+	mount := os.Getenv(gopassMountEnv)
+	if mount == "" {
+		return "", nil
+	}
+	return cleanStorePath(gopassMountEnv, mount)
+}
+
+// cleanStorePath cleans the path p configured through name, and rejects it if
+// it does not denote a path within the store.
+func cleanStorePath(name, p string) (string, error) {
+	p = path.Clean(p)
+	if p == "." || path.IsAbs(p) {
+		return "", fmt.Errorf("invalid %s %q: must be a relative path within the store", name, p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid %s %q: must not escape the store", name, p)
 		}
-		infos = append(infos, info)
 	}
-	return infos, nil
+	return p, nil
 }
 
-// Get returns the username and secret to use for a given registry server URL.
-func (g Gopass) Get(serverURL string) (string, string, error) {
-	if serverURL == "" {
-		return "", "", errors.New("missing server url")
+// checkWritable returns an error wrapping ErrReadOnly if the store may not be
+// modified by op.
+func (g Gopass) checkWritable(op string) error {
+	if g.config().readOnly || os.Getenv(gopassReadOnlyEnv) == "1" {
+		return fmt.Errorf("cannot %s credentials: %w", op, ErrReadOnly)
+	}
+	return nil
+}
+
+// validateUsername rejects usernames that cannot be stored. Usernames that
+// cannot be used as a single element of a gopass path are stored under an
+// encoded name, along with the username as metadata, which must be a single
+// line.
+func validateUsername(username string) error {
+	if username == "" {
+		return credentials.NewErrCredentialsMissingUsername()
 	}
+	if strings.ContainsAny(username, "\x00\r\n") {
+		return fmt.Errorf("invalid username %q: must be a single line without NUL characters", username)
+	}
+	return nil
+}
 
-	gopassDir, err := g.getGopassDir()
+// secretFolder returns the gopass path credentials are stored under: the
+// folder, prefixed by the mount if one is selected.
+func (g Gopass) secretFolder() (string, error) {
+	mount, err := g.gopassMount()
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
-	encoded := base64.URLEncoding.EncodeToString([]byte(serverURL))
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mount, folder), nil
+}
 
-	if _, err := os.Stat(path.Join(gopassDir, GOPASS_FOLDER, encoded)); err != nil {
-		if os.IsNotExist(err) {
-			return "", "", credentials.NewErrCredentialsNotFound()
+// runGopass runs gopass once it is known to be initialized. If gopass fails
+// because the gpg key is locked and pinentry is enabled, the key is unlocked
+// and gopass run again. Write operations failing transiently are retried if
+// configured.
+func (g Gopass) runGopass(stdinContent string, args ...string) (string, error) {
+	out, err := g.runGopassRetry(stdinContent, args...)
+	if err != nil && g.nonInteractive() && isLocked(err) {
+		return "", passphraseRequired(err)
+	}
+	if err != nil && g.usePinentry() && isLocked(err) {
+		if err := g.ensureUnlocked(); err != nil {
+			return "", err
 		}
+		return g.runGopassRetry(stdinContent, args...)
+	}
+	return out, err
+}
 
-		return "", "", err
+// runGopassTimeout runs gopass, bounding the invocation by the configured
+// timeout.
+func (g Gopass) runGopassTimeout(stdinContent string, args ...string) (string, error) {
+	ctx, cancel, err := g.timeoutContext()
+	if err != nil {
+		return "", err
 	}
+	defer cancel()
+	return g.runGopassContext(ctx, stdinContent, args...)
+}
 
-	usernames, err := g.listGopassDir(encoded)
+// timeoutContext returns a context bounded by the configured timeout.
+func (g Gopass) timeoutContext() (context.Context, context.CancelFunc, error) {
+	timeout, err := g.gopassTimeout()
 	if err != nil {
-		return "", "", err
+		return nil, nil, err
 	}
 
-	if len(usernames) < 1 {
-		return "", "", fmt.Errorf("no usernames for %s", serverURL)
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		return ctx, cancel, nil
 	}
+	return context.Background(), func() {}, nil
+}
 
-	actual := strings.TrimSuffix(usernames[0].Name(), ".gpg")
-	secret, err := g.runGopass("", "show", "-o", path.Join(GOPASS_FOLDER, encoded, actual))
+func (g Gopass) runGopassContext(ctx context.Context, stdinContent string, args ...string) (string, error) {
+	if err := g.checkInitialized(); err != nil {
+		return "", err
+	}
+	return g.runGopassHelperContext(ctx, stdinContent, args...)
+}
 
-	return actual, secret, err
+func (g Gopass) runGopassHelper(stdinContent string, args ...string) (string, error) {
+	return g.runGopassHelperContext(context.Background(), stdinContent, args...)
 }
 
-// List returns the stored URLs and corresponding usernames for a given credentials label
-func (g Gopass) List() (map[string]string, error) {
-	servers, err := g.listGopassDir()
+func (g Gopass) runGopassHelperContext(ctx context.Context, stdinContent string, args ...string) (string, error) {
+	var extra []string
+	if writeOperations[operation(args)] && !g.autoSync() {
+		extra = append(extra, "GOPASS_NO_AUTOSYNC=true")
+	}
+	if g.nonInteractive() {
+		extra = append(extra, nonInteractiveEnv())
+	}
+
+	env, err := g.gopassEnv(extra...)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	resp := map[string]string{}
+	args, err = g.gopassArgs(args...)
+	if err != nil {
+		return "", err
+	}
 
-	for _, server := range servers {
-		if !server.IsDir() {
-			continue
+	start := time.Now()
+	out, err := g.runner().run(ctx, env, stdinContent, args...)
+	if logf := g.config().logf; logf != nil {
+		// The secret is only ever sent on stdin or read from stdout, neither
+		// of which is logged, but it is redacted from args to be safe.
+		keyvals := []interface{}{
+			"subcommand", operation(args),
+			"args", redactArgs(args, stdinContent),
+			"duration", time.Since(start),
 		}
-
-		serverURL, err := base64.URLEncoding.DecodeString(server.Name())
 		if err != nil {
-			return nil, err
+			keyvals = append(keyvals, "error", err)
+		}
+		logf("gopass invocation", keyvals...)
+	}
+	return out, err
+}
+
+// secretField returns the configured field, or value of gopassFieldEnv, that
+// secrets are read from instead of their first line.
+func (g Gopass) secretField() (string, error) {
+	name, field := "field", g.config().field
+	if field == "" {
+		name, field = gopassFieldEnv, os.Getenv(gopassFieldEnv)
+	}
+	if strings.HasPrefix(field, "-") || strings.ContainsAny(field, ":\x00\r\n") {
+		return "", fmt.Errorf("invalid %s %q: must be a metadata key", name, field)
+	}
+	return field, nil
+}
+
+// legacyFallback reports whether Get falls back to credentials stored under
+// the plain server URL.
+func (g Gopass) legacyFallback() bool {
+	return g.config().legacyFallback || os.Getenv(gopassLegacyFallbackEnv) == "1"
+}
+
+// autoSync reports whether gopass may autosync after modifying the store.
+func (g Gopass) autoSync() bool {
+	return g.config().autoSync || os.Getenv(gopassAutoSyncEnv) == "1"
+}
+
+// gopassArgs returns the arguments to invoke gopass with: the configured
+// global flags, followed by the subcommand and its arguments.
+func (g Gopass) gopassArgs(args ...string) ([]string, error) {
+	globalArgs := g.config().globalArgs
+	if globalArgs == nil {
+		globalArgs = strings.Fields(os.Getenv(gopassGlobalArgsEnv))
+	}
+
+	for _, arg := range globalArgs {
+		// Flags taking a value must use the --flag=value form, so that
+		// none of them can be mistaken for the subcommand.
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" || strings.ContainsAny(arg, "\x00\r\n") {
+			return nil, fmt.Errorf("invalid global gopass argument %q: must be a single flag", arg)
 		}
+	}
+
+	return append(append([]string{}, globalArgs...), args...), nil
+}
+
+// execGopass runs the given gopass binary, or the wrapper running it, with
+// the environment env, or the environment of the helper if env is nil. The
+// arguments of the wrapper, prefix, precede the gopass arguments, which alone
+// are reported in errors.
+func execGopass(ctx context.Context, binary string, prefix, env []string, stdinContent string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, append(append([]string{}, prefix...), args...)...)
+	cmd.Env = env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
-		usernames, err := g.listGopassDir(server.Name())
+	// stdin is closed as soon as the intended content is written, so that a
+	// gopass unexpectedly prompting for input reads EOF and aborts rather
+	// than waiting for an answer. The --yes flag of gopass is not passed, as
+	// answering its questions blindly, such as whether to add a missing
+	// recipient, could change the store in unexpected ways.
+	//
+	// gopass cat stores its input unless it is a terminal, so it is left
+	// reading /dev/null, a character device, when only reading a secret.
+	var stdin io.WriteCloser
+	if stdinContent != "" || operation(args) != "cat" {
+		var err error
+		stdin, err = cmd.StdinPipe()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
+	}
+	if err := cmd.Start(); err != nil {
+		return "", newGopassError(err, -1, stdinContent, "", args)
+	}
+	if stdin != nil {
+		go func() {
+			// gopass may exit without reading its input, failing the write.
+			_, _ = io.WriteString(stdin, stdinContent)
+			_ = stdin.Close()
+		}()
+	}
 
-		if len(usernames) < 1 {
-			return nil, fmt.Errorf("no usernames for %s", serverURL)
+	// Success is decided by the exit code alone: gopass prints deprecation
+	// and sync warnings on stderr even when succeeding, which are ignored.
+	err := cmd.Wait()
+	prompt := redact(findPrompt(safeStdout(args, stdout.String()), stderr.String()), stdinContent)
+	if ctxErr := ctx.Err(); errors.Is(ctxErr, context.DeadlineExceeded) {
+		if prompt != "" {
+			return "", fmt.Errorf("gopass %s timed out waiting for an answer to %q: %w", operation(args), prompt, ctxErr)
+		}
+		return "", fmt.Errorf("gopass %s timed out: %w", operation(args), ctxErr)
+	} else if ctxErr != nil {
+		return "", fmt.Errorf("gopass %s was canceled: %w", operation(args), ctxErr)
+	}
+	if err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
 		}
+		gopassErr := newGopassError(err, exitCode, stdinContent, stderr.String(), args)
+		gopassErr.Prompt = prompt
+		gopassErr.Stdout = diagnosticStdout(args, stdinContent, stdout.String())
+		return "", gopassErr
+	}
 
-		resp[string(serverURL)] = strings.TrimSuffix(usernames[0].Name(), ".gpg")
+	if rawOutputs[operation(args)] {
+		return stdout.String(), nil
 	}
 
-	return resp, nil
+	return trimOutputEnding(stdout.String(), crlfOutput), nil
+}
+
+// promptPattern matches the answers of the yes/no questions gopass asks
+// interactively, such as "Do you want to add a recipient? [y/N]: ".
+var promptPattern = regexp.MustCompile(`\[[yYnN]/[yYnN]\]:?`)
+
+// findPrompt returns the last yes/no question gopass asked in its output, if
+// any. Questions asked again on the same line are reported once.
+func findPrompt(outputs ...string) string {
+	prompt := ""
+	for _, out := range outputs {
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimSpace(line)
+			matches := promptPattern.FindAllStringIndex(line, -1)
+			if len(matches) == 0 || matches[len(matches)-1][1] != len(line) {
+				continue
+			}
+
+			start := 0
+			if len(matches) > 1 {
+				start = matches[len(matches)-2][1]
+			}
+			prompt = strings.TrimSpace(line[start:])
+		}
+	}
+	return prompt
+}
+
+// operation returns the gopass subcommand in args, for use in error messages.
+func operation(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return "command"
+}
+
+// gopassTimeout returns the timeout applied to gopass invocations: the
+// configured timeout or value of gopassTimeoutEnv if set, defaultGopassTimeout
+// otherwise. A zero timeout disables the deadline.
+func (g Gopass) gopassTimeout() (time.Duration, error) {
+	if cfg := g.config(); cfg.hasTimeout {
+		return cfg.timeout, nil
+	}
+
+	v := os.Getenv(gopassTimeoutEnv)
+	if v == "" {
+		return defaultGopassTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassTimeoutEnv, v)
+	}
+	return timeout, nil
+}
+
+// Add adds new credentials to the keychain. If gopass fails to store them,
+// the server folder it may have created for them is removed, so that no
+// empty folder is left behind.
+func (g Gopass) Add(creds *credentials.Credentials) (err error) {
+	defer g.observe("Add", time.Now(), &err)
+
+	return g.add(creds, nil)
+}
+
+// AddWithMetadata adds new credentials to the keychain, storing the given
+// metadata alongside the secret. The original server URL is always stored
+// as metadata.
+func (g Gopass) AddWithMetadata(creds *credentials.Credentials, metadata map[string]string) (err error) {
+	defer g.observe("AddWithMetadata", time.Now(), &err)
+
+	for _, key := range reservedMetadata {
+		if _, ok := metadata[key]; ok {
+			return fmt.Errorf("metadata key %q is reserved", key)
+		}
+	}
+	return g.add(creds, metadata)
+}
+
+// UpdateSecret replaces the secret of credentials already stored for the
+// username, such as when rotating a token, without deleting them first. The
+// metadata stored alongside the secret is preserved. It returns
+// credentials.NewErrCredentialsNotFound if nothing is stored for the username.
+func (g Gopass) UpdateSecret(serverURL, username, secret string) (err error) {
+	defer g.observe("UpdateSecret", time.Now(), &err)
+
+	if serverURL == "" {
+		return errors.New("missing server url")
+	}
+
+	if err := g.checkWritable("update"); err != nil {
+		return err
+	}
+
+	if g, err = g.routed(serverURL); err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.invalidateCache(serverURL)
+
+	unlock, err := g.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
+	loc, usernames, err := g.serverUsernames(serverURL)
+	if err != nil {
+		return err
+	}
+
+	name := usernameName(username)
+	found := false
+	for _, u := range usernames {
+		if u == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return credentials.NewErrCredentialsNotFound()
+	}
+	p := loc.secretPath(name)
+
+	if g.useCat() {
+		if err := checkCatSecret(secret, nil); err != nil {
+			return err
+		}
+		_, err = g.runGopass(secret, "cat", p)
+		return err
+	}
+
+	_, metadata, err := g.showSecretWithMetadata(p)
+	if err != nil {
+		return &ReadError{ServerURL: serverURL, Username: username, err: err}
+	}
+	// The encoding of the secret is recorded anew by formatSecret.
+	delete(metadata, metadataSecretEncoding)
+	content, err := formatSecret(secret, metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := g.ensureRecipients(); err != nil {
+		return err
+	}
+
+	_, err = g.runGopass(content, append(g.insertArgs(true), p)...)
+	return err
+}
+
+// add adds new credentials to the keychain, storing the given metadata, which
+// may hold reserved keys, alongside the secret.
+func (g Gopass) add(creds *credentials.Credentials, metadata map[string]string) error {
+	if creds == nil {
+		return errors.New("missing credentials")
+	}
+
+	if err := g.checkWritable("add"); err != nil {
+		return err
+	}
+
+	g, err := g.routed(creds.ServerURL)
+	if err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.invalidateCache(creds.ServerURL)
+
+	unlock, err := g.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := validateUsername(creds.Username); err != nil {
+		return err
+	}
+
+	name := usernameName(creds.Username)
+	insert := g.insertArgs(true)
+	content := creds.Secret
+	if g.useCat() {
+		if name != creds.Username {
+			return fmt.Errorf("invalid username %q: usernames stored under an encoded name cannot be stored through gopass cat", creds.Username)
+		}
+		if err := checkCatSecret(creds.Secret, metadata); err != nil {
+			return err
+		}
+		// gopass cat always overwrites the secret.
+		insert = []string{"cat"}
+	} else {
+		all := make(map[string]string, len(metadata)+1)
+		for key, value := range metadata {
+			all[key] = value
+		}
+		all[metadataServerURL] = creds.ServerURL
+		if g.recordCreatedAt() {
+			all[metadataCreatedAt] = time.Now().UTC().Format(time.RFC3339)
+		}
+		if name != creds.Username {
+			all[metadataUsername] = creds.Username
+		}
+
+		content, err = formatSecret(creds.Secret, all)
+		if err != nil {
+			return err
+		}
+	}
+
+	loc, err := g.serverLocation(creds.ServerURL)
+	if err != nil {
+		return err
+	}
+
+	if g.noOverwrite() {
+		exists, err := g.hasUsername(creds.ServerURL, creds.Username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s for %s", ErrCredentialsExist, creds.Username, creds.ServerURL)
+		}
+		// Without -f, gopass refuses to overwrite credentials added since.
+		if !g.useCat() {
+			insert = g.insertArgs(false)
+		}
+	}
+
+	if err := g.ensureRecipients(); err != nil {
+		return err
+	}
+
+	if _, err := g.runGopass(content, append(insert, loc.secretPath(name))...); err != nil {
+		// gopass creates the folders of the secret before writing it, so an
+		// interrupted insert may leave an empty server folder behind. It is
+		// only removed if no secret is stored in it.
+		if cleanupErr := g.removeEmptyServerDir(loc); cleanupErr != nil {
+			return joinErrors([]error{err, fmt.Errorf("unable to remove the folder left by the failed insert: %w", cleanupErr)})
+		}
+		return err
+	}
+	return nil
+}
+
+// noOverwrite reports whether adding credentials refuses to overwrite those
+// already stored for the username.
+func (g Gopass) noOverwrite() bool {
+	return g.config().noOverwrite || os.Getenv(gopassNoOverwriteEnv) == "1"
+}
+
+// Delete removes credentials from the store.
+func (g Gopass) Delete(serverURL string) (err error) {
+	defer g.observe("Delete", time.Now(), &err)
+
+	if serverURL == "" {
+		return errors.New("missing server url")
+	}
+
+	if err := g.checkWritable("delete"); err != nil {
+		return err
+	}
+
+	if g, err = g.routed(serverURL); err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.invalidateCache(serverURL)
+
+	unlock, err := g.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	loc, err := g.serverLocation(serverURL)
+	if err != nil {
+		return err
+	}
+
+	if err := g.removeServerDir(loc); err != nil {
+		return err
+	}
+
+	// gopass may report success while leaving secrets behind, which List
+	// would then keep reporting.
+	exists, err := g.serverDirExists(loc)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("credentials for %s are still stored after deleting them", serverURL)
+	}
+	return g.removeEmptyParents()
+}
+
+// serverDirPath returns the filesystem path of the server folder dir.
+func (g Gopass) serverDirPath(dir string) (string, error) {
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return "", err
+	}
+
+	gopassDir, err := g.getGopassDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(gopassDir, folder, dir), nil
+}
+
+// DeleteUser removes the credentials of a single username from the store,
+// leaving other usernames stored for the server URL in place. The server
+// folder is removed once its last username is deleted.
+func (g Gopass) DeleteUser(serverURL, username string) (err error) {
+	defer g.observe("DeleteUser", time.Now(), &err)
+
+	if err := g.checkWritable("delete"); err != nil {
+		return err
+	}
+
+	if g, err = g.routed(serverURL); err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.invalidateCache(serverURL)
+
+	unlock, err := g.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
+	loc, usernames, err := g.serverUsernames(serverURL)
+	if err != nil {
+		return err
+	}
+
+	name := usernameName(username)
+	found := false
+	for _, u := range usernames {
+		if u == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return credentials.NewErrCredentialsNotFound()
+	}
+
+	if _, err := g.runGopass("", "rm", "-f", loc.secretPath(name)); err != nil {
+		return err
+	}
+
+	if err := g.removeEmptyServerDir(loc); err != nil {
+		return err
+	}
+	return g.removeEmptyParents()
+}
+
+// Compact removes the server folders left without credentials, such as by
+// partial deletes or edits made by hand, and returns how many were removed.
+// Folders holding any file are left in place, and so are folders that were
+// not created by the helper. Every folder List lists is compacted. With the
+// flat layout, there is no server folder to remove.
+func (g Gopass) Compact() (removed int, err error) {
+	defer g.observe("Compact", time.Now(), &err)
+
+	if err := g.checkWritable("compact"); err != nil {
+		return 0, err
+	}
+
+	listed, err := g.listedFolders()
+	if err != nil {
+		return 0, err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	unlock, err := lockStores(listed)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	for _, h := range listed {
+		n, err := h.compact()
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// compact removes the empty server folders of the folder of g, as Compact
+// does, and returns how many were removed.
+func (g Gopass) compact() (removed int, err error) {
+	scheme, err := g.pathScheme()
+	if err != nil {
+		return 0, err
+	}
+	if !scheme.nested() {
+		return 0, nil
+	}
+
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return 0, err
+	}
+
+	dirs, err := g.listServerDirs(scheme)
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range dirs {
+		if _, err := DecodeServerURL(dir); err != nil && !isHashedName(dir) {
+			continue
+		}
+
+		if err := g.removeEmptyServerDir(serverLocation{scheme: scheme, secrets: secrets, dir: dir}); err != nil {
+			return removed, err
+		}
+
+		p, err := g.serverDirPath(dir)
+		if err != nil {
+			return removed, err
+		}
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// getGopassDir returns the directory of the selected mount, or of the root
+// store if no mount is selected. It is resolved once and cached for the
+// lifetime of the process.
+func (g Gopass) getGopassDir() (string, error) {
+	mount, err := g.gopassMount()
+	if err != nil {
+		return "", err
+	}
+
+	// gopass reads its configuration from its home directory, so the
+	// directory of a mount changes along with GOPASS_HOMEDIR. The fallback
+	// directory of the root store changes along with XDG_DATA_HOME.
+	key := dirKey{homedir: os.Getenv(gopassHomedirEnv), dataHome: os.Getenv(xdgDataHomeEnv), mount: mount}
+
+	cfg := g.config()
+	cfg.dirMutex.Lock()
+	defer cfg.dirMutex.Unlock()
+	if dir, ok := cfg.dirs[key]; ok {
+		return dir, nil
+	}
+
+	dir, err := g.resolveGopassDir(mount)
+	if err != nil {
+		return "", err
+	}
+	if cfg.dirs == nil {
+		cfg.dirs = map[dirKey]string{}
+	}
+	cfg.dirs[key] = dir
+	return dir, nil
+}
+
+// dirKey identifies a store directory cached by getGopassDir.
+type dirKey struct {
+	homedir  string
+	dataHome string
+	mount    string
+}
+
+// resolveGopassDir returns the directory of the given mount, as reported by
+// gopass. If gopass fails to report the directory of the root store, the
+// first existing fallback directory is used instead.
+func (g Gopass) resolveGopassDir(mount string) (string, error) {
+	key := "mounts.path"
+	if mount != "" {
+		key = "mounts." + mount + ".path"
+	}
+	source := "gopass config " + key
+	dir, err := g.runGopass("", "config", key)
+
+	if err == nil && strings.TrimSpace(dir) == "" {
+		err = fmt.Errorf("gopass config %s is empty", key)
+	}
+
+	var ret string
+	if err != nil {
+		var ok bool
+		if mount == "" {
+			source, ret, ok = fallbackGopassDir()
+		}
+		if !ok {
+			return "", fmt.Errorf("error getting gopass dir: %v", err)
+		}
+	} else if ret, err = expandStorePath(dir, runtime.GOOS == "windows"); err != nil {
+		return "", err
+	}
+	if logf := g.config().logf; logf != nil {
+		logf("gopass store directory resolved", "source", source, "dir", ret)
+	}
+
+	// A missing store would otherwise be listed as holding no credentials.
+	info, err := os.Stat(ret)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrStoreNotFound, ret)
+	}
+	if err != nil {
+		return "", fmt.Errorf("gopass store directory %q is not usable: %v", ret, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("gopass store directory %q is not a directory", ret)
+	}
+
+	return ret, nil
+}
+
+// gopassHomedirEnv is the environment variable gopass reads its home
+// directory from, instead of the home directory of the user.
+const gopassHomedirEnv = "GOPASS_HOMEDIR"
+
+// xdgDataHomeEnv is the environment variable of the XDG base directory
+// specification holding the directory user data is stored in.
+const xdgDataHomeEnv = "XDG_DATA_HOME"
+
+// dataStoreDir is the directory of the root store gopass creates by default,
+// relative to its data directory.
+var dataStoreDir = filepath.Join("gopass", "stores", "root")
+
+// defaultStoreDir is the directory of the root store gopass creates by
+// default, relative to its home directory.
+var defaultStoreDir = filepath.Join(".local", "share", dataStoreDir)
+
+// fallbackGopassDir returns the directory of the root store used when gopass
+// does not report it, along with where it was found: defaultStoreDir below
+// GOPASS_HOMEDIR if set, dataStoreDir below XDG_DATA_HOME if set, and
+// defaultStoreDir below the home directory of the user otherwise. As by the
+// XDG base directory specification, a relative XDG_DATA_HOME is ignored. It
+// reports false if none exists.
+func fallbackGopassDir() (string, string, bool) {
+	var candidates [][2]string
+	if home := os.Getenv(gopassHomedirEnv); home != "" {
+		candidates = append(candidates, [2]string{gopassHomedirEnv, filepath.Join(home, defaultStoreDir)})
+	}
+	if data := os.Getenv(xdgDataHomeEnv); filepath.IsAbs(data) {
+		candidates = append(candidates, [2]string{xdgDataHomeEnv, filepath.Join(data, dataStoreDir)})
+	} else if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, [2]string{"default store location", filepath.Join(home, defaultStoreDir)})
+	}
+
+	for _, c := range candidates {
+		if info, err := os.Stat(c[1]); err == nil && info.IsDir() {
+			return c[0], c[1], true
+		}
+	}
+	return "", "", false
+}
+
+// userHomeDir returns the directory a leading "~" of store paths expands to.
+var userHomeDir = gopassHomeDir
+
+// gopassHomeDir returns the home directory gopass expands a leading "~" of
+// store paths to: the value of gopassHomedirEnv if set, the home directory of
+// the user otherwise.
+func gopassHomeDir() (string, error) {
+	if home := os.Getenv(gopassHomedirEnv); home != "" {
+		return home, nil
+	}
+	return os.UserHomeDir()
+}
+
+// windowsEnvPattern matches the %VAR% environment variable references of
+// Windows paths.
+var windowsEnvPattern = regexp.MustCompile(`%([^%]+)%`)
+
+// expandStorePath expands the environment variables and leading "~" of a store
+// directory reported by gopass, returning a filesystem path. On Windows,
+// %VAR% references and a leading "~\" are expanded as well.
+func expandStorePath(dir string, windows bool) (string, error) {
+	ret := os.ExpandEnv(dir)
+	if windows {
+		ret = windowsEnvPattern.ReplaceAllStringFunc(ret, func(ref string) string {
+			if v, ok := os.LookupEnv(ref[1 : len(ref)-1]); ok {
+				return v
+			}
+			return ref
+		})
+	}
+
+	if strings.HasPrefix(ret, "~/") || (windows && strings.HasPrefix(ret, `~\`)) {
+		d, err := userHomeDir()
+
+		if err != nil {
+			message := fmt.Sprintf("unable to get user home directory: %v", err.Error())
+			return "", errors.New(message)
+		}
+
+		rest := ret[2:]
+		if windows {
+			rest = strings.ReplaceAll(rest, `\`, "/")
+		}
+		ret = filepath.Join(d, filepath.FromSlash(rest))
+	}
+
+	return ret, nil
+}
+
+// listGopassDir lists all the contents of a directory in the password store.
+// Gopass uses fancy unicode to emit stuff to stdout, so rather than try
+// and parse this, let's just look at the directory structure instead.
+// Missing directories are listed as empty, unless the store directory itself
+// is missing, in which case an error wrapping ErrStoreNotFound is returned.
+func (g Gopass) listGopassDir(args ...string) ([]os.FileInfo, error) {
+	if len(args) > 0 && g.cliUsernames() {
+		return g.listGopassSubtree(args...)
+	}
+	if g.cliListing() {
+		return g.listGopassCLI(args...)
+	}
+
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	gopassDir, err := g.getGopassDir()
+	if err != nil {
+		return nil, err
+	}
+
+	p := os.ExpandEnv(filepath.Join(append([]string{gopassDir, folder}, args...)...))
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// The folder does not exist until credentials are first added to
+		// it, but the store itself must.
+		if _, err := os.Stat(os.ExpandEnv(gopassDir)); os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrStoreNotFound, gopassDir)
+		}
+		return []os.FileInfo{}, nil
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Get returns the username and secret to use for a given registry server URL.
+//
+// When several usernames are stored for a server URL, a specific one may be
+// requested by appending it as a fragment: "serverURL#username". Credentials
+// are then only found if that username is stored for the server URL.
+//
+// Credentials not found is only returned if nothing is stored for the server
+// URL. Failures to read the secret of stored credentials, such as decryption
+// failures, are returned as a *ReadError instead.
+func (g Gopass) Get(serverURL string) (username, secret string, err error) {
+	defer g.observe("Get", time.Now(), &err)
+
+	return g.cachedGet(serverURL)
+}
+
+// getFragment implements Get, looking up the username requested as the
+// fragment of serverURL, if any.
+func (g Gopass) getFragment(serverURL string) (username, secret string, err error) {
+	username, secret, _, err = g.getExpiring(serverURL)
+	return username, secret, err
+}
+
+// getExpiring is like getFragment, but also returns the time at which the
+// credentials expire if expired credentials are hidden, or the zero time.
+func (g Gopass) getExpiring(serverURL string) (username, secret string, expiresAt time.Time, err error) {
+	base, requested, exact := strings.Cut(serverURL, "#")
+	if exact {
+		if err := validateUsername(requested); err != nil {
+			return "", "", time.Time{}, err
+		}
+	}
+
+	if g, err = g.routed(base); err != nil {
+		return "", "", time.Time{}, err
+	}
+	err = g.searchFolders(func(h Gopass) error {
+		var err error
+		username, secret, expiresAt, err = h.get(base, requested, exact)
+		return err
+	})
+	return username, secret, expiresAt, err
+}
+
+// GetMany returns the credentials of several server URLs, mapped to their
+// server URL, as Get would return them. Repeated server URLs are looked up
+// once, and server URLs without credentials are left out. Every secret is
+// still read by a gopass invocation of its own, as by Get: nothing is checked
+// or unlocked ahead of the batch. Since the gpg key stays unlocked once the
+// first read needing it unlocks it through pinentry, if enabled, the
+// following reads do not prompt again. Failing to read the credentials of a
+// server URL does not stop the batch: the credentials that could be read are
+// returned along with the errors.
+func (g Gopass) GetMany(serverURLs []string) (creds map[string]*credentials.Credentials, err error) {
+	defer g.observe("GetMany", time.Now(), &err)
+
+	creds = make(map[string]*credentials.Credentials, len(serverURLs))
+	seen := make(map[string]bool, len(serverURLs))
+	var errs []error
+	for _, serverURL := range serverURLs {
+		if seen[serverURL] {
+			continue
+		}
+		seen[serverURL] = true
+
+		username, secret, err := g.getFragment(serverURL)
+		if credentials.IsErrCredentialsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to get credentials for %s: %w", serverURL, err))
+			continue
+		}
+		base, _, _ := strings.Cut(serverURL, "#")
+		creds[serverURL] = &credentials.Credentials{ServerURL: base, Username: username, Secret: secret}
+	}
+	return creds, joinErrors(errs)
+}
+
+// get returns the username and secret stored for serverURL. The given
+// username is preferred if it is stored for serverURL, otherwise the first
+// stored username is used, unless exact is true in which case credentials not
+// found is returned. The time at which the credentials expire is returned if
+// expired credentials are hidden, the zero time otherwise.
+func (g Gopass) get(serverURL, username string, exact bool) (string, string, time.Time, error) {
+	loc, usernames, err := g.serverUsernames(serverURL)
+	if credentials.IsErrCredentialsNotFound(err) && g.legacyFallback() {
+		loc, usernames, err = g.legacyUsernames(serverURL)
+	}
+	if credentials.IsErrCredentialsNotFound(err) && exact && g.resolveAliases() {
+		// gopass does not list the paths its aliases resolve.
+		username, secret, err := g.getAliased(serverURL, username)
+		return username, secret, time.Time{}, err
+	}
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	actual := ""
+	for _, u := range usernames {
+		if u == usernameName(username) {
+			actual = u
+			break
+		}
+	}
+	if actual == "" {
+		if exact {
+			return "", "", time.Time{}, credentials.NewErrCredentialsNotFound()
+		}
+		actual = usernames[0]
+		username, err = g.storedUsername(loc, actual)
+		if err != nil {
+			return "", "", time.Time{}, &ReadError{ServerURL: serverURL, Username: actual, err: err}
+		}
+		g.logMultipleUsernames(serverURL, username, usernames)
+	}
+
+	if g.hideExpired() {
+		secret, expiresAt, ok, err := g.showUnexpiredSecret(loc.secretPath(actual))
+		if err != nil {
+			return "", "", time.Time{}, &ReadError{ServerURL: serverURL, Username: username, err: err}
+		}
+		if !ok {
+			return "", "", time.Time{}, credentials.NewErrCredentialsNotFound()
+		}
+		return username, secret, expiresAt, nil
+	}
+
+	secret, err := g.showSecret(loc.secretPath(actual))
+	if isEntryNotFound(err) && g.resolveAliases() {
+		return "", "", time.Time{}, credentials.NewErrCredentialsNotFound()
+	}
+	if err != nil {
+		return "", "", time.Time{}, &ReadError{ServerURL: serverURL, Username: username, err: err}
+	}
+	return username, secret, time.Time{}, nil
+}
+
+// showSecret returns the secret stored at the given gopass path: the value of
+// the configured field if any, the first line otherwise. The whole secret is
+// read, rather than letting gopass pick its password, so that secrets encoded
+// by formatSecret are decoded, unless a show template says otherwise. Secrets
+// stored through `gopass cat` are read back byte for byte.
+func (g Gopass) showSecret(p string) (string, error) {
+	template, custom, err := g.showTemplate()
+	if err != nil {
+		return "", err
+	}
+
+	if g.useCat() {
+		if custom {
+			return "", fmt.Errorf("%s cannot be combined with %s", gopassShowTemplateEnv, gopassUseCatEnv)
+		}
+		return g.runGopass("", "cat", p)
+	}
+
+	field, err := g.secretField()
+	if err != nil {
+		return "", err
+	}
+	if field != "" {
+		if custom {
+			return "", fmt.Errorf("%s cannot be combined with %s", gopassShowTemplateEnv, gopassFieldEnv)
+		}
+		return g.runGopass("", "show", p, field)
+	}
+
+	content, err := g.runGopass("", showArgs(template, p)...)
+	if err != nil {
+		return "", err
+	}
+
+	secret, _, err := parseSecret(normalizeLineEndings(content, crlfOutput))
+	return secret, err
+}
+
+// Has reports whether credentials are stored for a given registry server URL.
+// Unlike Get, it never decrypts a secret, so it never prompts for a
+// passphrase.
+func (g Gopass) Has(serverURL string) (exists bool, err error) {
+	defer g.observe("Has", time.Now(), &err)
+
+	if serverURL == "" {
+		return false, errors.New("missing server url")
+	}
+
+	if g, err = g.routed(serverURL); err != nil {
+		return false, err
+	}
+	loc, err := g.serverLocation(serverURL)
+	if err != nil {
+		return false, err
+	}
+
+	usernames, err := g.listUsernames(loc)
+	if err != nil {
+		return false, err
+	}
+	return len(usernames) > 0, nil
+}
+
+// GetWithMetadata returns the credentials to use for a given registry server
+// URL, along with the metadata stored alongside the secret.
+func (g Gopass) GetWithMetadata(serverURL string) (creds *credentials.Credentials, metadata map[string]string, err error) {
+	defer g.observe("GetWithMetadata", time.Now(), &err)
+
+	return g.getWithMetadata(serverURL)
+}
+
+// getWithMetadata implements GetWithMetadata, searching every folder in
+// priority order.
+func (g Gopass) getWithMetadata(serverURL string) (creds *credentials.Credentials, metadata map[string]string, err error) {
+	if g, err = g.routed(serverURL); err != nil {
+		return nil, nil, err
+	}
+	err = g.searchFolders(func(h Gopass) error {
+		var err error
+		creds, metadata, err = h.getFolderWithMetadata(serverURL)
+		return err
+	})
+	return creds, metadata, err
+}
+
+// getFolderWithMetadata returns the credentials stored for serverURL in the
+// folder of g, along with their metadata.
+func (g Gopass) getFolderWithMetadata(serverURL string) (*credentials.Credentials, map[string]string, error) {
+	loc, usernames, err := g.serverUsernames(serverURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, metadata, err := g.showSecretWithMetadata(loc.secretPath(usernames[0]))
+	if err != nil {
+		return nil, nil, &ReadError{ServerURL: serverURL, Username: usernames[0], err: err}
+	}
+	username := usernameFromMetadata(usernames[0], metadata)
+	g.logMultipleUsernames(serverURL, username, usernames)
+	return &credentials.Credentials{
+		ServerURL: serverURL,
+		Username:  username,
+		Secret:    secret,
+	}, metadata, nil
+}
+
+// showSecretWithMetadata returns the secret stored at the given gopass path,
+// along with its metadata. Secrets stored through `gopass cat` have none.
+func (g Gopass) showSecretWithMetadata(p string) (string, map[string]string, error) {
+	if g.useCat() {
+		secret, err := g.runGopass("", "cat", p)
+		return secret, map[string]string{}, err
+	}
+
+	content, err := g.runGopass("", "show", "-n", p)
+	if err != nil {
+		return "", nil, err
+	}
+	return parseSecret(normalizeLineEndings(content, crlfOutput))
+}
+
+// GetAll returns every username stored for a given registry server URL,
+// mapped to its secret.
+func (g Gopass) GetAll(serverURL string) (secrets map[string]string, err error) {
+	defer g.observe("GetAll", time.Now(), &err)
+
+	if g, err = g.routed(serverURL); err != nil {
+		return nil, err
+	}
+	loc, usernames, err := g.serverUsernames(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make(map[string]string, len(usernames))
+	for _, name := range usernames {
+		username, err := g.storedUsername(loc, name)
+		if err != nil {
+			return nil, &ReadError{ServerURL: serverURL, Username: name, err: err}
+		}
+		secret, err := g.showSecret(loc.secretPath(name))
+		if err != nil {
+			return nil, &ReadError{ServerURL: serverURL, Username: username, err: err}
+		}
+		resp[username] = secret
+	}
+
+	return resp, nil
+}
+
+// serverUsernames returns where the credentials for serverURL are stored,
+// along with the usernames stored there. It returns
+// credentials.NewErrCredentialsNotFound if nothing is stored for serverURL.
+func (g Gopass) serverUsernames(serverURL string) (serverLocation, []string, error) {
+	if serverURL == "" {
+		return serverLocation{}, nil, errors.New("missing server url")
+	}
+
+	loc, err := g.serverLocation(serverURL)
+	if err != nil {
+		return serverLocation{}, nil, err
+	}
+	return g.folderUsernames(loc)
+}
+
+// legacyUsernames is like serverUsernames, but for credentials stored under
+// the plain server URL rather than its base64-url encoding, as done by older
+// tools. Legacy credentials are always laid out in nested folders.
+func (g Gopass) legacyUsernames(serverURL string) (serverLocation, []string, error) {
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return serverLocation{}, nil, err
+	}
+
+	// Cleaning as a rooted path keeps the server URL within the folder, but
+	// server URLs containing ".." are rejected outright as they would alias
+	// the credentials of other servers.
+	legacy := path.Clean("/" + serverURL)[1:]
+	if legacy == "" || strings.Contains("/"+serverURL+"/", "/../") {
+		return serverLocation{}, nil, credentials.NewErrCredentialsNotFound()
+	}
+	return g.folderUsernames(serverLocation{scheme: nestedScheme, secrets: secrets, dir: legacy})
+}
+
+// folderUsernames returns the usernames stored in the server folder, along
+// with its location. It returns credentials.NewErrCredentialsNotFound if no
+// username is stored there.
+func (g Gopass) folderUsernames(loc serverLocation) (serverLocation, []string, error) {
+	exists, err := g.serverDirExists(loc)
+	if err != nil {
+		return serverLocation{}, nil, err
+	}
+	if !exists {
+		return serverLocation{}, nil, credentials.NewErrCredentialsNotFound()
+	}
+
+	usernames, err := g.listUsernames(loc)
+	if err != nil {
+		return serverLocation{}, nil, err
+	}
+	if len(usernames) < 1 {
+		// The folder may be left behind with only hidden files, such as
+		// its .gpg-id, once its last username is deleted.
+		return serverLocation{}, nil, credentials.NewErrCredentialsNotFound()
+	}
+
+	return loc, usernames, nil
+}
+
+// secretExtensions are the extensions of the secret files of the gopass
+// crypto backends: gpg and age. The plain backend uses none.
+var secretExtensions = []string{".gpg", ".age"}
+
+// sortedUsernames returns the sorted usernames of the secrets of a server
+// folder, so that the username picked by Get and List does not depend on the
+// order of the files on disk. Hidden files, such as the .gpg-id of a folder
+// with its own recipients, are not secrets and are skipped.
+func sortedUsernames(infos []os.FileInfo) []string {
+	usernames := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		usernames = append(usernames, secretName(info))
+	}
+	return sortUnique(usernames)
+}
+
+// sortUnique sorts names in place and removes the duplicates, such as the
+// usernames stored by both the gpg and age backends of gopass, which would
+// otherwise be reported twice.
+func sortUnique(names []string) []string {
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// trimSecretExtension returns the name of a secret file without the extension
+// of its crypto backend, if any.
+func trimSecretExtension(name string) string {
+	for _, ext := range secretExtensions {
+		if trimmed := strings.TrimSuffix(name, ext); trimmed != name {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// logSkipped logs that an entry of the store of the given kind was skipped
+// while listing it, for the reason err.
+func (g Gopass) logSkipped(kind string, err error) {
+	if logf := g.config().logf; logf != nil {
+		logf("gopass "+kind+" skipped", "error", err)
+	}
+}
+
+// logMultipleUsernames logs that username was picked among several usernames
+// stored for serverURL, as the caller may expect another one.
+func (g Gopass) logMultipleUsernames(serverURL, username string, usernames []string) {
+	if logf := g.config().logf; logf != nil && len(usernames) > 1 {
+		logf("multiple usernames stored for server, using one",
+			"server_url", serverURL,
+			"username", username,
+			"usernames", len(usernames),
+		)
+	}
+}
+
+// List returns the stored URLs and corresponding usernames for a given credentials label.
+// The URLs are decoded from the folder names as they were given to Add,
+// scheme, port, path and trailing slash included, without being normalized.
+// When normalization is enabled, the folder names hold the normalized URLs.
+// The URLs of every fallback folder are listed as well, unless already
+// listed from a folder searched before.
+func (g Gopass) List() (servers map[string]string, err error) {
+	defer g.observe("List", time.Now(), &err)
+
+	return g.list(func(string) bool { return true })
+}
+
+// ListByPrefix is like List, but only returns the server URLs starting with
+// prefix, such as "https://registry.example.com" for every registry path of
+// a host. Folders that are not encoded server URLs are skipped.
+func (g Gopass) ListByPrefix(prefix string) (servers map[string]string, err error) {
+	defer g.observe("ListByPrefix", time.Now(), &err)
+
+	return g.list(func(serverURL string) bool { return strings.HasPrefix(serverURL, prefix) })
+}
+
+// list implements List, returning only the server URLs match reports true
+// for.
+func (g Gopass) list(match func(serverURL string) bool) (map[string]string, error) {
+	searched, err := g.listedFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := map[string]string{}
+	for _, h := range searched {
+		err = h.walkServers(true, func(serverURL string, loc serverLocation, usernames []string) error {
+			if _, ok := resp[serverURL]; ok || !match(serverURL) {
+				return nil
+			}
+			name, err := h.listUsername(loc, usernames)
+			if err != nil {
+				return err
+			}
+			username, err := h.storedUsername(loc, name)
+			if err != nil {
+				return err
+			}
+			h.logMultipleUsernames(serverURL, username, usernames)
+			resp[serverURL] = username
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// ListServers returns the sorted server URLs credentials are stored for,
+// including those of fallback folders. Unlike List, it only lists the
+// credentials folder, without listing the usernames of every server folder,
+// so server folders left empty are listed as well. Folders that are not
+// encoded server URLs are skipped, and so are the server URLs stored under a
+// hash, whose server URL cannot be read without decrypting a secret.
+func (g Gopass) ListServers() (serverURLs []string, err error) {
+	defer g.observe("ListServers", time.Now(), &err)
+
+	scheme, err := g.pathScheme()
+	if err != nil {
+		return nil, err
+	}
+
+	searched, err := g.listedFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, h := range searched {
+		dirs, err := h.listServerDirs(scheme)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			serverURL, err := DecodeServerURL(dir)
+			if err != nil || seen[serverURL] {
+				continue
+			}
+			seen[serverURL] = true
+			serverURLs = append(serverURLs, serverURL)
+		}
+	}
+	sort.Strings(serverURLs)
+	return serverURLs, nil
+}
+
+// ListPaths returns the stored URLs mapped to the gopass path of the secret
+// holding their credentials, such as
+// "docker-credential-helpers/<base64-url(serverURL)>/<username>", for use with
+// `gopass show` when diagnosing the store. The paths include the mount, if
+// any. As with List, fallback folders and routes are listed as well.
+func (g Gopass) ListPaths() (paths map[string]string, err error) {
+	defer g.observe("ListPaths", time.Now(), &err)
+
+	searched, err := g.listedFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := map[string]string{}
+	for _, h := range searched {
+		err = h.walkServers(true, func(serverURL string, loc serverLocation, usernames []string) error {
+			if _, ok := resp[serverURL]; ok {
+				return nil
+			}
+			username, err := h.listUsername(loc, usernames)
+			if err != nil {
+				return err
+			}
+			h.logMultipleUsernames(serverURL, username, usernames)
+			resp[serverURL] = loc.secretPath(username)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// Count returns the number of credentials stored, counting every username
+// stored for a server URL, in the folders List lists. A server URL stored in
+// several folders is counted once, as listed by List. It only lists the
+// store, so it never decrypts a secret.
+func (g Gopass) Count() (count int, err error) {
+	defer g.observe("Count", time.Now(), &err)
+
+	searched, err := g.listedFolders()
+	if err != nil {
+		return 0, err
+	}
+
+	seen := map[string]bool{}
+	for _, h := range searched {
+		err = h.walkServers(false, func(serverURL string, loc serverLocation, usernames []string) error {
+			// The URLs stored under a hash are not read, but are stored
+			// under the same hash in every folder.
+			key := serverURL
+			if key == "" {
+				key = loc.dir
+			}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+			count += len(usernames)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// hashedServerURL returns the server URL of the credentials of username stored
+// under a hash, as encoded, from their server_url metadata.
+func (g Gopass) hashedServerURL(loc serverLocation, username string) (string, error) {
+	_, metadata, err := g.showSecretWithMetadata(loc.secretPath(username))
+	if err != nil {
+		return "", err
+	}
+	serverURL := metadata[metadataServerURL]
+	if serverURL == "" {
+		return "", fmt.Errorf("no server url stored in %s", loc.secretPath(username))
+	}
+
+	n, err := g.normalization()
+	if err != nil {
+		return "", err
+	}
+	return normalizeServerURL(serverURL, n), nil
+}
+
+// walkServers calls fn with every stored URL, the location of its credentials
+// and the sorted usernames stored for it, of which there is at least one. It
+// stops at the first error returned by fn. The URLs stored under a hash are
+// read from the metadata of their credentials if resolveHashed is true, which
+// decrypts a secret, and are empty otherwise.
+//
+// Names that are not valid UTF-8, such as those written under another locale,
+// cannot be reported through the credential helper protocol: the server
+// folders and usernames holding them are skipped, and logged.
+func (g Gopass) walkServers(resolveHashed bool, fn func(serverURL string, loc serverLocation, usernames []string) error) error {
+	scheme, err := g.pathScheme()
+	if err != nil {
+		return err
+	}
+
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return err
+	}
+
+	dirs, err := g.listServerDirs(scheme)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		// Skip folders that were not created by us, or that are left empty
+		// after a partial delete, rather than failing the whole listing.
+		serverURL, err := DecodeServerURL(dir)
+		hashed := err != nil && isHashedName(dir)
+		if err != nil && !hashed {
+			if !utf8.ValidString(dir) {
+				g.logSkipped("server folder", err)
+			}
+			continue
+		}
+
+		loc := serverLocation{scheme: scheme, secrets: secrets, dir: dir}
+		names, err := g.listUsernames(loc)
+		if err != nil {
+			return err
+		}
+		usernames := names[:0]
+		for _, name := range names {
+			if !utf8.ValidString(name) {
+				g.logSkipped("username", fmt.Errorf("invalid username %q stored for %s: not valid UTF-8", name, dir))
+				continue
+			}
+			usernames = append(usernames, name)
+		}
+		if len(usernames) < 1 {
+			continue
+		}
+
+		if hashed && resolveHashed {
+			serverURL, err = g.hashedServerURL(loc, usernames[0])
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := fn(serverURL, loc, usernames); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -1,6 +1,8 @@
 package gopass
 
 import (
+	"errors"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -85,3 +87,42 @@ func TestMissingCred(t *testing.T) {
 		t.Fatalf("expected credentials not found, actual: %v", err)
 	}
 }
+
+func TestExpandStorePath(t *testing.T) {
+	home := t.TempDir()
+	oldHome := userHomeDir
+	t.Cleanup(func() { userHomeDir = oldHome })
+	userHomeDir = func() (string, error) { return home, nil }
+
+	t.Setenv("USERPROFILE", `C:\Users\docker`)
+	t.Setenv("STORE_ROOT", "/srv/stores")
+
+	for _, tc := range []struct {
+		dir      string
+		windows  bool
+		expected string
+	}{
+		{"~/.password-store", false, filepath.Join(home, ".password-store")},
+		{"~/.local/share/gopass/stores/root", false, filepath.Join(home, ".local", "share", "gopass", "stores", "root")},
+		{"$STORE_ROOT/root", false, "/srv/stores/root"},
+		{`~\.password-store`, false, `~\.password-store`},
+		{`%USERPROFILE%\.password-store`, false, `%USERPROFILE%\.password-store`},
+		{`~\.password-store`, true, filepath.Join(home, ".password-store")},
+		{`~\AppData\Local\gopass`, true, filepath.Join(home, "AppData", "Local", "gopass")},
+		{`%USERPROFILE%\.password-store`, true, `C:\Users\docker\.password-store`},
+		{`%UNSET_STORE_VARIABLE%\store`, true, `%UNSET_STORE_VARIABLE%\store`},
+	} {
+		actual, err := expandStorePath(tc.dir, tc.windows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %s to expand to %s (windows: %t), actual: %s", tc.dir, tc.expected, tc.windows, actual)
+		}
+	}
+
+	userHomeDir = func() (string, error) { return "", errors.New("no home") }
+	if _, err := expandStorePath("~/.password-store", false); err == nil {
+		t.Error("expected a missing home directory to be reported")
+	}
+}
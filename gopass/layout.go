@@ -0,0 +1,380 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// gopassPathSeparatorEnv is the environment variable used to select the
+// separator between the encoded server URL and the username in the gopass
+// path of credentials.
+const gopassPathSeparatorEnv = "GOPASS_PATH_SEPARATOR"
+
+// nestedSeparator is the default separator, which stores the usernames of a
+// server URL as secrets of its own folder.
+const nestedSeparator = "/"
+
+// gopassUsernameDirsEnv is the environment variable used to store the
+// credentials of every username in a folder of its own.
+const gopassUsernameDirsEnv = "GOPASS_USERNAME_DIRS"
+
+// usernameLeaf is the name of the secret holding the credentials of a
+// username stored in a folder of its own.
+const usernameLeaf = "credential"
+
+// gopassPruneParentsEnv is the environment variable used to remove the
+// folders left empty between the credentials folder and the configured folder,
+// such as the subfolder of the current OS user, once credentials are deleted.
+const gopassPruneParentsEnv = "GOPASS_PRUNE_PARENTS"
+
+// pathScheme lays out the credentials in the credentials folder: either
+// nested, as "folder/encoded/username", or flat, as
+// "folder/<encoded><separator><username>". With a leaf, the nested layout
+// stores the credentials of every username in a folder of its own, as
+// "folder/encoded/username/leaf".
+type pathScheme struct {
+	separator string
+	leaf      string
+}
+
+// nestedScheme is the default layout, which the legacy layout also follows.
+var nestedScheme = pathScheme{separator: nestedSeparator}
+
+// pathScheme returns the layout of the credentials in the credentials folder.
+func (g Gopass) pathScheme() (pathScheme, error) {
+	sep := g.config().pathSeparator
+	if sep == "" {
+		sep = os.Getenv(gopassPathSeparatorEnv)
+	}
+	usernameDirs := g.config().usernameDirs || os.Getenv(gopassUsernameDirsEnv) == "1"
+	if sep == "" || sep == nestedSeparator {
+		if usernameDirs {
+			return pathScheme{separator: nestedSeparator, leaf: usernameLeaf}, nil
+		}
+		return nestedScheme, nil
+	}
+	if usernameDirs {
+		return pathScheme{}, fmt.Errorf("%s cannot be combined with %s %q: usernames are only stored in folders with the nested layout", gopassUsernameDirsEnv, gopassPathSeparatorEnv, sep)
+	}
+
+	if strings.ContainsAny(sep, "/\\\x00") || strings.TrimSpace(sep) != sep || strings.HasPrefix(sep, ".") {
+		return pathScheme{}, fmt.Errorf("invalid %s %q: must be \"/\" or contain no path separators, surrounding whitespace or leading \".\"", gopassPathSeparatorEnv, sep)
+	}
+	return pathScheme{separator: sep}, nil
+}
+
+// nested reports whether every server URL has a folder of its own.
+func (s pathScheme) nested() bool {
+	return s.separator == nestedSeparator
+}
+
+// splitName splits the name of a secret of the credentials folder stored
+// with the flat layout into the encoded server URL and the username it holds.
+// Encoded server URLs may contain the separator, so the name is split at the
+// first separator preceded by a valid encoded server URL.
+func (s pathScheme) splitName(name string) (string, string, bool) {
+	for i := 0; i < len(name); {
+		j := strings.Index(name[i:], s.separator)
+		if j < 0 {
+			break
+		}
+
+		dir, username := name[:i+j], name[i+j+len(s.separator):]
+		if _, err := DecodeServerURL(dir); (err == nil || isHashedName(dir)) && username != "" {
+			return dir, username, true
+		}
+		i += j + 1
+	}
+	return "", "", false
+}
+
+// serverLocation is where the credentials of a server URL are stored: the
+// gopass folder, including the mount, and the server folder dir within it,
+// laid out by scheme. With the flat layout, dir is the prefix of the names of
+// the secrets rather than a folder of its own.
+type serverLocation struct {
+	scheme  pathScheme
+	secrets string
+	dir     string
+}
+
+// serverLocation returns where the credentials of serverURL are stored.
+func (g Gopass) serverLocation(serverURL string) (serverLocation, error) {
+	scheme, err := g.pathScheme()
+	if err != nil {
+		return serverLocation{}, err
+	}
+
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return serverLocation{}, err
+	}
+
+	encoded, err := g.encodeServerURL(serverURL)
+	if err != nil {
+		return serverLocation{}, err
+	}
+	return serverLocation{scheme: scheme, secrets: secrets, dir: encoded}, nil
+}
+
+// secretPath returns the gopass path of the secret holding the credentials of
+// username.
+func (l serverLocation) secretPath(username string) string {
+	if l.scheme.nested() {
+		return path.Join(l.secrets, l.dir, username, l.scheme.leaf)
+	}
+	return path.Join(l.secrets, l.dir+l.scheme.separator+username)
+}
+
+// listUsernames returns the sorted usernames stored in the server folder, each
+// once, so that the username Get and List pick among them is the same from
+// one call to the next.
+func (g Gopass) listUsernames(l serverLocation) ([]string, error) {
+	if l.scheme.leaf != "" {
+		leaves, err := g.listLeaves(l)
+		if err != nil {
+			return nil, err
+		}
+		usernames := make([]string, 0, len(leaves))
+		for username := range leaves {
+			usernames = append(usernames, username)
+		}
+		return sortUnique(usernames), nil
+	}
+	if l.scheme.nested() {
+		infos, err := g.listGopassDir(l.dir)
+		if err != nil {
+			return nil, err
+		}
+		return sortedUsernames(infos), nil
+	}
+
+	infos, err := g.listGopassDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var usernames []string
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		dir, username, ok := l.scheme.splitName(secretName(info))
+		if ok && dir == l.dir {
+			usernames = append(usernames, username)
+		}
+	}
+	return sortUnique(usernames), nil
+}
+
+// listLeaves returns the secret holding the credentials of every username of
+// the server folder laid out with a leaf, by username. Username folders
+// holding other files only are skipped.
+func (g Gopass) listLeaves(l serverLocation) (map[string]os.FileInfo, error) {
+	infos, err := g.listGopassDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := map[string]os.FileInfo{}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		entries, err := g.listGopassDir(l.dir, info.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && secretName(entry) == l.scheme.leaf {
+				leaves[info.Name()] = entry
+			}
+		}
+	}
+	return leaves, nil
+}
+
+// listServerDirs returns the names of the server folders of the credentials
+// folder laid out by scheme. The names are not checked to be encoded server
+// URLs.
+func (g Gopass) listServerDirs(scheme pathScheme) ([]string, error) {
+	infos, err := g.listGopassDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, info := range infos {
+		if scheme.nested() {
+			if info.IsDir() {
+				dirs = append(dirs, info.Name())
+			}
+			continue
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		dir, _, ok := scheme.splitName(secretName(info))
+		if ok && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// serverDirExists reports whether the server folder exists. When listing the
+// store or usernames through gopass, which does not report empty folders, or
+// with the flat layout, it reports whether any username is stored in it.
+func (g Gopass) serverDirExists(l serverLocation) (bool, error) {
+	if !l.scheme.nested() || g.cliListing() || g.cliUsernames() {
+		usernames, err := g.listUsernames(l)
+		return len(usernames) > 0, err
+	}
+
+	p, err := g.serverDirPath(l.dir)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// removeServerDir removes every credential stored in the server folder.
+func (g Gopass) removeServerDir(l serverLocation) error {
+	if l.scheme.nested() {
+		_, err := g.runGopass("", "rm", "-rf", path.Join(l.secrets, l.dir))
+		return err
+	}
+
+	usernames, err := g.listUsernames(l)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if _, err := g.runGopass("", "rm", "-f", l.secretPath(username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyServerDir removes the server folder if no username is left
+// stored in it, along with the empty folders of usernames laid out with a
+// leaf. With the flat layout, there is no folder to remove.
+func (g Gopass) removeEmptyServerDir(l serverLocation) error {
+	if !l.scheme.nested() {
+		return nil
+	}
+
+	if l.scheme.leaf != "" {
+		infos, err := g.listGopassDir(l.dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			entries, err := g.listGopassDir(l.dir, info.Name())
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				continue
+			}
+			if err := g.removeEmptyDir(path.Join(l.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	remaining, err := g.listGopassDir(l.dir)
+	if err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		return nil
+	}
+
+	return g.removeEmptyDir(l.dir)
+}
+
+// removeEmptyDir removes the folder dir of the credentials folder, unless
+// files were added to it since it was listed empty.
+func (g Gopass) removeEmptyDir(dir string) error {
+	p, err := g.serverDirPath(dir)
+	if err != nil {
+		return err
+	}
+
+	// os.Remove refuses to remove a folder that is not empty, so this never
+	// deletes secrets added concurrently.
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneParents reports whether the folders left empty above the credentials
+// folder are removed once credentials are deleted.
+func (g Gopass) pruneParents() bool {
+	return g.config().pruneParents || os.Getenv(gopassPruneParentsEnv) == "1"
+}
+
+// removeEmptyParents removes the credentials folder and its parents, up to
+// but not including the configured folder, as long as they are left empty.
+// The folders of fallback folders and routes are used as configured, so they
+// have no parents to remove.
+func (g Gopass) removeEmptyParents() error {
+	if !g.pruneParents() || g.folder != "" {
+		return nil
+	}
+
+	base, err := g.baseFolder()
+	if err != nil {
+		return err
+	}
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return err
+	}
+	gopassDir, err := g.getGopassDir()
+	if err != nil {
+		return err
+	}
+
+	for ; strings.HasPrefix(folder, base+"/"); folder = path.Dir(folder) {
+		p := filepath.Join(gopassDir, filepath.FromSlash(folder))
+		entries, err := os.ReadDir(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		// As in removeEmptyDir, os.Remove refuses to remove a folder files
+		// were added to since.
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
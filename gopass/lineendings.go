@@ -0,0 +1,31 @@
+package gopass
+
+import (
+	"runtime"
+	"strings"
+)
+
+// crlfOutput reports whether gopass terminates the lines of its output with
+// "\r\n" rather than "\n", as it does on Windows.
+var crlfOutput = runtime.GOOS == "windows"
+
+// trimOutputEnding removes the line ending gopass terminates its output with,
+// and nothing else, so that trailing whitespace of the output itself, such as
+// a carriage return ending a secret, is preserved.
+func trimOutputEnding(out string, crlf bool) string {
+	out = strings.TrimSuffix(out, "\n")
+	if crlf {
+		out = strings.TrimSuffix(out, "\r")
+	}
+	return out
+}
+
+// normalizeLineEndings returns the content of a secret printed by gopass with
+// its lines terminated by "\n", as stored, rather than by the line endings of
+// the output. Carriage returns that are part of the content are kept.
+func normalizeLineEndings(content string, crlf bool) string {
+	if !crlf {
+		return content
+	}
+	return strings.ReplaceAll(content, "\r\n", "\n")
+}
@@ -0,0 +1,30 @@
+package gopass
+
+import "testing"
+
+func TestTrimOutputEnding(t *testing.T) {
+	for _, tc := range []struct {
+		out      string
+		crlf     bool
+		expected string
+	}{
+		{"secret\n", false, "secret"},
+		{"secret\r\n", false, "secret\r"},
+		{"secret", false, "secret"},
+		{"secret\r\n", true, "secret"},
+		{"secret\r\r\n", true, "secret\r"},
+		{"secret\n", true, "secret"},
+		{"secret \r\n", true, "secret "},
+	} {
+		if actual := trimOutputEnding(tc.out, tc.crlf); actual != tc.expected {
+			t.Errorf("expected %q to be trimmed to %q (crlf: %t), actual: %q", tc.out, tc.expected, tc.crlf, actual)
+		}
+	}
+
+	if actual := normalizeLineEndings("secret\r\r\nkey: value\r\n", true); actual != "secret\r\nkey: value\n" {
+		t.Errorf("expected the carriage return of the secret to be kept, actual: %q", actual)
+	}
+	if actual := normalizeLineEndings("secret\r\nkey: value\n", false); actual != "secret\r\nkey: value\n" {
+		t.Errorf("expected the content to be kept as is without crlf output, actual: %q", actual)
+	}
+}
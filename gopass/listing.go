@@ -0,0 +1,225 @@
+package gopass
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gopassCLIListingEnv is the environment variable used to list the store
+// through `gopass ls` rather than by reading the store directory.
+const gopassCLIListingEnv = "GOPASS_CLI_LISTING"
+
+// gopassCLIUsernamesEnv is the environment variable used to list the
+// usernames of a server folder through `gopass ls --flat`, scoped to the
+// folder, rather than by reading the store directory.
+const gopassCLIUsernamesEnv = "GOPASS_CLI_USERNAMES"
+
+// cliUsernames reports whether the usernames of server folders are listed
+// through `gopass ls`.
+func (g Gopass) cliUsernames() bool {
+	return g.config().cliUsernames || os.Getenv(gopassCLIUsernamesEnv) == "1"
+}
+
+// cliListing reports whether the store is listed through `gopass ls`.
+func (g Gopass) cliListing() bool {
+	return g.config().cliListing || os.Getenv(gopassCLIListingEnv) == "1" || g.resolveAliases()
+}
+
+// listGopassCLI is like listGopassDir, but lists the secrets gopass reports
+// with `gopass ls --flat` rather than reading the store directory, so that it
+// does not depend on the storage backend of gopass.
+func (g Gopass) listGopassCLI(args ...string) ([]os.FileInfo, error) {
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := g.runGopass("", "ls", "--flat")
+	if err != nil {
+		return nil, err
+	}
+	return parseFlatListing(out, path.Join(append([]string{secrets}, args...)...)), nil
+}
+
+// listGopassSubtree is like listGopassCLI, but only lists the folder of the
+// credentials folder named by args, with `gopass ls --flat <folder>`. A
+// folder gopass reports as not found holds no secrets.
+func (g Gopass) listGopassSubtree(args ...string) ([]os.FileInfo, error) {
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Join(append([]string{secrets}, args...)...)
+	out, err := g.runGopass("", "ls", "--flat", dir)
+	if isSubtreeNotFound(err) {
+		return []os.FileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseFlatListing(out, dir), nil
+}
+
+// isSubtreeNotFound reports whether gopass failed to list a folder because it
+// is not in the store.
+func isSubtreeNotFound(err error) bool {
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) {
+		return false
+	}
+	stderr := strings.ToLower(gopassErr.Stderr)
+	return strings.Contains(stderr, "not found") || strings.Contains(stderr, entryNotFoundMessage)
+}
+
+// secretName returns the name of the secret of a folder entry: the name
+// gopass lists as is, or the name of a secret file of the store directory
+// without the extension of its crypto backend.
+func secretName(info os.FileInfo) string {
+	if _, ok := info.(listedEntry); ok {
+		return info.Name()
+	}
+	return trimSecretExtension(info.Name())
+}
+
+// parseFlatListing returns the entries of the folder dir found in the output
+// of `gopass ls --flat`, which lists the path of every secret on its own
+// line, sorted by name.
+func parseFlatListing(out, dir string) []os.FileInfo {
+	prefix := dir + "/"
+
+	entries := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(line, prefix)
+		if rest == "" {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		entries[name] = entries[name] || isDir
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for name, isDir := range entries {
+		infos = append(infos, listedEntry{name: name, dir: isDir})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos
+}
+
+// Reconcile compares the secrets of the credentials folder found by reading
+// the store directory, as Get and List do unless the store is listed through
+// gopass, with those `gopass ls --flat` reports, such as to detect a remote
+// mount lagging behind. It returns the gopass paths of the secrets only
+// gopass lists as added, and of those only found in the store directory as
+// removed, both sorted. Nothing is modified.
+func (g Gopass) Reconcile() (added, removed []string, err error) {
+	defer g.observe("Reconcile", time.Now(), &err)
+
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	walked, err := g.walkSecretFolder(secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := g.runGopass("", "ls", "--flat")
+	if err != nil {
+		return nil, nil, err
+	}
+	listed := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if p := strings.TrimSpace(line); strings.HasPrefix(p, secrets+"/") {
+			listed[p] = true
+		}
+	}
+
+	for p := range listed {
+		if !walked[p] {
+			added = append(added, p)
+		}
+	}
+	for p := range walked {
+		if !listed[p] {
+			removed = append(removed, p)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// walkSecretFolder returns the gopass paths of the secrets found in the store
+// directory under the credentials folder secrets. Hidden files and folders,
+// such as the .gpg-id of a folder with its own recipients, are skipped.
+func (g Gopass) walkSecretFolder(secrets string) (map[string]bool, error) {
+	root, err := g.serverDirPath("")
+	if err != nil {
+		return nil, err
+	}
+	root = os.ExpandEnv(root)
+
+	walked := map[string]bool{}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		walked[path.Join(secrets, trimSecretExtension(filepath.ToSlash(rel)))] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return walked, nil
+}
+
+// listedEntry is an entry of a folder of the store listed by gopass.
+type listedEntry struct {
+	name string
+	dir  bool
+}
+
+func (e listedEntry) Name() string       { return e.name }
+func (e listedEntry) Size() int64        { return 0 }
+func (e listedEntry) ModTime() time.Time { return time.Time{} }
+func (e listedEntry) IsDir() bool        { return e.dir }
+func (e listedEntry) Sys() interface{}   { return nil }
+
+func (e listedEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
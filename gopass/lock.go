@@ -0,0 +1,107 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gopassLockTimeoutEnv is the environment variable used to lock the store
+// while adding or deleting credentials, holding how long to wait for the lock
+// parsed as a time.Duration.
+const gopassLockTimeoutEnv = "GOPASS_LOCK_TIMEOUT"
+
+// lockFileName is the name of the lock file created in the store directory
+// while credentials are added or deleted.
+const lockFileName = ".docker-credential-helpers.lock"
+
+// lockPollInterval is how often a lock file held by another writer is
+// checked for release.
+const lockPollInterval = 50 * time.Millisecond
+
+// lockTimeout returns how long to wait for the lock file of the store, or
+// zero if the store is not locked.
+func (g Gopass) lockTimeout() (time.Duration, error) {
+	if cfg := g.config(); cfg.hasLockTimeout {
+		return cfg.lockTimeout, nil
+	}
+
+	v := os.Getenv(gopassLockTimeoutEnv)
+	if v == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassLockTimeoutEnv, v)
+	}
+	return timeout, nil
+}
+
+// lockStore creates the lock file of the store, waiting for other writers
+// holding it for up to the configured timeout, and returns the function
+// releasing it. It returns an error wrapping ErrStoreBusy if the lock file
+// cannot be created in time. Nothing is locked unless configured.
+func (g Gopass) lockStore() (func(), error) {
+	timeout, err := g.lockTimeout()
+	if err != nil || timeout == 0 {
+		return func() {}, err
+	}
+
+	dir, err := g.getGopassDir()
+	if err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, lockFileName)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			_ = f.Close()
+			return func() { _ = os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("unable to lock the store: %v", err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s is still held after %s, remove it if no other process is writing to the store", ErrStoreBusy, p, timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockStores is like lockStore, but locks the store of every mount the
+// folders are in, once per mount, and returns the function releasing them
+// all. The stores already locked are released if one cannot be locked.
+func lockStores(folders []Gopass) (func(), error) {
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	locked := map[string]bool{}
+	for _, h := range folders {
+		mount, err := h.gopassMount()
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		if locked[mount] {
+			continue
+		}
+
+		unlock, err := h.lockStore()
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		locked[mount] = true
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
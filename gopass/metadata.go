@@ -0,0 +1,107 @@
+package gopass
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metadataServerURL is the metadata key holding the original server URL of
+// the credentials, so that secrets can be identified without decoding the
+// folder they are stored in.
+const metadataServerURL = "server_url"
+
+// metadataSecretEncoding is the metadata key recording how the secret on the
+// first line is encoded. Secrets spanning several lines are stored base64
+// encoded, as only the first line of a gopass secret holds its password.
+const metadataSecretEncoding = "secret_encoding"
+
+// secretEncodingBase64 is the metadataSecretEncoding of base64 encoded secrets.
+const secretEncodingBase64 = "base64"
+
+// metadataIdentityToken is the metadata key holding the identity token stored
+// alongside the password of credentials.
+const metadataIdentityToken = "identity_token"
+
+// reservedMetadata are the metadata keys set by the helper itself.
+var reservedMetadata = []string{metadataServerURL, metadataSecretEncoding, metadataIdentityToken, metadataExpiresAt, metadataUsername, metadataCreatedAt}
+
+// formatSecret returns the content of a gopass secret: the secret on the
+// first line, followed by one "key: value" line per metadata entry, as
+// understood by gopass. Secrets spanning several lines are base64 encoded.
+func formatSecret(secret string, metadata map[string]string) (string, error) {
+	keys := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		if key == "" || strings.ContainsAny(key, ":\r\n") {
+			return "", fmt.Errorf("invalid metadata key %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("invalid value for metadata key %q: must be a single line", key)
+		}
+		keys = append(keys, key)
+	}
+	if strings.ContainsAny(secret, "\r\n") {
+		all := make(map[string]string, len(metadata)+1)
+		for key, value := range metadata {
+			all[key] = value
+		}
+		all[metadataSecretEncoding] = secretEncodingBase64
+		metadata = all
+		keys = append(keys, metadataSecretEncoding)
+		secret = base64.StdEncoding.EncodeToString([]byte(secret))
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(secret)
+	b.WriteString("\n")
+	for _, key := range keys {
+		b.WriteString(key + ": " + metadata[key] + "\n")
+	}
+	return b.String(), nil
+}
+
+// parseSecret splits the content of a gopass secret into the secret on its
+// first line and the "key: value" metadata on the following lines, decoding
+// the secret if it was encoded by formatSecret. Lines that are not key-value
+// pairs are ignored.
+func parseSecret(content string) (string, map[string]string, error) {
+	secret, body, _ := strings.Cut(content, "\n")
+	secret = strings.TrimRight(secret, "\r")
+
+	metadata := map[string]string{}
+	for _, line := range strings.Split(body, "\n") {
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if !ok || key == "" {
+			continue
+		}
+		metadata[key] = strings.TrimSpace(value)
+	}
+
+	switch encoding := metadata[metadataSecretEncoding]; encoding {
+	case "":
+		return secret, metadata, nil
+	case secretEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid base64 encoded secret: %v", err)
+		}
+		return string(decoded), metadata, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported secret encoding %q", encoding)
+	}
+}
+
+// setMetadata returns the content of a gopass secret with the value of the
+// metadata key replaced, leaving the rest of the content untouched. The value
+// must be a single line.
+func setMetadata(content, key, value string) string {
+	lines := strings.Split(content, "\n")
+	for i := 1; i < len(lines); i++ {
+		if k, _, ok := strings.Cut(lines[i], ":"); ok && k == key {
+			lines[i] = key + ": " + value
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,66 @@
+package gopass
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics receives an observation for every call of an exported method of
+// Gopass: the name of the method, such as "Get", how long it took and the
+// error it returned, if any. Methods built on others, such as SelfTest, are
+// observed along with the methods they call. Observations never hold
+// secrets, and neither do the errors of the helper.
+type Metrics interface {
+	ObserveOp(name string, dur time.Duration, err error)
+}
+
+// nopMetrics is the Metrics used by default, which discards observations.
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveOp(string, time.Duration, error) {}
+
+// Observation is an operation observed by MemoryMetrics.
+type Observation struct {
+	// Name is the name of the method called.
+	Name string
+	// Duration is how long the call took.
+	Duration time.Duration
+	// Err is the error returned by the call, if any.
+	Err error
+}
+
+// MemoryMetrics is a Metrics keeping every observation in memory, such as to
+// check the operations made by the helper in tests. The zero value is ready
+// to use.
+type MemoryMetrics struct {
+	mu           sync.Mutex
+	observations []Observation
+}
+
+// ObserveOp records an observation.
+func (m *MemoryMetrics) ObserveOp(name string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, Observation{Name: name, Duration: dur, Err: err})
+}
+
+// Observations returns the observations recorded so far, in order.
+func (m *MemoryMetrics) Observations() []Observation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Observation{}, m.observations...)
+}
+
+// metrics returns the configured Metrics, or one discarding observations.
+func (g Gopass) metrics() Metrics {
+	if m := g.config().metrics; m != nil {
+		return m
+	}
+	return nopMetrics{}
+}
+
+// observe reports the call of the exported method name, started at start and
+// returning *err, to the configured Metrics.
+func (g Gopass) observe(name string, start time.Time, err *error) {
+	g.metrics().ObserveOp(name, time.Since(start), *err)
+}
@@ -0,0 +1,288 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// ImportFrom copies the credentials stored by another helper, such as the
+// secretservice helper, into the store, and returns the number of credentials
+// copied. Credentials already stored for the same server URL and username are
+// skipped, unless overwrite is true. Failing to copy a credential does not
+// stop the import: the errors are returned together once every credential
+// has been tried.
+func (g Gopass) ImportFrom(src credentials.Helper, overwrite bool) (imported int, err error) {
+	defer g.observe("ImportFrom", time.Now(), &err)
+
+	if err := g.checkWritable("import"); err != nil {
+		return 0, err
+	}
+
+	servers, err := src.List()
+	if err != nil {
+		return 0, fmt.Errorf("unable to list credentials to import: %w", err)
+	}
+
+	serverURLs := make([]string, 0, len(servers))
+	for serverURL := range servers {
+		serverURLs = append(serverURLs, serverURL)
+	}
+	sort.Strings(serverURLs)
+
+	var errs []error
+	for _, serverURL := range serverURLs {
+		ok, err := g.importCredentials(src, serverURL, overwrite)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to import credentials for %s: %w", serverURL, err))
+			continue
+		}
+		if ok {
+			imported++
+		}
+	}
+	return imported, joinErrors(errs)
+}
+
+// Export returns every credential in the store, sorted by server URL and
+// username. Every username stored for a server URL is returned.
+//
+// The returned secrets are in plaintext: the caller is responsible for
+// protecting them, for example by encrypting them before writing them out,
+// and for not keeping them around longer than needed.
+//
+// Failing to read the credentials of a server URL does not stop the export:
+// the credentials that could be read are returned along with the errors.
+func (g Gopass) Export() (all []*credentials.Credentials, err error) {
+	defer g.observe("Export", time.Now(), &err)
+
+	servers, err := g.List()
+	if err != nil {
+		return nil, err
+	}
+
+	serverURLs := make([]string, 0, len(servers))
+	for serverURL := range servers {
+		serverURLs = append(serverURLs, serverURL)
+	}
+	sort.Strings(serverURLs)
+
+	var errs []error
+	var exported []*credentials.Credentials
+	for _, serverURL := range serverURLs {
+		secrets, err := g.GetAll(serverURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to export credentials for %s: %w", serverURL, err))
+			continue
+		}
+
+		usernames := make([]string, 0, len(secrets))
+		for username := range secrets {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		for _, username := range usernames {
+			exported = append(exported, &credentials.Credentials{
+				ServerURL: serverURL,
+				Username:  username,
+				Secret:    secrets[username],
+			})
+		}
+	}
+	return exported, joinErrors(errs)
+}
+
+// importCredentials copies the credentials of serverURL from src, reporting
+// whether they were copied.
+func (g Gopass) importCredentials(src credentials.Helper, serverURL string, overwrite bool) (bool, error) {
+	username, secret, err := src.Get(serverURL)
+	if err != nil {
+		return false, err
+	}
+
+	if !overwrite {
+		h, err := g.routed(serverURL)
+		if err != nil {
+			return false, err
+		}
+		exists, err := h.hasUsername(serverURL, username)
+		if err != nil || exists {
+			return false, err
+		}
+	}
+
+	err = g.Add(&credentials.Credentials{
+		ServerURL: serverURL,
+		Username:  username,
+		Secret:    secret,
+	})
+	return err == nil, err
+}
+
+// hasUsername reports whether credentials are stored for the given server URL
+// and username.
+func (g Gopass) hasUsername(serverURL, username string) (bool, error) {
+	_, usernames, err := g.serverUsernames(serverURL)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, u := range usernames {
+		if u == usernameName(username) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Move moves the credentials of every username stored for oldServerURL to
+// newServerURL, such as when a registry is renamed, and removes the folder of
+// oldServerURL. Each server URL is stored where its route, if any, stores it,
+// so moving credentials may move them to another folder or mount. Nothing is
+// moved if any of the usernames is already stored for newServerURL.
+func (g Gopass) Move(oldServerURL, newServerURL string) (err error) {
+	defer g.observe("Move", time.Now(), &err)
+
+	if newServerURL == "" {
+		return errors.New("missing server url")
+	}
+	if strings.ContainsAny(newServerURL, "\r\n") {
+		return fmt.Errorf("invalid server url %q", newServerURL)
+	}
+
+	if err := g.checkWritable("move"); err != nil {
+		return err
+	}
+
+	src, err := g.routed(oldServerURL)
+	if err != nil {
+		return err
+	}
+	dst, err := g.routed(newServerURL)
+	if err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.invalidateCache(oldServerURL)
+	defer g.invalidateCache(newServerURL)
+
+	// Both stores are locked when moving credentials to another mount.
+	unlock, err := lockStores([]Gopass{src, dst})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	loc, usernames, err := src.serverUsernames(oldServerURL)
+	if err != nil {
+		return err
+	}
+
+	to, err := dst.serverLocation(newServerURL)
+	if err != nil {
+		return err
+	}
+	if to.dir == loc.dir && to.secrets == loc.secrets {
+		return nil
+	}
+
+	var conflicts []string
+	for _, username := range usernames {
+		exists, err := dst.hasUsername(newServerURL, username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			conflicts = append(conflicts, username)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("usernames already stored for %s: %s", newServerURL, strings.Join(conflicts, ", "))
+	}
+
+	_, err = src.moveServer(loc, dst, to, newServerURL)
+	return err
+}
+
+// moveServer moves the credentials stored in the server folder from to the
+// server folder to of dst, and returns the number of credentials moved. The
+// server_url metadata of the credentials is set to serverURL, unless empty or
+// storing secrets through gopass cat, which copies them byte for byte.
+// Usernames already stored in to are left in place, and reported once every
+// other credential has been moved. The server folder from is removed once it
+// is left empty.
+func (g Gopass) moveServer(from serverLocation, dst Gopass, to serverLocation, serverURL string) (int, error) {
+	usernames, err := g.listUsernames(from)
+	if err != nil {
+		return 0, err
+	}
+
+	existing, err := dst.listUsernames(to)
+	if err != nil {
+		return 0, err
+	}
+	stored := map[string]bool{}
+	for _, username := range existing {
+		stored[username] = true
+	}
+
+	var conflicts []string
+	moved := 0
+	for _, username := range usernames {
+		if stored[username] {
+			conflicts = append(conflicts, username)
+			continue
+		}
+
+		content, insert, err := g.copySecret(from.secretPath(username), serverURL)
+		if err != nil {
+			return moved, err
+		}
+		if _, err := dst.runGopass(content, append(insert, to.secretPath(username))...); err != nil {
+			return moved, err
+		}
+		if _, err := g.runGopass("", "rm", "-f", from.secretPath(username)); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	if err := g.removeEmptyServerDir(from); err != nil {
+		return moved, err
+	}
+	if len(conflicts) > 0 {
+		return moved, fmt.Errorf("usernames already stored: %s", strings.Join(conflicts, ", "))
+	}
+	return moved, nil
+}
+
+// copySecret returns the content of the secret stored at the given gopass
+// path, with its server_url metadata set to serverURL unless empty, along
+// with the gopass arguments writing it back elsewhere.
+func (g Gopass) copySecret(p, serverURL string) (string, []string, error) {
+	if g.useCat() {
+		content, err := g.runGopass("", "cat", p)
+		return content, []string{"cat"}, err
+	}
+
+	// The whole secret is copied so that metadata is preserved.
+	content, err := g.runGopass("", "show", "-n", p)
+	if err != nil {
+		return "", nil, err
+	}
+	content = normalizeLineEndings(content, crlfOutput)
+	if serverURL != "" {
+		content = setMetadata(content, metadataServerURL, serverURL)
+	}
+	return content, g.insertArgs(true), nil
+}
@@ -0,0 +1,27 @@
+package gopass
+
+import "os"
+
+// gopassMultilineInsertEnv is the environment variable used to insert
+// secrets through `gopass insert --multiline`.
+const gopassMultilineInsertEnv = "GOPASS_MULTILINE_INSERT"
+
+// multilineInsert reports whether secrets are inserted through
+// `gopass insert --multiline`, which stores the secret and its metadata lines
+// as a single block.
+func (g Gopass) multilineInsert() bool {
+	return g.config().multilineInsert || os.Getenv(gopassMultilineInsertEnv) == "1"
+}
+
+// insertArgs returns the gopass arguments inserting a secret, overwriting the
+// secret already stored if overwrite is true. The path is to be appended.
+func (g Gopass) insertArgs(overwrite bool) []string {
+	args := []string{"insert"}
+	if g.multilineInsert() {
+		args = append(args, "--multiline")
+	}
+	if overwrite {
+		args = append(args, "-f")
+	}
+	return args
+}
@@ -0,0 +1,65 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// gopassNonInteractiveEnv is the environment variable used to make gpg fail
+// rather than prompt for a passphrase: "1" always does, and "auto" does when
+// no terminal or display is available to prompt on.
+const gopassNonInteractiveEnv = "GOPASS_NONINTERACTIVE"
+
+// gopassGPGOptsEnv is the environment variable gopass reads extra gpg
+// arguments from.
+const gopassGPGOptsEnv = "GOPASS_GPG_OPTS"
+
+// batchGPGOpts are the gpg arguments making gpg fail with "No pinentry"
+// rather than prompt for a passphrase.
+const batchGPGOpts = "--batch --pinentry-mode=error"
+
+// hasTerminal reports whether the helper has a controlling terminal.
+var hasTerminal = func() bool {
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+	return true
+}
+
+// nonInteractive reports whether gpg must fail rather than prompt for a
+// passphrase. With "auto", a passphrase can be prompted for on Windows and
+// macOS, whose pinentry programs need neither, on a controlling terminal or
+// on a graphical display.
+func (g Gopass) nonInteractive() bool {
+	if g.batch || g.config().nonInteractive {
+		return true
+	}
+
+	switch os.Getenv(gopassNonInteractiveEnv) {
+	case "1":
+		return true
+	case "auto":
+		if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+			return false
+		}
+		return !hasTerminal() && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+	}
+	return false
+}
+
+// nonInteractiveEnv returns the environment variable making gpg fail rather
+// than prompt for a passphrase, preserving the gpg arguments already set.
+func nonInteractiveEnv() string {
+	opts := strings.TrimSpace(os.Getenv(gopassGPGOptsEnv) + " " + batchGPGOpts)
+	return gopassGPGOptsEnv + "=" + opts
+}
+
+// passphraseRequired translates the failure of gopass to decrypt a secret in
+// a non-interactive context into ErrPassphraseRequired.
+func passphraseRequired(err error) error {
+	return fmt.Errorf("%w: %v", ErrPassphraseRequired, err)
+}
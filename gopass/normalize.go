@@ -0,0 +1,180 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/registryurl"
+)
+
+// gopassNormalizeEnv is the environment variable used to normalize server URLs
+// before storing or looking up their credentials.
+const gopassNormalizeEnv = "DOCKER_CREDENTIAL_GOPASS_NORMALIZE"
+
+// normalization selects how server URLs are normalized.
+type normalization int
+
+const (
+	// normalizeNone stores credentials under the server URL as given.
+	normalizeNone normalization = iota
+	// normalizeURL lowercases the scheme and host of server URLs, defaulting
+	// the scheme to https, and strips trailing slashes from their path.
+	normalizeURL
+	// normalizeHost is like normalizeURL, but drops the scheme as well.
+	normalizeHost
+)
+
+// dockerHubHosts are the hostnames Docker Hub is addressed by. They are all
+// normalized to the address the docker CLI stores Docker Hub credentials
+// under.
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// normalization returns how server URLs are normalized.
+func (g Gopass) normalization() (normalization, error) {
+	if n := g.config().normalization; n != normalizeNone {
+		return n, nil
+	}
+
+	switch v := os.Getenv(gopassNormalizeEnv); v {
+	case "", "0":
+		return normalizeNone, nil
+	case "1":
+		return normalizeURL, nil
+	case "host":
+		return normalizeHost, nil
+	default:
+		return normalizeNone, fmt.Errorf("invalid %s %q: must be \"0\", \"1\" or \"host\"", gopassNormalizeEnv, v)
+	}
+}
+
+// normalizeServerURL returns the canonical form of serverURL. Server URLs that
+// cannot be parsed are returned unchanged.
+func normalizeServerURL(serverURL string, n normalization) string {
+	if n == normalizeNone {
+		return serverURL
+	}
+
+	u, err := registryurl.Parse(serverURL)
+	if err != nil {
+		return serverURL
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "https"
+	}
+	host := strings.ToLower(u.Host)
+	p := strings.TrimRight(u.EscapedPath(), "/")
+
+	if dockerHubHosts[host] && (p == "" || p == "/v1") {
+		scheme, host, p = "https", "index.docker.io", "/v1"
+	}
+
+	if n == normalizeHost {
+		return host + p
+	}
+	return scheme + "://" + host + p
+}
+
+// MigrateNormalized moves credentials stored under a server URL that is not
+// normalized to the folder of its normalized server URL, and returns the
+// number of credentials moved. It requires normalization to be enabled.
+//
+// Credentials are left in place when the same username is already stored for
+// the normalized server URL, and an error is returned for them once every
+// other credential has been moved. Credentials are moved within their folder,
+// in every folder List lists.
+func (g Gopass) MigrateNormalized() (migrated int, err error) {
+	defer g.observe("MigrateNormalized", time.Now(), &err)
+
+	n, err := g.normalization()
+	if err != nil {
+		return 0, err
+	}
+	if n == normalizeNone {
+		return 0, errors.New("server URL normalization is not enabled")
+	}
+
+	if err := g.checkWritable("migrate"); err != nil {
+		return 0, err
+	}
+
+	listed, err := g.listedFolders()
+	if err != nil {
+		return 0, err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.config().cache.clear()
+
+	unlock, err := lockStores(listed)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var errs []error
+	for _, h := range listed {
+		moved, folderErrs, err := h.migrateNormalized(n)
+		migrated += moved
+		if err != nil {
+			return migrated, err
+		}
+		errs = append(errs, folderErrs...)
+	}
+	return migrated, joinErrors(errs)
+}
+
+// migrateNormalized moves the credentials of the folder of g that are not
+// stored under their normalized server URL, as MigrateNormalized does, and
+// returns the number of credentials moved, along with the errors moving
+// them. The error is reserved for failures to list the folder.
+func (g Gopass) migrateNormalized(n normalization) (moved int, errs []error, err error) {
+	scheme, err := g.pathScheme()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	secrets, err := g.secretFolder()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dirs, err := g.listServerDirs(scheme)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, dir := range dirs {
+		serverURL, err := DecodeServerURL(dir)
+		if err != nil {
+			continue
+		}
+
+		normalized := normalizeServerURL(serverURL, n)
+		if normalized == serverURL {
+			continue
+		}
+
+		target, err := g.encodeServerURL(normalized)
+		if err != nil {
+			return moved, errs, err
+		}
+
+		from := serverLocation{scheme: scheme, secrets: secrets, dir: dir}
+		m, err := g.moveServer(from, g, serverLocation{scheme: scheme, secrets: secrets, dir: target}, "")
+		moved += m
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to migrate credentials for %s to %s: %w", serverURL, normalized, err))
+		}
+	}
+	return moved, errs, nil
+}
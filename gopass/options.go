@@ -0,0 +1,582 @@
+package gopass
+
+import (
+	"sync"
+	"time"
+)
+
+// Option configures a Gopass created with New.
+type Option func(*config)
+
+// Logger receives debug messages along with alternating key-value pairs. It
+// is compatible with the Debug method of a *slog.Logger.
+type Logger func(msg string, keyvals ...interface{})
+
+// config holds the configuration of a Gopass, along with the state cached
+// from it. Settings left unset fall back to the environment.
+type config struct {
+	binary             string
+	wrapper            []string
+	folder             string
+	fallbackFolders    []string
+	routes             []route
+	mount              string
+	timeout            time.Duration
+	hasTimeout         bool
+	initTimeout        time.Duration
+	hasInitTimeout     bool
+	initTTL            time.Duration
+	hasInitTTL         bool
+	lockTimeout        time.Duration
+	hasLockTimeout     bool
+	readOnly           bool
+	globalArgs         []string
+	autoSync           bool
+	logf               Logger
+	metrics            Metrics
+	legacyFallback     bool
+	normalization      normalization
+	retries            int
+	retryDelay         time.Duration
+	hasRetries         bool
+	recipients         []string
+	field              string
+	showTemplate       []string
+	fullInitCheck      bool
+	initCheckArgs      []string
+	skipInitCheck      bool
+	readablePaths      bool
+	cliListing         bool
+	cliUsernames       bool
+	resolveAliases     bool
+	pathSeparator      string
+	usernameDirs       bool
+	noOverwrite        bool
+	recentUsername     bool
+	preferredUsernames []string
+	perUser            bool
+	pruneParents       bool
+	createdAt          bool
+	envAllowList       []string
+	useCat             bool
+	multilineInsert    bool
+	hideExpired        bool
+	nonInteractive     bool
+	usePinentry        bool
+	cacheTTL           time.Duration
+	cacheSize          int
+	hasCache           bool
+	runner             runner
+
+	// initializationMutex is held while initializing so that only one
+	// 'gopass' round-tripping is done to check that gopass is functioning.
+	initializationMutex sync.Mutex
+	// initialized, initializedAt and resolvedRunner are set by
+	// checkInitialized while holding initializationMutex, once gopass is
+	// known to be functioning.
+	initialized    bool
+	initializedAt  time.Time
+	resolvedRunner execRunner
+
+	// dirMutex is held while resolving store directories so that only one
+	// 'gopass config' round-trip is done per mount.
+	dirMutex sync.Mutex
+	// dirs caches the store directories resolved by getGopassDir, by mount
+	// and gopass home directory.
+	dirs map[dirKey]string
+
+	// cache holds the credentials returned by Get, if enabled.
+	cache credentialCache
+}
+
+// New returns a Gopass configured with the given options. Settings that are
+// not configured by an option are read from the environment, as for the
+// zero value of Gopass.
+func New(opts ...Option) *Gopass {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &Gopass{cfg: cfg}
+}
+
+// reset clears the state cached from the configuration.
+func (c *config) reset() {
+	c.initializationMutex.Lock()
+	c.initialized = false
+	c.resolvedRunner = execRunner{}
+	c.initializationMutex.Unlock()
+
+	c.dirMutex.Lock()
+	c.dirs = nil
+	c.dirMutex.Unlock()
+
+	c.cache.clear()
+}
+
+// WithBinary sets the name or path of the gopass binary, instead of
+// GOPASS_BINARY. The binary is looked up on PATH by default.
+func WithBinary(binary string) Option {
+	return func(c *config) {
+		c.binary = binary
+	}
+}
+
+// WithWrapper runs gopass through the command argv, such as
+// "sudo", "-u", "ci", "gopass" or "flatpak-spawn", "--host", "gopass", to
+// which the gopass arguments are appended, instead of GOPASS_WRAPPER, which
+// holds the whitespace separated command. The binary is then ignored.
+func WithWrapper(argv ...string) Option {
+	return func(c *config) {
+		c.wrapper = append([]string{}, argv...)
+	}
+}
+
+// WithFolder sets the folder credentials are stored under, instead of
+// DOCKER_CREDENTIAL_GOPASS_FOLDER.
+func WithFolder(folder string) Option {
+	return func(c *config) {
+		c.folder = folder
+	}
+}
+
+// WithFallbackFolders sets the folders Get searches in order when nothing is
+// found in the credentials folder, such as a folder of credentials shared by
+// a team, which personal credentials then override, instead of the comma or
+// whitespace separated GOPASS_FALLBACK_FOLDERS. List lists them as well,
+// reporting the credentials of the folder searched first for server URLs
+// stored in several. Credentials are never added to or deleted from them.
+func WithFallbackFolders(folders ...string) Option {
+	return func(c *config) {
+		c.fallbackFolders = append([]string{}, folders...)
+	}
+}
+
+// WithRoute stores the credentials of the server URLs, or hosts, matching the
+// glob pattern in the given mount and folder, instead of GOPASS_ROUTES, which
+// holds comma or whitespace separated routes of the form
+// "pattern=mount:folder", such as "*.corp.example.com=work:". An empty mount
+// or folder is the configured one. Routes are consulted in the order they are
+// added, and the first matching one is used; server URLs matching none are
+// stored as configured. List lists the credentials of every route.
+func WithRoute(pattern, mount, folder string) Option {
+	return func(c *config) {
+		c.routes = append(c.routes, route{pattern: pattern, mount: mount, folder: folder})
+	}
+}
+
+// WithMount sets the gopass mount credentials are stored in, instead of
+// GOPASS_MOUNT, in which case secrets are stored as
+// "$GOPASS_MOUNT/$GOPASS_FOLDER/base64-url(serverURL)/username". Credentials
+// are stored in the root store by default.
+func WithMount(mount string) Option {
+	return func(c *config) {
+		c.mount = mount
+	}
+}
+
+// WithTimeout sets the timeout applied to gopass invocations, instead of
+// GOPASS_TIMEOUT. It is one minute by default, and a zero timeout disables
+// the deadline.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.timeout = timeout
+		c.hasTimeout = true
+	}
+}
+
+// WithCache caches the credentials returned by Get in memory for ttl, holding
+// those of at most size server URLs, instead of GOPASS_CACHE_TTL and
+// GOPASS_CACHE_SIZE. This spares long-running callers a gopass invocation,
+// and possibly a pinentry prompt, for every lookup. Adding and deleting
+// credentials evicts those of the server URL, and secrets are zeroed once
+// evicted. A zero ttl disables the cache, as by default, and a size that is
+// not positive holds the default of 64 server URLs.
+func WithCache(ttl time.Duration, size int) Option {
+	return func(c *config) {
+		c.cacheTTL = ttl
+		c.cacheSize = size
+		c.hasCache = true
+	}
+}
+
+// WithInitTimeout sets the deadline of the check that gopass is initialized,
+// including its fallback to listing the whole store, instead of
+// GOPASS_INIT_TIMEOUT, so that a hanging gpg-agent or pinentry fails it
+// rather than blocking `docker login`. It is the timeout of gopass
+// invocations by default, and a zero timeout disables the deadline.
+func WithInitTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.initTimeout = timeout
+		c.hasInitTimeout = true
+	}
+}
+
+// WithInitTTL sets how long gopass is known to be initialized once checked,
+// instead of GOPASS_INIT_TTL. It is five minutes by default, and a zero TTL
+// never expires.
+func WithInitTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.initTTL = ttl
+		c.hasInitTTL = true
+	}
+}
+
+// WithLockTimeout locks the store while adding or deleting credentials,
+// waiting up to timeout for the lock held by other writers, instead of
+// GOPASS_LOCK_TIMEOUT. This serializes writes across processes, through a
+// ".docker-credential-helpers.lock" file created in the store directory:
+// writers fail with ErrStoreBusy if it is not removed in time. Manual edits
+// of the store can be serialized with the helper by creating the lock file
+// around them. Reading credentials is never blocked by a write in progress.
+// A zero timeout disables locking, as by default.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.lockTimeout = timeout
+		c.hasLockTimeout = true
+	}
+}
+
+// WithReadOnly makes the helper refuse to modify the store, as when
+// GOPASS_READ_ONLY is set to "1".
+func WithReadOnly() Option {
+	return func(c *config) {
+		c.readOnly = true
+	}
+}
+
+// WithGlobalArgs sets the global flags passed to every gopass invocation,
+// before the subcommand, instead of GOPASS_GLOBAL_ARGS. Flags taking a value
+// must use the --flag=value form.
+func WithGlobalArgs(args ...string) Option {
+	return func(c *config) {
+		c.globalArgs = append([]string{}, args...)
+	}
+}
+
+// WithAutoSync lets gopass autosync after adding or deleting credentials, as
+// when DOCKER_CREDENTIAL_GOPASS_AUTOSYNC is set to "1". By default, secrets
+// are written to the local store immediately, so that logging in is not
+// slowed down by pushing to a remote, but only pushed by a later
+// `gopass sync`, or by Sync.
+func WithAutoSync() Option {
+	return func(c *config) {
+		c.autoSync = true
+	}
+}
+
+// WithLogger sets a Logger receiving a debug message for every gopass
+// invocation, with its subcommand, arguments and duration. Secrets are never
+// logged. Nothing is logged by default.
+func WithLogger(logf Logger) Option {
+	return func(c *config) {
+		c.logf = logf
+	}
+}
+
+// WithMetrics sets the Metrics receiving an observation for every call of an
+// exported method. Nothing is observed by default.
+func WithMetrics(m Metrics) Option {
+	return func(c *config) {
+		c.metrics = m
+	}
+}
+
+// WithLegacyFallback lets Get fall back to credentials stored under the plain
+// server URL, as "$GOPASS_FOLDER/serverURL/username", when nothing is found
+// under the encoded server URL, as when GOPASS_LEGACY_FALLBACK is set to "1".
+// This eases migrating from tools storing credentials that way.
+func WithLegacyFallback() Option {
+	return func(c *config) {
+		c.legacyFallback = true
+	}
+}
+
+// WithNormalization normalizes server URLs before storing or looking up their
+// credentials, as when DOCKER_CREDENTIAL_GOPASS_NORMALIZE is set to "1", so
+// that variants of the same server URL, such as
+// "https://index.docker.io/v1/" and "index.docker.io", share their
+// credentials: the scheme and host are lowercased, the scheme defaults to
+// https, trailing slashes are stripped and the Docker Hub hosts are mapped to
+// "https://index.docker.io/v1". The scheme is dropped from normalized server
+// URLs if dropScheme is true, as when the variable is set to "host".
+// Credentials stored before enabling normalization are moved by
+// MigrateNormalized.
+func WithNormalization(dropScheme bool) Option {
+	return func(c *config) {
+		c.normalization = normalizeURL
+		if dropScheme {
+			c.normalization = normalizeHost
+		}
+	}
+}
+
+// WithRetries sets how many times adding or deleting credentials is retried
+// after a gopass failure that looks transient, such as a git lock held by
+// another process or a network error, and the delay before the first retry,
+// instead of GOPASS_RETRIES and GOPASS_RETRY_DELAY. The delay is 500ms by
+// default, and doubles with every retry. Decryption failures are never
+// retried, and nothing is retried by default.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *config) {
+		c.retries = retries
+		c.retryDelay = delay
+		c.hasRetries = true
+	}
+}
+
+// WithRecipients sets the gpg recipients written to the .gpg-id file of the
+// credentials folder, unless it has one already, before credentials are
+// written to it, instead of the comma or whitespace separated
+// GOPASS_RECIPIENTS. gopass then encrypts the credentials for them, leaving
+// the recipients of the rest of the store untouched, and re-encrypts those
+// already stored through `gopass fsck`. Each key must be known to gpg. Once
+// the recipients change, such as after rotating a gpg key, Rekey re-encrypts
+// the credentials for them.
+func WithRecipients(recipients ...string) Option {
+	return func(c *config) {
+		c.recipients = append([]string{}, recipients...)
+	}
+}
+
+// WithField reads secrets from the given field of gopass secrets instead of
+// their first line, such as to read credentials curated by hand holding
+// "token: <secret>", as when DOCKER_CREDENTIAL_GOPASS_FIELD is set.
+func WithField(field string) Option {
+	return func(c *config) {
+		c.field = field
+	}
+}
+
+// WithShowTemplate sets the gopass arguments Get reads secrets with, instead
+// of the whitespace separated GOPASS_SHOW_TEMPLATE, such as "show -o {path}",
+// for setups wrapping gopass differently. Secrets are read with
+// `gopass show -n <path>` by default. The arguments must contain "{path}",
+// which is replaced by the gopass path of the secret, exactly once, and their
+// subcommand must be show or cat. The first line of the output is read as the
+// secret, along with metadata on the following lines. It cannot be combined
+// with hiding expired credentials, which reads the whole secret.
+func WithShowTemplate(args ...string) Option {
+	return func(c *config) {
+		c.showTemplate = append([]string{}, args...)
+	}
+}
+
+// WithFullInitCheck lists the whole store when checking that gopass is
+// initialized, as when GOPASS_FULL_INIT_CHECK is set to "1". The check lists
+// the credentials folder with `gopass ls --flat` by default, falling back to
+// listing the whole store until the folder exists.
+func WithFullInitCheck() Option {
+	return func(c *config) {
+		c.fullInitCheck = true
+	}
+}
+
+// WithInitCheckArgs sets the gopass arguments run to check that gopass is
+// initialized, rather than listing the store, such as "config", "mounts.path"
+// where listing is expensive, instead of the whitespace separated
+// GOPASS_INIT_CHECK_ARGS.
+func WithInitCheckArgs(args ...string) Option {
+	return func(c *config) {
+		c.initCheckArgs = append([]string{}, args...)
+	}
+}
+
+// WithSkipInitCheck treats gopass as initialized without checking it, nor
+// its version, as when GOPASS_SKIP_INIT_CHECK is set to "1". A missing or
+// broken store then only surfaces as the errors of the first operation, which
+// are less descriptive than ErrGopassNotInitialized.
+func WithSkipInitCheck() Option {
+	return func(c *config) {
+		c.skipInitCheck = true
+	}
+}
+
+// WithReadablePaths stores credentials under readable folder names rather
+// than base64-url encoded ones, so that the store can be browsed directly, as
+// when GOPASS_READABLE_PATHS is set to "1": "/" is replaced by "~" and other
+// characters that are not ASCII letters, digits, ".", "-" or "_" are
+// percent-encoded, as in
+// "$GOPASS_FOLDER/https%3A~~registry.example.com%3A5000~v1/username". Both
+// layouts are listed regardless of the setting.
+func WithReadablePaths() Option {
+	return func(c *config) {
+		c.readablePaths = true
+	}
+}
+
+// WithCLIListing lists the store through `gopass ls --flat` rather than by
+// reading the store directory, so that listing does not depend on the storage
+// backend of gopass, as when GOPASS_CLI_LISTING is set to "1".
+func WithCLIListing() Option {
+	return func(c *config) {
+		c.cliListing = true
+	}
+}
+
+// WithCLIUsernames lists the usernames of a server URL through
+// `gopass ls --flat <folder>/<encoded server URL>` rather than by reading the
+// store directory, as when GOPASS_CLI_USERNAMES is set to "1". The names
+// gopass reports are read rather than guessed from the names of the secret
+// files, which depend on its crypto backend.
+func WithCLIUsernames() Option {
+	return func(c *config) {
+		c.cliUsernames = true
+	}
+}
+
+// WithResolveAliases looks credentials up through gopass only, so that the
+// aliases and templates gopass resolves paths with are honored, as when
+// GOPASS_RESOLVE_ALIASES is set to "1". The store is listed through gopass,
+// and Get shows the path of the credentials of a username requested as
+// "serverURL#username" even if gopass does not list it. Only gopass reporting
+// that the entry is not in the store is then treated as credentials not
+// found.
+func WithResolveAliases() Option {
+	return func(c *config) {
+		c.resolveAliases = true
+	}
+}
+
+// WithPathSeparator sets the separator between the encoded server URL and the
+// username in the gopass path of credentials, instead of
+// GOPASS_PATH_SEPARATOR. Any separator but "/" stores every credential as a
+// secret of the credentials folder itself, as
+// "$GOPASS_FOLDER/base64-url(serverURL)<separator>username". Credentials
+// stored with one layout are not listed with the other.
+func WithPathSeparator(sep string) Option {
+	return func(c *config) {
+		c.pathSeparator = sep
+	}
+}
+
+// WithUsernameDirs stores the credentials of every username in a folder of
+// its own, as "$GOPASS_FOLDER/base64-url(serverURL)/username/credential", so
+// that other files, such as notes, may be stored next to them, as when
+// GOPASS_USERNAME_DIRS is set to "1". Credentials stored with one layout are
+// not listed with the other.
+func WithUsernameDirs() Option {
+	return func(c *config) {
+		c.usernameDirs = true
+	}
+}
+
+// WithNoOverwrite makes Add refuse to overwrite the credentials already stored
+// for a username, with ErrCredentialsExist, as when GOPASS_NO_OVERWRITE is set
+// to "1". Add overwrites them by default, as docker expects.
+func WithNoOverwrite() Option {
+	return func(c *config) {
+		c.noOverwrite = true
+	}
+}
+
+// WithRecentUsername makes List report the most recently modified username of
+// server URLs storing several, rather than the first one in alphabetical
+// order, as when GOPASS_LIST_USERNAME is set to "recent".
+func WithRecentUsername() Option {
+	return func(c *config) {
+		c.recentUsername = true
+	}
+}
+
+// WithPreferredUsernames sets the usernames List reports in preference to
+// others, in order of preference, such as to avoid reporting a bot account,
+// instead of the comma or whitespace separated GOPASS_PREFERRED_USERNAMES.
+func WithPreferredUsernames(usernames ...string) Option {
+	return func(c *config) {
+		c.preferredUsernames = append([]string{}, usernames...)
+	}
+}
+
+// WithPerUser stores credentials in a subfolder of the credentials folder
+// named after the current OS user, as
+// "$GOPASS_FOLDER/<user>/base64-url(serverURL)/username", so that users
+// sharing a store do not read or overwrite each other's credentials, as when
+// GOPASS_PER_USER is set to "1". Credentials stored outside of the subfolder
+// are not listed.
+func WithPerUser() Option {
+	return func(c *config) {
+		c.perUser = true
+	}
+}
+
+// WithPruneParents removes the folders left empty between the credentials
+// folder and the configured folder once credentials are deleted, such as the
+// subfolder of WithPerUser, as when GOPASS_PRUNE_PARENTS is set to "1". They
+// are left in place by default.
+func WithPruneParents() Option {
+	return func(c *config) {
+		c.pruneParents = true
+	}
+}
+
+// WithCreatedAt makes Add record the time at which credentials are added in
+// their created_at field, as RFC 3339, as when GOPASS_CREATED_AT is set to
+// "1". ListWithMetadata reports it, or the modification time of the secret
+// for credentials lacking it.
+func WithCreatedAt() Option {
+	return func(c *config) {
+		c.createdAt = true
+	}
+}
+
+// WithEnvAllowList restricts the environment gopass is run with to the given
+// variables, in addition to HOME, GNUPGHOME, GOPASS_HOMEDIR and PATH, which
+// are always passed, instead of the comma or whitespace separated
+// GOPASS_ENV_ALLOWLIST. gopass is run with the whole environment of the
+// helper by default.
+func WithEnvAllowList(names ...string) Option {
+	return func(c *config) {
+		c.envAllowList = append([]string{}, names...)
+	}
+}
+
+// WithCat stores and reads secrets byte for byte through `gopass cat`, so that
+// binary secrets round-trip unchanged, as when GOPASS_USE_CAT is set to "1".
+// No metadata is stored then: neither metadata nor empty secrets can be added,
+// and server URLs stored under a hash cannot be listed.
+func WithCat() Option {
+	return func(c *config) {
+		c.useCat = true
+	}
+}
+
+// WithMultilineInsert inserts the secret and its metadata lines through
+// `gopass insert --multiline`, for gopass setups that store the first line
+// only otherwise, as when GOPASS_MULTILINE_INSERT is set to "1". They are read
+// back the same way.
+func WithMultilineInsert() Option {
+	return func(c *config) {
+		c.multilineInsert = true
+	}
+}
+
+// WithHideExpired makes Get treat expired credentials as not found, as when
+// GOPASS_HIDE_EXPIRED is set to "1".
+func WithHideExpired() Option {
+	return func(c *config) {
+		c.hideExpired = true
+	}
+}
+
+// WithPinentry unlocks the gpg key through pinentry when gopass fails to
+// decrypt a secret because it is locked, as when GOPASS_USE_PINENTRY is set to
+// "1": the passphrase is prompted for and the key unlocked in gpg-agent before
+// gopass is run again.
+func WithPinentry() Option {
+	return func(c *config) {
+		c.usePinentry = true
+	}
+}
+
+// WithNonInteractive makes gpg fail with ErrPassphraseRequired rather than
+// prompt for a passphrase, by adding "--batch --pinentry-mode=error" to
+// GOPASS_GPG_OPTS, as when GOPASS_NONINTERACTIVE is set to "1". This suits
+// systemd units and CI agents, where nobody answers the prompt. Setting the
+// variable to "auto" does so only when the helper has neither a controlling
+// terminal nor a graphical display, except on Windows and macOS.
+func WithNonInteractive() Option {
+	return func(c *config) {
+		c.nonInteractive = true
+	}
+}
@@ -0,0 +1,50 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// gopassPerUserEnv is the environment variable used to store credentials in a
+// subfolder of the credentials folder named after the current OS user.
+const gopassPerUserEnv = "GOPASS_PER_USER"
+
+// currentUser returns the name of the current OS user, without the domain
+// Windows prefixes it with.
+var currentUser = func() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	name := u.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, nil
+}
+
+// perUser reports whether credentials are stored in a subfolder named after
+// the current OS user.
+func (g Gopass) perUser() bool {
+	return g.config().perUser || os.Getenv(gopassPerUserEnv) == "1"
+}
+
+// userFolder returns folder, followed by the name of the current OS user if
+// credentials are stored per user.
+func (g Gopass) userFolder(folder string) (string, error) {
+	if !g.perUser() {
+		return folder, nil
+	}
+
+	name, err := currentUser()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine the current user for %s: %v", gopassPerUserEnv, err)
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("invalid user name %q for %s: must not contain path separators or start with \".\"", name, gopassPerUserEnv)
+	}
+	return path.Join(folder, name), nil
+}
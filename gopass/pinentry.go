@@ -0,0 +1,222 @@
+package gopass
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// gopassUsePinentryEnv is the environment variable used to opt into unlocking
+// the gpg key through pinentry when gopass fails to decrypt a secret.
+const gopassUsePinentryEnv = "GOPASS_USE_PINENTRY"
+
+// pinentryProgram and gpgProgram are the programs used to prompt for the
+// passphrase and to unlock the gpg key with it.
+var (
+	pinentryProgram = "pinentry"
+	gpgProgram      = "gpg"
+)
+
+// lockedMessages are the messages gpg reports when gopass fails to decrypt a
+// secret because the key is locked and no passphrase could be obtained. A
+// missing key is only reported as "decryption failed: No secret key", which
+// none of them match, as no passphrase would unlock it.
+var lockedMessages = []string{
+	"public key decryption failed",
+	"bad passphrase",
+	"inappropriate ioctl for device",
+	"no pinentry",
+}
+
+// usePinentry reports whether unlocking through pinentry is enabled.
+func (g Gopass) usePinentry() bool {
+	return g.config().usePinentry || os.Getenv(gopassUsePinentryEnv) == "1"
+}
+
+// isLocked reports whether err is a gopass failure caused by a locked key.
+func isLocked(err error) bool {
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) {
+		return false
+	}
+	stderr := strings.ToLower(gopassErr.Stderr)
+	for _, msg := range lockedMessages {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// errLockProbed stops the walk of IsLocked once a secret was decrypted.
+var errLockProbed = errors.New("lock probed")
+
+// IsLocked reports whether the gpg key the store is encrypted for needs to be
+// unlocked before credentials can be read, such as to prompt for the
+// passphrase ahead of the first Get. It decrypts a stored credential of every
+// folder List lists, until one is locked, with gpg failing rather than
+// prompting for a passphrase, so it never blocks on a prompt. A key that is
+// missing is not locked: the decryption failure is returned instead. Nothing
+// needs unlocking while no credentials are stored.
+func (g Gopass) IsLocked() (locked bool, err error) {
+	defer g.observe("IsLocked", time.Now(), &err)
+
+	listed, err := g.listedFolders()
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range listed {
+		h.batch = true
+		err = h.walkServers(false, func(_ string, loc serverLocation, usernames []string) error {
+			_, _, err := h.showSecretWithMetadata(loc.secretPath(usernames[0]))
+			if errors.Is(err, ErrPassphraseRequired) {
+				locked = true
+				return errLockProbed
+			}
+			if err != nil {
+				return err
+			}
+			return errLockProbed
+		})
+		if err != nil && !errors.Is(err, errLockProbed) {
+			return false, err
+		}
+		if locked {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ensureUnlocked prompts for the passphrase of the key the credentials folder
+// is encrypted for, and unlocks it in gpg-agent so that subsequent
+// decryptions succeed.
+func (g Gopass) ensureUnlocked() error {
+	keyID, err := g.storeKeyID()
+	if err != nil {
+		return err
+	}
+
+	desc := "Please enter the passphrase to unlock the gopass store used by docker-credential-gopass."
+	if keyID != "" {
+		desc += "\nKey: " + keyID
+	}
+	passphrase, err := readPassphrase(pinentryProgram, desc)
+	if err != nil {
+		return fmt.Errorf("unable to read passphrase: %v", err)
+	}
+
+	// Signing with the loopback pinentry makes gpg-agent cache the
+	// passphrase, which gopass then benefits from.
+	args := []string{"--batch", "--yes", "--pinentry-mode", "loopback", "--passphrase-fd", "0"}
+	if keyID != "" {
+		args = append(args, "--local-user", keyID)
+	}
+	args = append(args, "--output", os.DevNull, "--sign", os.DevNull)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(gpgProgram, args...)
+	cmd.Stdin = strings.NewReader(passphrase + "\n")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to unlock gpg key: %v: %s", err, redact(strings.TrimSpace(stderr.String()), passphrase))
+	}
+	return nil
+}
+
+// readPassphrase prompts for a passphrase by speaking the Assuan protocol to
+// the given pinentry program.
+func readPassphrase(program, desc string) (string, error) {
+	cmd := exec.Command(program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	p := &pinentry{w: stdin, r: bufio.NewReader(stdout)}
+	if _, err := p.response(); err != nil {
+		return "", err
+	}
+	for _, command := range []string{
+		"SETTITLE docker-credential-gopass",
+		"SETDESC " + assuanEscape(desc),
+		"SETPROMPT Passphrase:",
+	} {
+		if _, err := p.command(command); err != nil {
+			return "", err
+		}
+	}
+
+	passphrase, err := p.command("GETPIN")
+	if err != nil {
+		return "", err
+	}
+	_, _ = p.command("BYE")
+	return passphrase, nil
+}
+
+// pinentry is a client for the Assuan protocol spoken by pinentry programs.
+type pinentry struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// command sends a command and returns the data sent in response.
+func (p *pinentry) command(command string) (string, error) {
+	if _, err := io.WriteString(p.w, command+"\n"); err != nil {
+		return "", err
+	}
+	return p.response()
+}
+
+// response reads lines up to the final OK or ERR line of a response, and
+// returns the data lines it contained.
+func (p *pinentry) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("unexpected end of pinentry response: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", fmt.Errorf("pinentry: %s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			d, err := url.PathUnescape(strings.TrimPrefix(line, "D "))
+			if err != nil {
+				return "", fmt.Errorf("invalid pinentry data: %v", err)
+			}
+			data.WriteString(d)
+		}
+		// Status ("S") and comment ("#") lines are ignored.
+	}
+}
+
+// assuanEscape percent-escapes the characters that cannot appear verbatim in
+// an Assuan command.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -0,0 +1,142 @@
+package gopass
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// gopassRecipientsEnv is the environment variable holding the gpg recipients
+// added to the store before credentials are first written to it.
+const gopassRecipientsEnv = "GOPASS_RECIPIENTS"
+
+// recipients returns the configured gpg recipients, or the comma or
+// whitespace separated recipients in gopassRecipientsEnv.
+func (g Gopass) recipients() []string {
+	if recipients := g.config().recipients; recipients != nil {
+		return recipients
+	}
+	return strings.FieldsFunc(os.Getenv(gopassRecipientsEnv), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// gpgIDFile is the name of the file gopass reads the recipients of a folder
+// and its subfolders from.
+const gpgIDFile = ".gpg-id"
+
+// ensureRecipients writes the configured recipients to the .gpg-id file of
+// the credentials folder, if it has none yet, so that gopass encrypts the
+// credentials for them without changing the recipients of the rest of the
+// store, which `gopass recipients add` would. Credentials already stored are
+// then re-encrypted for them through `gopass fsck --decrypt`, scoped to the
+// credentials folder; if that fails, the .gpg-id file is removed again so
+// that the next write retries. Every recipient is checked to be a known gpg
+// key before the store is modified.
+func (g Gopass) ensureRecipients() error {
+	recipients := g.recipients()
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return err
+	}
+
+	gopassDir, err := g.getGopassDir()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(gopassDir, filepath.FromSlash(folder))
+	if _, err := os.Stat(filepath.Join(dir, gpgIDFile)); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		if err := checkRecipient(recipient); err != nil {
+			return err
+		}
+	}
+
+	_, err = os.Stat(dir)
+	stored := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	p := filepath.Join(dir, gpgIDFile)
+	if err := os.WriteFile(p, []byte(strings.Join(recipients, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	if !stored {
+		return nil
+	}
+
+	secrets, err := g.secretFolder()
+	if err == nil {
+		_, err = g.runGopass("", "fsck", "--decrypt", secrets)
+	}
+	if err != nil {
+		err = fmt.Errorf("unable to re-encrypt the credentials for their recipients: %w", err)
+		if removeErr := os.Remove(p); removeErr != nil {
+			return joinErrors([]error{err, fmt.Errorf("unable to remove the %s file left by the failed re-encryption: %w", gpgIDFile, removeErr)})
+		}
+		return err
+	}
+	return nil
+}
+
+// storeKeyID returns the first recipient of the credentials folder: that of
+// its own .gpg-id file, or of the closest parent folder holding one, up to
+// the root of the store. It is empty if no .gpg-id file is found.
+func (g Gopass) storeKeyID() (string, error) {
+	gopassDir, err := g.getGopassDir()
+	if err != nil {
+		return "", err
+	}
+	folder, err := g.gopassFolder()
+	if err != nil {
+		return "", err
+	}
+
+	for dir := folder; ; dir = path.Dir(dir) {
+		b, err := os.ReadFile(filepath.Join(gopassDir, filepath.FromSlash(dir), gpgIDFile))
+		if err == nil {
+			keyID, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+			return strings.TrimSpace(keyID), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if dir == "." || dir == "/" || dir == "" {
+			return "", nil
+		}
+	}
+}
+
+// checkRecipient returns an error unless recipient names a key known to gpg.
+func checkRecipient(recipient string) error {
+	if strings.HasPrefix(recipient, "-") {
+		return fmt.Errorf("invalid gpg recipient %q", recipient)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(gpgProgram, "--batch", "--list-keys", recipient)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unknown gpg recipient %q: %v: %s", recipient, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errSampleDecrypted stops the walk of Rekey once a credential was decrypted.
+var errSampleDecrypted = errors.New("sample decrypted")
+
+// Rekey re-encrypts every credential for the current recipients of the store,
+// such as after rotating the gpg key, through `gopass fsck --decrypt` scoped
+// to the credentials folder and the folder of every route. Fallback folders
+// are left untouched. A credential of every folder is then read back to check
+// that it still decrypts. Re-encryption decrypts every secret, so the old key
+// must still be available. The store of every mount rewritten is locked.
+func (g Gopass) Rekey() (err error) {
+	defer g.observe("Rekey", time.Now(), &err)
+
+	if err := g.checkWritable("rekey"); err != nil {
+		return err
+	}
+
+	written, err := g.writtenFolders()
+	if err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	defer g.config().cache.clear()
+
+	unlock, err := lockStores(written)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, h := range written {
+		secrets, err := h.secretFolder()
+		if err != nil {
+			return err
+		}
+		if _, err := h.runGopass("", "fsck", "--decrypt", secrets); err != nil {
+			return fmt.Errorf("unable to re-encrypt the credentials in %s: %w", secrets, err)
+		}
+
+		err = h.walkServers(false, func(_ string, loc serverLocation, usernames []string) error {
+			p := loc.secretPath(usernames[0])
+			if _, _, err := h.showSecretWithMetadata(p); err != nil {
+				return fmt.Errorf("unable to decrypt %s once re-encrypted: %w", p, err)
+			}
+			return errSampleDecrypted
+		})
+		if err != nil && !errors.Is(err, errSampleDecrypted) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gopassRetriesEnv is the environment variable setting how many times a write
+// operation failing transiently is retried.
+const gopassRetriesEnv = "GOPASS_RETRIES"
+
+// gopassRetryDelayEnv is the environment variable setting the delay before
+// the first retry, parsed as a time.Duration. It doubles with every retry.
+const gopassRetryDelayEnv = "GOPASS_RETRY_DELAY"
+
+// defaultGopassRetryDelay is the delay used when gopassRetryDelayEnv is unset.
+const defaultGopassRetryDelay = 500 * time.Millisecond
+
+// transientMessages are the messages gopass and git report on failures that
+// may succeed when retried, such as a lock held by a concurrent process or an
+// unreachable remote.
+var transientMessages = []string{
+	"resource temporarily unavailable",
+	"index.lock",
+	"unable to lock",
+	"cannot lock ref",
+	"could not lock",
+	"connection reset",
+	"connection refused",
+	"could not resolve host",
+	"temporary failure",
+}
+
+// isTransient reports whether err is a gopass failure that may succeed when
+// retried. Failures caused by a locked key are never transient.
+func isTransient(err error) bool {
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) || isLocked(err) {
+		return false
+	}
+	stderr := strings.ToLower(gopassErr.Stderr)
+	for _, msg := range transientMessages {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// retries returns how many times a transiently failing write operation is
+// retried, and the delay before the first retry. Write operations are not
+// retried by default.
+func (g Gopass) retries() (int, time.Duration, error) {
+	if cfg := g.config(); cfg.hasRetries {
+		return cfg.retries, cfg.retryDelay, nil
+	}
+
+	retries := 0
+	if v := os.Getenv(gopassRetriesEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", gopassRetriesEnv, v)
+		}
+		retries = n
+	}
+
+	delay := defaultGopassRetryDelay
+	if v := os.Getenv(gopassRetryDelayEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be a non-negative duration", gopassRetryDelayEnv, v)
+		}
+		delay = d
+	}
+	return retries, delay, nil
+}
+
+// runGopassRetry runs gopass, retrying write operations that fail
+// transiently with an exponential backoff.
+func (g Gopass) runGopassRetry(stdinContent string, args ...string) (string, error) {
+	if !writeOperations[operation(args)] {
+		return g.runGopassTimeout(stdinContent, args...)
+	}
+
+	retries, delay, err := g.retries()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := g.runGopassTimeout(stdinContent, args...)
+	for i := 0; i < retries && isTransient(err); i++ {
+		time.Sleep(delay)
+		delay *= 2
+		out, err = g.runGopassTimeout(stdinContent, args...)
+	}
+	return out, err
+}
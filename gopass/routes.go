@@ -0,0 +1,154 @@
+package gopass
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// gopassRoutesEnv is the environment variable holding comma or whitespace
+// separated routes, each of the form "pattern=mount:folder", storing the
+// credentials of the server URLs matching pattern in the given mount and
+// folder.
+const gopassRoutesEnv = "GOPASS_ROUTES"
+
+// route stores the credentials of the server URLs matching pattern in mount
+// and folder. An empty mount or folder is the configured one.
+type route struct {
+	pattern string
+	mount   string
+	folder  string
+}
+
+// routes returns the configured routes, or those of gopassRoutesEnv, in the
+// order they are consulted, with their mount and folder cleaned.
+func (g Gopass) routes() ([]route, error) {
+	name, routes := "route", g.config().routes
+	if routes == nil {
+		name = gopassRoutesEnv
+		for _, entry := range strings.FieldsFunc(os.Getenv(gopassRoutesEnv), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		}) {
+			i := strings.LastIndex(entry, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid %s entry %q: must be pattern=mount:folder", gopassRoutesEnv, entry)
+			}
+			mount, folder, _ := strings.Cut(entry[i+1:], ":")
+			routes = append(routes, route{pattern: entry[:i], mount: mount, folder: folder})
+		}
+	}
+
+	cleaned := make([]route, 0, len(routes))
+	for _, r := range routes {
+		if _, err := path.Match(r.pattern, ""); err != nil || r.pattern == "" {
+			return nil, fmt.Errorf("invalid %s pattern %q: must be a non-empty glob", name, r.pattern)
+		}
+		if r.mount == "" && r.folder == "" {
+			return nil, fmt.Errorf("invalid %s %q: must set a mount or a folder", name, r.pattern)
+		}
+
+		var err error
+		if r.mount != "" {
+			if r.mount, err = cleanStorePath(name+" mount", r.mount); err != nil {
+				return nil, err
+			}
+		}
+		if r.folder != "" {
+			if r.folder, err = cleanStorePath(name+" folder", r.folder); err != nil {
+				return nil, err
+			}
+		}
+		cleaned = append(cleaned, r)
+	}
+	return cleaned, nil
+}
+
+// matches reports whether serverURL, or its host, matches the pattern of r.
+func (r route) matches(serverURL string) bool {
+	if ok, _ := path.Match(r.pattern, serverURL); ok {
+		return true
+	}
+
+	host := serverURL
+	if u, err := url.Parse(serverURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if u, err := url.Parse("//" + serverURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	ok, _ := path.Match(r.pattern, host)
+	return ok
+}
+
+// target returns a copy of g storing credentials in the mount and folder of
+// r.
+func (g Gopass) target(r route) Gopass {
+	if r.mount != "" {
+		g.mount = r.mount
+	}
+	if r.folder != "" {
+		g.folder = r.folder
+	}
+	return g
+}
+
+// routed returns a copy of g storing credentials in the mount and folder of
+// the first route serverURL matches, or g itself if it matches none.
+func (g Gopass) routed(serverURL string) (Gopass, error) {
+	routes, err := g.routes()
+	if err != nil {
+		return g, err
+	}
+	for _, r := range routes {
+		if r.matches(serverURL) {
+			return g.target(r), nil
+		}
+	}
+	return g, nil
+}
+
+// listedFolders returns the folders List lists, in priority order: the
+// searched folders of g, followed by the folder of every route. Folders are
+// listed once, even if several routes target them.
+func (g Gopass) listedFolders() ([]Gopass, error) {
+	listed, err := g.searchedFolders()
+	if err != nil {
+		return nil, err
+	}
+	return g.withRouteFolders(listed)
+}
+
+// writtenFolders returns the folders credentials are written to: g, which
+// writes the credentials folder, followed by the folder of every route.
+// Unlike listedFolders, fallback folders are left out, since nothing is
+// written to them.
+func (g Gopass) writtenFolders() ([]Gopass, error) {
+	return g.withRouteFolders([]Gopass{g})
+}
+
+// withRouteFolders returns folders followed by the folder of every route,
+// each folder once.
+func (g Gopass) withRouteFolders(folders []Gopass) ([]Gopass, error) {
+	routes, err := g.routes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		folders = append(folders, g.target(r))
+	}
+
+	unique := folders[:0]
+	seen := map[string]bool{}
+	for _, h := range folders {
+		secrets, err := h.secretFolder()
+		if err != nil {
+			return nil, err
+		}
+		if !seen[secrets] {
+			seen[secrets] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique, nil
+}
@@ -0,0 +1,40 @@
+package gopass
+
+import "context"
+
+// runner runs gopass with the given arguments and the environment env, or the
+// environment of the helper if env is nil, sending stdinContent on its
+// standard input, and returns its output. The default runner executes the
+// gopass binary; tests may substitute a fake one through withRunner.
+type runner interface {
+	run(ctx context.Context, env []string, stdinContent string, args ...string) (string, error)
+}
+
+// execRunner runs the gopass binary at the given path, or the wrapper running
+// gopass, passing it prefix before the gopass arguments.
+type execRunner struct {
+	binary string
+	prefix []string
+}
+
+func (r execRunner) run(ctx context.Context, env []string, stdinContent string, args ...string) (string, error) {
+	return execGopass(ctx, r.binary, r.prefix, env, stdinContent, args...)
+}
+
+// withRunner runs gopass through r rather than by executing the gopass
+// binary, which is then neither looked up nor required to be installed.
+func withRunner(r runner) Option {
+	return func(c *config) {
+		c.runner = r
+	}
+}
+
+// runner returns the runner gopass is run through, once the binary is
+// resolved.
+func (g Gopass) runner() runner {
+	cfg := g.config()
+	if cfg.runner != nil {
+		return cfg.runner
+	}
+	return cfg.resolvedRunner
+}
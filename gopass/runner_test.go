@@ -0,0 +1,723 @@
+package gopass
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// fakeRunner is a runner answering gopass invocations through handle, which
+// is passed the subcommand and its arguments, and recording them.
+type fakeRunner struct {
+	handle func(stdinContent string, args ...string) (string, error)
+
+	mu      sync.Mutex
+	history [][]string
+	envs    [][]string
+}
+
+// newFakeRunner returns a fakeRunner answering the invocations made to check
+// that gopass is initialized, and passing every other one to handle.
+func newFakeRunner(handle func(stdinContent string, args ...string) (string, error)) *fakeRunner {
+	return &fakeRunner{handle: handle}
+}
+
+func (r *fakeRunner) run(_ context.Context, env []string, stdinContent string, args ...string) (string, error) {
+	r.mu.Lock()
+	r.history = append(r.history, args)
+	r.envs = append(r.envs, env)
+	r.mu.Unlock()
+
+	if len(args) == 1 && args[0] == "version" {
+		return "gopass 1.15.11 go1.21.5 linux amd64", nil
+	}
+	if operation(args) == "ls" {
+		return "", nil
+	}
+	return r.handle(stdinContent, args...)
+}
+
+// calls returns the invocations of the given subcommand made so far.
+func (r *fakeRunner) calls(subcommand string) [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var calls [][]string
+	for _, args := range r.history {
+		if operation(args) == subcommand {
+			calls = append(calls, args)
+		}
+	}
+	return calls
+}
+
+func TestGopassRetryPermanent(t *testing.T) {
+	r := newFakeRunner(func(_ string, args ...string) (string, error) {
+		return "", &GopassError{Args: args, ExitCode: 1, Stderr: "gpg: decryption failed: No secret key"}
+	})
+	t.Setenv(gopassBinaryEnv, "missing-gopass-binary")
+	helper := New(withRunner(r), WithRetries(3, time.Millisecond))
+
+	err := helper.Add(&credentials.Credentials{
+		ServerURL: "https://retry.docker.io",
+		Username:  "retry-username",
+		Secret:    "retry-password",
+	})
+	if err == nil || !strings.Contains(err.Error(), "decryption failed") {
+		t.Fatalf("expected the insert to fail, actual: %v", err)
+	}
+	if inserts := r.calls("insert"); len(inserts) != 1 {
+		t.Errorf("expected a single insert, actual: %q", inserts)
+	}
+
+	t.Setenv(gopassRetriesEnv, "-1")
+	if err := New(withRunner(r)).Delete("https://retry.docker.io"); err == nil || !strings.Contains(err.Error(), gopassRetriesEnv) {
+		t.Errorf("expected invalid retries to be rejected, actual: %v", err)
+	}
+	if removals := r.calls("rm"); len(removals) != 0 {
+		t.Errorf("expected nothing to be removed, actual: %q", removals)
+	}
+}
+
+func TestGopassEnvAllowList(t *testing.T) {
+	for _, name := range append([]string{"ALLOWED", "DOCKER_CONFIG"}, requiredEnv...) {
+		t.Setenv(name, strings.ToLower(name))
+	}
+
+	r := newFakeRunner(func(string, ...string) (string, error) { return "", nil })
+	helper := New(withRunner(r), WithEnvAllowList("ALLOWED", "MISSING"))
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://env.docker.io", Username: "foo", Secret: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ALLOWED=allowed", "GNUPGHOME=gnupghome", "GOPASS_HOMEDIR=gopass_homedir", "GOPASS_NO_AUTOSYNC=true", "HOME=home", "PATH=path"}
+	for i, args := range r.history {
+		if operation(args) != "insert" {
+			continue
+		}
+		env := append([]string{}, r.envs[i]...)
+		sort.Strings(env)
+		if strings.Join(env, " ") != strings.Join(expected, " ") {
+			t.Errorf("expected insert to be run with %v, actual %v", expected, env)
+		}
+	}
+	if len(r.calls("insert")) != 1 {
+		t.Fatalf("expected one insert, actual %v", r.history)
+	}
+
+	r = newFakeRunner(func(string, ...string) (string, error) { return "", nil })
+	if _, err := New(withRunner(r), WithCLIListing()).Count(); err != nil {
+		t.Fatal(err)
+	}
+	for i, env := range r.envs {
+		if env != nil {
+			t.Errorf("expected %v to inherit the environment, actual %v", r.history[i], env)
+		}
+	}
+
+	t.Setenv(gopassEnvAllowListEnv, "ALLOWED,BAD=NAME")
+	if _, err := New(withRunner(r), WithCLIListing()).Count(); err == nil || !strings.Contains(err.Error(), gopassEnvAllowListEnv) {
+		t.Errorf("expected an invalid allow-list to be rejected, actual: %v", err)
+	}
+}
+
+func TestGopassSync(t *testing.T) {
+	var fail bool
+	r := newFakeRunner(func(_ string, args ...string) (string, error) {
+		if fail {
+			return "", &GopassError{Args: args, ExitCode: 1, Stderr: "git push failed: remote rejected"}
+		}
+		return "", nil
+	})
+	helper := New(withRunner(r))
+
+	if err := helper.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if syncs := r.calls("sync"); len(syncs) != 1 || len(syncs[0]) != 1 {
+		t.Fatalf("expected a single `gopass sync`, actual: %q", syncs)
+	}
+
+	fail = true
+	err := helper.Sync()
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) || gopassErr.Stderr != "git push failed: remote rejected" {
+		t.Fatalf("expected the gopass error to be returned, actual: %v", err)
+	}
+
+	if err := New(withRunner(r), WithReadOnly()).Sync(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected read-only helpers not to sync, actual: %v", err)
+	}
+}
+
+// memoryRunner is a runner standing in for gopass with an in-memory store, to
+// be used along with WithCLIListing. Every subcommand but version, ls and
+// config is first passed to intercept, if set, which may fail it.
+type memoryRunner struct {
+	intercept func(args ...string) error
+
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func newMemoryRunner() *memoryRunner {
+	return &memoryRunner{secrets: map[string]string{}}
+}
+
+func (r *memoryRunner) run(_ context.Context, _ []string, stdinContent string, args ...string) (string, error) {
+	if len(args) == 1 && args[0] == "version" {
+		return "gopass 1.15.11 go1.21.5 linux amd64", nil
+	}
+
+	var positional []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+		}
+	}
+	cmd, target := positional[0], ""
+	if len(positional) > 1 {
+		target = positional[1]
+	}
+
+	if r.intercept != nil && cmd != "ls" {
+		if err := r.intercept(args...); err != nil {
+			return "", err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch cmd {
+	case "ls":
+		paths := make([]string, 0, len(r.secrets))
+		for p := range r.secrets {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		return strings.Join(paths, "\n"), nil
+	case "insert":
+		r.secrets[target] = stdinContent
+		return "", nil
+	case "show":
+		content, ok := r.secrets[target]
+		if !ok {
+			return "", &GopassError{Args: args, ExitCode: 1, Stderr: "entry is not in the password store"}
+		}
+		return strings.TrimSuffix(content, "\n"), nil
+	case "rm":
+		for p := range r.secrets {
+			if p == target || strings.HasPrefix(p, target+"/") {
+				delete(r.secrets, p)
+			}
+		}
+		return "", nil
+	}
+	return "", &GopassError{Args: args, ExitCode: 1, Stderr: "unknown command: " + cmd}
+}
+
+func TestGopassSelfTest(t *testing.T) {
+	r := newMemoryRunner()
+	stored := "docker-credential-helpers/cmVhbA==/stored-username"
+	r.secrets[stored] = "stored-password\n"
+	helper := New(withRunner(r), WithCLIListing())
+
+	if err := helper.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.secrets) != 1 || r.secrets[stored] != "stored-password\n" {
+		t.Fatalf("expected only the stored credentials to be left, actual: %q", r.secrets)
+	}
+
+	for _, tc := range []struct {
+		fail    string
+		message string
+	}{
+		{fail: "insert", message: "failed to add"},
+		{fail: "show", message: "failed to get"},
+		{fail: "rm", message: "failed to delete"},
+	} {
+		t.Run(tc.fail, func(t *testing.T) {
+			r.intercept = func(args ...string) error {
+				if operation(args) == tc.fail {
+					return &GopassError{Args: args, ExitCode: 1, Stderr: tc.fail + " failed"}
+				}
+				return nil
+			}
+			defer func() { r.intercept = nil }()
+
+			err := helper.SelfTest()
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("expected the error to name the failing step, actual: %v", err)
+			}
+			if tc.fail != "rm" {
+				if len(r.secrets) != 1 {
+					t.Errorf("expected the throwaway credentials to be cleaned up, actual: %q", r.secrets)
+				}
+			}
+		})
+	}
+
+	if r.secrets[stored] != "stored-password\n" {
+		t.Errorf("expected the stored credentials to be left untouched, actual: %q", r.secrets)
+	}
+	if err := helper.SelfTest(); err != nil {
+		t.Errorf("expected leftover credentials to be cleaned up, actual: %v", err)
+	}
+	if len(r.secrets) != 1 {
+		t.Errorf("expected only the stored credentials to be left, actual: %q", r.secrets)
+	}
+}
+
+func TestGopassMetrics(t *testing.T) {
+	r := newMemoryRunner()
+	metrics := &MemoryMetrics{}
+	helper := New(withRunner(r), WithCLIListing(), WithMetrics(metrics))
+
+	creds := &credentials.Credentials{ServerURL: "https://metrics.docker.io", Username: "foo", Secret: "metrics-secret"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get("https://missing.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+	r.intercept = func(args ...string) error {
+		return &GopassError{Args: args, ExitCode: 2, Stderr: "gpg: decryption failed: No secret key"}
+	}
+	if _, _, err := helper.Get(creds.ServerURL); err == nil {
+		t.Fatal("expected the decryption failure to be returned")
+	}
+
+	observations := metrics.Observations()
+	names := make([]string, len(observations))
+	for i, o := range observations {
+		names[i] = o.Name
+		if o.Duration < 0 {
+			t.Errorf("expected a non-negative duration for %s, actual %s", o.Name, o.Duration)
+		}
+		if o.Err != nil && strings.Contains(o.Err.Error(), creds.Secret) {
+			t.Errorf("expected the secret never to be observed, actual: %v", o.Err)
+		}
+	}
+	if strings.Join(names, " ") != "Add Get Get Get" {
+		t.Fatalf("expected one observation per call, actual %q", names)
+	}
+
+	if observations[0].Err != nil || observations[1].Err != nil {
+		t.Errorf("expected successful calls to be observed without error, actual %v, %v", observations[0].Err, observations[1].Err)
+	}
+	if !credentials.IsErrCredentialsNotFound(observations[2].Err) {
+		t.Errorf("expected credentials not found to be observed, actual: %v", observations[2].Err)
+	}
+	var readErr *ReadError
+	if !errors.As(observations[3].Err, &readErr) {
+		t.Errorf("expected the read error to be observed, actual: %v", observations[3].Err)
+	}
+}
+
+func TestGopassUpdateSecret(t *testing.T) {
+	r := newMemoryRunner()
+	helper := New(withRunner(r), WithCLIListing())
+
+	creds := &credentials.Credentials{ServerURL: "https://update.docker.io", Username: "foo", Secret: "old-token"}
+	if err := helper.AddWithMetadata(creds, map[string]string{"note": "ci token"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Add(&credentials.Credentials{ServerURL: creds.ServerURL, Username: "zed", Secret: "zed-token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"multi\nline\ntoken", "new-token"} {
+		if err := helper.UpdateSecret(creds.ServerURL, "foo", secret); err != nil {
+			t.Fatal(err)
+		}
+		if username, actual, err := helper.Get(creds.ServerURL + "#foo"); err != nil || username != "foo" || actual != secret {
+			t.Errorf("expected the secret to be updated to %q, actual %s/%q, %v", secret, username, actual, err)
+		}
+	}
+
+	_, metadata, err := helper.GetWithMetadata(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["note"] != "ci token" || metadata[metadataServerURL] != creds.ServerURL {
+		t.Errorf("expected the metadata to be preserved, actual: %v", metadata)
+	}
+	if _, ok := metadata[metadataSecretEncoding]; ok {
+		t.Errorf("expected the single line secret not to be encoded, actual: %v", metadata)
+	}
+	if _, secret, err := helper.Get(creds.ServerURL + "#zed"); err != nil || secret != "zed-token" {
+		t.Errorf("expected the other usernames to be left untouched, actual %q, %v", secret, err)
+	}
+
+	for _, missing := range [][2]string{
+		{creds.ServerURL, "baz"},
+		{"https://missing.docker.io", "foo"},
+	} {
+		if err := helper.UpdateSecret(missing[0], missing[1], "token"); !credentials.IsErrCredentialsNotFound(err) {
+			t.Errorf("expected credentials not found for %s#%s, actual: %v", missing[0], missing[1], err)
+		}
+	}
+	if _, _, err := helper.Get(creds.ServerURL + "#baz"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected nothing to be added for a missing username, actual: %v", err)
+	}
+}
+
+func TestGopassGetMany(t *testing.T) {
+	r := newMemoryRunner()
+	helper := New(withRunner(r), WithCLIListing())
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://one.docker.io", Username: "alice", Secret: "one-secret"},
+		{ServerURL: "https://two.docker.io", Username: "alice", Secret: "two-alice"},
+		{ServerURL: "https://two.docker.io", Username: "bob", Secret: "two-bob"},
+		{ServerURL: "https://locked.docker.io", Username: "alice", Secret: "locked-secret"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shows := 0
+	r.intercept = func(args ...string) error {
+		if args[0] != "show" {
+			return nil
+		}
+		shows++
+		if strings.Contains(args[len(args)-1], EncodeServerURL("https://locked.docker.io")) {
+			return &GopassError{Args: args, ExitCode: 1, Stderr: "gpg: decryption failed: No secret key"}
+		}
+		return nil
+	}
+
+	creds, err := helper.GetMany([]string{
+		"https://one.docker.io",
+		"https://missing.docker.io",
+		"https://two.docker.io#bob",
+		"https://locked.docker.io",
+		"https://one.docker.io",
+	})
+	if err == nil || !strings.Contains(err.Error(), "https://locked.docker.io") {
+		t.Errorf("expected the failure to be reported for its server URL, actual: %v", err)
+	}
+	if strings.Contains(err.Error(), "missing.docker.io") {
+		t.Errorf("expected missing credentials not to be an error, actual: %v", err)
+	}
+
+	if len(creds) != 2 {
+		t.Fatalf("expected the credentials of two server URLs, actual %v", creds)
+	}
+	if c := creds["https://one.docker.io"]; c == nil || c.Username != "alice" || c.Secret != "one-secret" {
+		t.Errorf("expected alice/one-secret, actual %+v", c)
+	}
+	if c := creds["https://two.docker.io#bob"]; c == nil || c.ServerURL != "https://two.docker.io" || c.Username != "bob" || c.Secret != "two-bob" {
+		t.Errorf("expected bob/two-bob, actual %+v", c)
+	}
+
+	if shows != 3 {
+		t.Errorf("expected repeated server URLs to be read once, actual %d reads", shows)
+	}
+}
+
+func TestGopassShowTemplate(t *testing.T) {
+	r := newMemoryRunner()
+	var shows [][]string
+	r.intercept = func(args ...string) error {
+		if operation(args) == "show" {
+			shows = append(shows, args)
+		}
+		return nil
+	}
+	creds := &credentials.Credentials{ServerURL: "https://show.docker.io", Username: "show-username", Secret: "show-password"}
+	if err := New(withRunner(r), WithCLIListing()).Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	p := "docker-credential-helpers/" + EncodeServerURL(creds.ServerURL) + "/" + creds.Username
+
+	for _, tc := range []struct {
+		name     string
+		template []string
+		expected []string
+	}{
+		{name: "default", expected: []string{"show", "-n", p}},
+		{name: "custom", template: []string{"show", "-o", "{path}"}, expected: []string{"show", "-o", p}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shows = nil
+			opts := []Option{withRunner(r), WithCLIListing()}
+			if tc.template != nil {
+				opts = append(opts, WithShowTemplate(tc.template...))
+			}
+
+			username, secret, err := New(opts...).Get(creds.ServerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != creds.Username || secret != creds.Secret {
+				t.Errorf("expected %s/%s, actual %s/%s", creds.Username, creds.Secret, username, secret)
+			}
+			if len(shows) != 1 || strings.Join(shows[0], " ") != strings.Join(tc.expected, " ") {
+				t.Errorf("expected the secret to be read with %q, actual: %q", tc.expected, shows)
+			}
+		})
+	}
+
+	for _, template := range []string{"show -o", "show {path} {path}", "{path}", "insert {path}"} {
+		t.Setenv(gopassShowTemplateEnv, template)
+		_, _, err := New(withRunner(r), WithCLIListing()).Get(creds.ServerURL)
+		if err == nil || !strings.Contains(err.Error(), gopassShowTemplateEnv) {
+			t.Errorf("expected template %q to be rejected, actual: %v", template, err)
+		}
+	}
+
+	// Hiding expired credentials reads the whole secret, ignoring the
+	// template, so the two cannot be combined.
+	t.Setenv(gopassShowTemplateEnv, "")
+	shows = nil
+	_, _, err := New(withRunner(r), WithCLIListing(), WithShowTemplate("show", "-o", "{path}"), WithHideExpired()).Get(creds.ServerURL)
+	if err == nil || !strings.Contains(err.Error(), gopassHideExpiredEnv) {
+		t.Errorf("expected the template to be rejected when hiding expired credentials, actual: %v", err)
+	}
+	if len(shows) != 0 {
+		t.Errorf("expected no secret to be read, actual: %q", shows)
+	}
+}
+
+func TestGopassClose(t *testing.T) {
+	if err := (Gopass{}).Close(); err != nil {
+		t.Fatal(err)
+	}
+	unused := New()
+	for i := 0; i < 2; i++ {
+		if err := unused.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newFakeRunner(func(string, ...string) (string, error) { return "", nil })
+	helper := New(withRunner(r), WithCLIListing())
+	if _, err := helper.Count(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := helper.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The helper checks gopass again when used after being closed.
+	if _, err := helper.Count(); err != nil {
+		t.Fatal(err)
+	}
+	versions := 0
+	for _, args := range r.history {
+		if len(args) == 1 && args[0] == "version" {
+			versions++
+		}
+	}
+	if versions != 2 {
+		t.Errorf("expected gopass to be checked again after Close, actual: %q", r.history)
+	}
+}
+
+func TestGopassInitCheckConfig(t *testing.T) {
+	var failConfig bool
+	r := newFakeRunner(func(_ string, args ...string) (string, error) {
+		if failConfig && operation(args) == "config" {
+			return "", &GopassError{Args: args, ExitCode: 1, Stderr: "no store"}
+		}
+		return "", nil
+	})
+
+	if _, err := New(withRunner(r), WithCLIListing(), WithSkipInitCheck()).Count(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.history) != 1 || operation(r.history[0]) != "ls" {
+		t.Errorf("expected gopass to be used without being checked, actual: %q", r.history)
+	}
+
+	r.history = nil
+	t.Setenv(gopassInitCheckArgsEnv, "config mounts.path")
+	if _, err := New(withRunner(r), WithCLIListing()).Count(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.history) != 3 || strings.Join(r.history[0], " ") != "config mounts.path" || r.history[1][0] != "version" {
+		t.Errorf("expected gopass to be checked with the configured arguments, actual: %q", r.history)
+	}
+
+	failConfig = true
+	if _, err := New(withRunner(r), WithCLIListing()).Count(); !errors.Is(err, ErrGopassNotInitialized) {
+		t.Errorf("expected the failing check to be reported, actual: %v", err)
+	}
+	if _, err := New(withRunner(r), WithCLIListing(), WithInitCheckArgs("--version")).Count(); err != nil {
+		t.Errorf("expected the option to take precedence, actual: %v", err)
+	}
+
+	t.Setenv(gopassSkipInitCheckEnv, "1")
+	if _, err := New(withRunner(r), WithCLIListing()).Count(); err != nil {
+		t.Errorf("expected the check to be skipped, actual: %v", err)
+	}
+}
+
+func TestGopassCache(t *testing.T) {
+	r := newMemoryRunner()
+	shows := 0
+	r.intercept = func(args ...string) error {
+		if operation(args) == "show" {
+			shows++
+		}
+		return nil
+	}
+	helper := New(withRunner(r), WithCLIListing(), WithCache(time.Minute, 2))
+
+	one := &credentials.Credentials{ServerURL: "https://one.docker.io", Username: "foo", Secret: "one-secret"}
+	two := &credentials.Credentials{ServerURL: "https://two.docker.io", Username: "foo", Secret: "two-secret"}
+	for _, creds := range []*credentials.Credentials{one, two} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if username, secret, err := helper.Get(one.ServerURL); err != nil || username != "foo" || secret != "one-secret" {
+			t.Fatalf("expected the credentials of %s, actual %s/%s, %v", one.ServerURL, username, secret, err)
+		}
+	}
+	if shows != 1 {
+		t.Errorf("expected gopass to be invoked once within the TTL, actual: %d", shows)
+	}
+
+	// Adding credentials evicts those cached for the server URL.
+	if err := helper.Add(&credentials.Credentials{ServerURL: one.ServerURL, Username: "foo", Secret: "rotated"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, err := helper.Get(one.ServerURL); err != nil || secret != "rotated" {
+		t.Errorf("expected the added credentials, actual %s, %v", secret, err)
+	}
+
+	// Deleting credentials evicts them, zeroing their secret.
+	cached := helper.config().cache.entries[one.ServerURL].Value.(*cacheEntry).secret
+	if err := helper.Delete(one.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != strings.Repeat("\x00", len("rotated")) {
+		t.Errorf("expected the evicted secret to be zeroed, actual: %q", cached)
+	}
+	if _, _, err := helper.Get(one.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found once deleted, actual: %v", err)
+	}
+
+	// The least recently used credentials are evicted beyond the size.
+	shows = 0
+	for _, serverURL := range []string{two.ServerURL, two.ServerURL + "#foo", two.ServerURL, two.ServerURL + "#foo"} {
+		if _, _, err := helper.Get(serverURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if shows != 2 {
+		t.Errorf("expected the credentials to be cached by requested username, actual %d invocations", shows)
+	}
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://three.docker.io", Username: "foo", Secret: "three-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get("https://three.docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := helper.config().cache.entries[two.ServerURL]; ok {
+		t.Error("expected the least recently used credentials to be evicted")
+	}
+
+	if err := helper.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(helper.config().cache.entries) != 0 {
+		t.Errorf("expected Close to clear the cache, actual: %v", helper.config().cache.entries)
+	}
+
+	shows = 0
+	uncached := New(withRunner(r), WithCLIListing())
+	for i := 0; i < 2; i++ {
+		if _, _, err := uncached.Get(two.ServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if shows != 2 {
+		t.Errorf("expected the cache to be disabled by default, actual %d invocations", shows)
+	}
+
+	// Credentials read before they changed are not cached afterwards.
+	var c credentialCache
+	generation := c.currentGeneration()
+	c.invalidate("stale")
+	c.put(cacheEntry{key: "stale", server: "stale", secret: []byte("old"), expires: time.Now().Add(time.Minute)}, 2, generation)
+	if _, _, ok := c.get("stale"); ok {
+		t.Error("expected credentials read before an invalidation not to be cached")
+	}
+
+	// Credentials hidden once expired are not served from the cache past
+	// their expiry.
+	hiding := New(withRunner(r), WithCLIListing(), WithCache(time.Minute, 2), WithHideExpired())
+	expiring := &credentials.Credentials{ServerURL: "https://expiring.docker.io", Username: "foo", Secret: "expiring-secret"}
+	expiresAt := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	if err := hiding.AddWithExpiry(expiring, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, err := hiding.Get(expiring.ServerURL); err != nil || secret != "expiring-secret" {
+		t.Fatalf("expected the unexpired credentials, actual %s, %v", secret, err)
+	}
+	time.Sleep(time.Until(expiresAt))
+	if _, _, err := hiding.Get(expiring.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected the cached credentials to expire along with the credentials, actual: %v", err)
+	}
+}
+
+func TestGopassVerify(t *testing.T) {
+	r := newMemoryRunner()
+	helper := New(withRunner(r), WithCLIListing(), WithRoute("https://routed.docker.io", "", "ci/docker"))
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://one.docker.io", Username: "alice", Secret: "one-secret"},
+		{ServerURL: "https://routed.docker.io", Username: "alice", Secret: "routed-secret"},
+		{ServerURL: "https://two.docker.io", Username: "alice", Secret: "two-alice"},
+		{ServerURL: "https://two.docker.io", Username: "bob", Secret: "two-bob"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures, err := helper.Verify()
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("expected every credential to be readable, actual %v, %v", failures, err)
+	}
+
+	rotated := "docker-credential-helpers/" + EncodeServerURL("https://two.docker.io") + "/bob"
+	routed := "ci/docker/" + EncodeServerURL("https://routed.docker.io") + "/alice"
+	r.intercept = func(args ...string) error {
+		if operation(args) == "show" && (args[len(args)-1] == rotated || args[len(args)-1] == routed) {
+			return &GopassError{Args: args, ExitCode: 1, Stderr: "gpg: decryption failed: No secret key"}
+		}
+		return nil
+	}
+	failures, err = helper.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 || failures[rotated] == nil || !strings.Contains(failures[rotated].Error(), "decryption failed") {
+		t.Errorf("expected only %s and %s to fail, actual: %v", rotated, routed, failures)
+	}
+	if failures[routed] == nil {
+		t.Errorf("expected the routed credentials to be verified, actual: %v", failures)
+	}
+	for _, failure := range failures {
+		if strings.Contains(failure.Error(), "two-bob") {
+			t.Errorf("expected the secret not to be reported, actual: %v", failure)
+		}
+	}
+}
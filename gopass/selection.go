@@ -0,0 +1,129 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// gopassListUsernameEnv is the environment variable used to select how List
+// picks the username it reports for server URLs storing several.
+const gopassListUsernameEnv = "GOPASS_LIST_USERNAME"
+
+// gopassPreferredUsernamesEnv is the environment variable holding comma or
+// whitespace separated usernames List reports in preference to others.
+const gopassPreferredUsernamesEnv = "GOPASS_PREFERRED_USERNAMES"
+
+// recentUsername reports whether List picks the most recently modified
+// username rather than the first one in alphabetical order.
+func (g Gopass) recentUsername() (bool, error) {
+	if g.config().recentUsername {
+		return true, nil
+	}
+
+	switch v := os.Getenv(gopassListUsernameEnv); v {
+	case "", "first":
+		return false, nil
+	case "recent":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s %q: must be \"first\" or \"recent\"", gopassListUsernameEnv, v)
+	}
+}
+
+// preferredUsernames returns the usernames List reports in preference to
+// others, in order of preference.
+func (g Gopass) preferredUsernames() []string {
+	if preferred := g.config().preferredUsernames; preferred != nil {
+		return preferred
+	}
+	return strings.FieldsFunc(os.Getenv(gopassPreferredUsernamesEnv), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// listUsername returns the secret name of the username List reports among
+// the sorted secret names stored in the server folder: the first preferred
+// username stored, if any, otherwise the most recently modified or first one,
+// as configured.
+func (g Gopass) listUsername(loc serverLocation, usernames []string) (string, error) {
+	stored := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		stored[username] = true
+	}
+	for _, username := range g.preferredUsernames() {
+		if name := usernameName(username); stored[name] {
+			return name, nil
+		}
+	}
+
+	recent, err := g.recentUsername()
+	if err != nil || !recent {
+		return usernames[0], err
+	}
+
+	modTimes, err := g.usernameModTimes(loc)
+	if err != nil {
+		return "", err
+	}
+
+	// Ties, such as when gopass does not report modification times, are
+	// broken alphabetically.
+	selected, latest := usernames[0], modTimes[usernames[0]]
+	for _, username := range usernames[1:] {
+		if t := modTimes[username]; t.After(latest) {
+			selected, latest = username, t
+		}
+	}
+	return selected, nil
+}
+
+// usernameModTimes returns the modification times of the secrets of the
+// usernames stored in the server folder, by username. Usernames listed
+// through gopass have no modification time.
+func (g Gopass) usernameModTimes(l serverLocation) (map[string]time.Time, error) {
+	if l.scheme.leaf != "" {
+		leaves, err := g.listLeaves(l)
+		if err != nil {
+			return nil, err
+		}
+		modTimes := make(map[string]time.Time, len(leaves))
+		for username, info := range leaves {
+			modTimes[username] = info.ModTime()
+		}
+		return modTimes, nil
+	}
+
+	var args []string
+	if l.scheme.nested() {
+		args = []string{l.dir}
+	}
+
+	infos, err := g.listGopassDir(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	modTimes := make(map[string]time.Time, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		username := secretName(info)
+		if !l.scheme.nested() {
+			dir, u, ok := l.scheme.splitName(username)
+			if !ok || dir != l.dir {
+				continue
+			}
+			username = u
+		}
+		// A username stored by several crypto backends was last modified
+		// when its latest secret was.
+		if t := info.ModTime(); t.After(modTimes[username]) {
+			modTimes[username] = t
+		}
+	}
+	return modTimes, nil
+}
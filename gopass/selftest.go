@@ -0,0 +1,114 @@
+package gopass
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// selfTestServerURL is the server URL SelfTest stores its throwaway
+// credentials under, which no registry uses.
+const selfTestServerURL = "__selftest__"
+
+// selfTestUsername is the username of the throwaway credentials of SelfTest.
+const selfTestUsername = "selftest"
+
+// SelfTest checks that credentials can be stored, read back and deleted, by
+// adding throwaway credentials under a dedicated server URL, reading them
+// back and deleting them. Credentials stored for other server URLs are never
+// touched. The returned error names the step that failed, and the throwaway
+// credentials are deleted even if a later step fails.
+func (g Gopass) SelfTest() (err error) {
+	defer g.observe("SelfTest", time.Now(), &err)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("self-test failed to generate a secret: %w", err)
+	}
+	creds := &credentials.Credentials{
+		ServerURL: selfTestServerURL,
+		Username:  selfTestUsername,
+		Secret:    hex.EncodeToString(b),
+	}
+
+	// Credentials left behind by an interrupted self-test would otherwise be
+	// read back instead.
+	if exists, err := g.Has(selfTestServerURL); err != nil {
+		return fmt.Errorf("self-test failed to list credentials: %w", err)
+	} else if exists {
+		if err := g.Delete(selfTestServerURL); err != nil {
+			return fmt.Errorf("self-test failed to delete leftover credentials: %w", err)
+		}
+	}
+
+	if err := g.Add(creds); err != nil {
+		return g.selfTestCleanup(fmt.Errorf("self-test failed to add credentials: %w", err))
+	}
+
+	username, secret, err := g.Get(selfTestServerURL)
+	if err != nil {
+		return g.selfTestCleanup(fmt.Errorf("self-test failed to get credentials: %w", err))
+	}
+	if username != creds.Username || secret != creds.Secret {
+		return g.selfTestCleanup(fmt.Errorf("self-test read back different credentials than it added, for username %q", username))
+	}
+
+	if err := g.Delete(selfTestServerURL); err != nil {
+		return fmt.Errorf("self-test failed to delete credentials: %w", err)
+	}
+	if exists, err := g.Has(selfTestServerURL); err != nil {
+		return fmt.Errorf("self-test failed to list credentials after deleting them: %w", err)
+	} else if exists {
+		return fmt.Errorf("self-test credentials are still stored after deleting them")
+	}
+	return nil
+}
+
+// selfTestCleanup deletes the throwaway credentials of SelfTest after err,
+// which is returned along with the error deleting them, if any. Nothing may
+// have been stored if adding them failed, in which case failing to delete
+// them is expected.
+func (g Gopass) selfTestCleanup(err error) error {
+	exists, hasErr := g.Has(selfTestServerURL)
+	if hasErr != nil || !exists {
+		return err
+	}
+	if deleteErr := g.Delete(selfTestServerURL); deleteErr != nil {
+		return joinErrors([]error{err, fmt.Errorf("self-test failed to clean up credentials: %w", deleteErr)})
+	}
+	return err
+}
+
+// Verify checks that every stored credential can be decrypted, such as after
+// rotating the gpg keys of the store, by reading each of them back from every
+// folder List lists. The credentials that cannot be read are returned mapped
+// by gopass path to the error reading them, which never holds the secret.
+// The error is reserved for failures to list the store.
+func (g Gopass) Verify() (failures map[string]error, err error) {
+	defer g.observe("Verify", time.Now(), &err)
+
+	listed, err := g.listedFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	failures = map[string]error{}
+	for _, h := range listed {
+		err = h.walkServers(false, func(_ string, loc serverLocation, usernames []string) error {
+			for _, username := range usernames {
+				p := loc.secretPath(username)
+				if _, _, err := h.showSecretWithMetadata(p); err != nil {
+					failures[p] = err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
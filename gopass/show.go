@@ -0,0 +1,57 @@
+package gopass
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// gopassShowTemplateEnv is the environment variable used to set the
+// whitespace separated gopass arguments Get reads secrets with.
+const gopassShowTemplateEnv = "GOPASS_SHOW_TEMPLATE"
+
+// pathPlaceholder is replaced by the gopass path of the secret in the show
+// template.
+const pathPlaceholder = "{path}"
+
+// defaultShowTemplate is the show template used unless one is configured. It
+// prints the whole secret unparsed, as formatted by formatSecret.
+var defaultShowTemplate = []string{"show", "-n", pathPlaceholder}
+
+// showTemplate returns the gopass arguments secrets are read with, and
+// whether they were configured rather than defaulted. The template must hold
+// pathPlaceholder exactly once, and its subcommand must be one whose output
+// is never logged or reported in errors, as it holds the secret.
+func (g Gopass) showTemplate() ([]string, bool, error) {
+	name, template := "show template", g.config().showTemplate
+	if template == nil {
+		name, template = gopassShowTemplateEnv, strings.Fields(os.Getenv(gopassShowTemplateEnv))
+	}
+	if len(template) == 0 {
+		return defaultShowTemplate, false, nil
+	}
+
+	placeholders := 0
+	for _, arg := range template {
+		if strings.ContainsAny(arg, "\x00\r\n") {
+			return nil, false, fmt.Errorf("invalid %s %q: arguments must be single lines", name, template)
+		}
+		placeholders += strings.Count(arg, pathPlaceholder)
+	}
+	if placeholders != 1 {
+		return nil, false, fmt.Errorf("invalid %s %q: must contain %s exactly once", name, template, pathPlaceholder)
+	}
+	if cmd := operation(template); !secretOutputs[cmd] {
+		return nil, false, fmt.Errorf("invalid %s %q: unsupported subcommand %q", name, template, cmd)
+	}
+	return template, true, nil
+}
+
+// showArgs returns the show template with pathPlaceholder replaced by p.
+func showArgs(template []string, p string) []string {
+	args := make([]string, len(template))
+	for i, arg := range template {
+		args[i] = strings.Replace(arg, pathPlaceholder, p, 1)
+	}
+	return args
+}
@@ -0,0 +1,4966 @@
+//go:build !windows
+
+package gopass
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// stubScript is a minimal stand-in for gopass. It keeps secrets as plain
+// files below the store directory and records every invocation in a log.
+const stubScript = `#!/bin/sh
+printf '%s\n' "$*" >> "@LOG@"
+case " $* " in
+*" version "|*" --version "*)
+	echo "gopass 1.15.11 go1.21.5 linux amd64"
+	exit 0
+	;;
+esac
+store="@STORE@"
+cmd=""
+target=""
+field=""
+for arg in "$@"; do
+	case "$arg" in
+	-*) ;;
+	*)
+		if [ -z "$cmd" ]; then
+			cmd="$arg"
+		elif [ -z "$target" ]; then
+			target="$arg"
+		else
+			field="$arg"
+		fi
+		;;
+	esac
+done
+case "$cmd" in
+ls) ;;
+config)
+	case "$target" in
+	mounts.path) echo "$store" ;;
+	mounts.*.path)
+		mount="${target#mounts.}"
+		mkdir -p "$store/${mount%.path}"
+		echo "$store/${mount%.path}"
+		;;
+	esac
+	;;
+insert) mkdir -p "$(dirname "$store/$target")" && cat > "$store/$target.gpg" ;;
+show)
+	file="$store/$target.gpg"
+	for f in "$store/$target.age" "$store/$target"; do
+		if [ ! -f "$file" ]; then file="$f"; fi
+	done
+	if [ ! -f "$file" ]; then
+		echo "entry is not in the password store" >&2
+		exit 1
+	fi
+	if [ -n "$field" ]; then
+		if ! line="$(grep -m 1 "^$field: " "$file")"; then
+			echo "key not found" >&2
+			exit 1
+		fi
+		printf '%s\n' "${line#"$field: "}"
+		exit 0
+	fi
+	case " $* " in
+	*" -o "*) head -n 1 "$file" ;;
+	*) cat "$file" ;;
+	esac
+	;;
+cat)
+	if [ -c /dev/stdin ]; then
+		if [ ! -f "$store/$target.gpg" ]; then
+			echo "entry is not in the password store" >&2
+			exit 1
+		fi
+		cat "$store/$target.gpg"
+	else
+		mkdir -p "$(dirname "$store/$target")" && cat > "$store/$target.gpg"
+	fi
+	;;
+rm) rm -rf "$store/$target" "$store/$target.gpg" ;;
+fsck) ;;
+*)
+	echo "unknown command: $cmd" >&2
+	exit 1
+	;;
+esac
+`
+
+// overrideStub returns stubScript with the handling of the given gopass
+// subcommand replaced by body.
+func overrideStub(cmd, body string) string {
+	return strings.Replace(stubScript, "case \"$cmd\" in\n", "case \"$cmd\" in\n"+cmd+")\n"+body+"\n\t;;\n", 1)
+}
+
+// stubGopass is a stub gopass binary backed by a temporary store.
+type stubGopass struct {
+	binary string
+	store  string
+	log    string
+}
+
+// newStubGopass installs a stub gopass binary using the given script, which
+// may refer to @STORE@ and @LOG@, and points GOPASS_BINARY at it for the
+// duration of the test.
+func newStubGopass(t *testing.T, script string) *stubGopass {
+	t.Helper()
+
+	dir := t.TempDir()
+	s := &stubGopass{
+		binary: filepath.Join(dir, "gopass"),
+		store:  filepath.Join(dir, "store"),
+		log:    filepath.Join(dir, "gopass.log"),
+	}
+	if err := os.MkdirAll(s.store, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	script = strings.ReplaceAll(script, "@STORE@", s.store)
+	script = strings.ReplaceAll(script, "@LOG@", s.log)
+	if err := os.WriteFile(s.binary, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	resetCache()
+	t.Cleanup(resetCache)
+	t.Setenv(gopassBinaryEnv, s.binary)
+	return s
+}
+
+// calls returns the argument lists the stub has been invoked with so far.
+func (s *stubGopass) calls(t *testing.T) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(s.log)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestGopassBinaryFromEnv(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	if !helper.CheckInitialized() {
+		t.Fatal("expected stub gopass to be initialized")
+	}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	u, s, err := helper.Get(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != creds.Username {
+		t.Errorf("invalid username %s", u)
+	}
+	if s != creds.Secret {
+		t.Errorf("invalid secret: %s", s)
+	}
+
+	calls := stub.calls(t)
+	if len(calls) == 0 || calls[0] != "ls --flat "+GOPASS_FOLDER {
+		t.Fatalf("expected stub to be invoked, calls: %q", calls)
+	}
+}
+
+func TestGopassBinaryNotFound(t *testing.T) {
+	resetCache()
+	t.Cleanup(resetCache)
+	t.Setenv(gopassBinaryEnv, filepath.Join(t.TempDir(), "missing-gopass"))
+
+	helper := Gopass{}
+	if helper.CheckInitialized() {
+		t.Fatal("expected missing binary to fail initialization")
+	}
+	err := helper.checkInitialized()
+	if err == nil || !strings.Contains(err.Error(), "missing-gopass") {
+		t.Fatalf("expected error naming the binary, actual: %v", err)
+	}
+	if !errors.Is(err, ErrGopassNotInstalled) || errors.Is(err, ErrGopassNotInitialized) {
+		t.Errorf("expected ErrGopassNotInstalled, actual: %v", err)
+	}
+
+	t.Setenv(gopassBinaryEnv, "missing-gopass-"+t.Name())
+	if err := helper.HealthCheck(); !errors.Is(err, ErrGopassNotInstalled) {
+		t.Errorf("expected ErrGopassNotInstalled for a binary missing from PATH, actual: %v", err)
+	}
+}
+
+func TestGopassNotInitialized(t *testing.T) {
+	newStubGopass(t, overrideStub("ls", `	echo "password store is not initialized" >&2
+	exit 1`))
+
+	err := Gopass{}.checkInitialized()
+	if !errors.Is(err, ErrGopassNotInitialized) || errors.Is(err, ErrGopassNotInstalled) {
+		t.Fatalf("expected ErrGopassNotInitialized, actual: %v", err)
+	}
+	if !strings.Contains(err.Error(), "password store is not initialized") {
+		t.Errorf("expected error to include the gopass output, actual: %v", err)
+	}
+}
+
+func TestGopassBinaryNotExecutable(t *testing.T) {
+	resetCache()
+	t.Cleanup(resetCache)
+
+	binary := filepath.Join(t.TempDir(), "gopass")
+	if err := os.WriteFile(binary, []byte(stubScript), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(gopassBinaryEnv, binary)
+
+	helper := Gopass{}
+	if helper.CheckInitialized() {
+		t.Fatal("expected non-executable binary to fail initialization")
+	}
+	if err := helper.checkInitialized(); errors.Is(err, ErrGopassNotInstalled) {
+		t.Errorf("expected a non-executable binary not to be reported as not installed: %v", err)
+	}
+}
+
+func TestGopassWrapper(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassBinaryEnv, filepath.Join(t.TempDir(), "missing-gopass"))
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "wrapper.log")
+	wrapper := filepath.Join(dir, "wrapper")
+	if err := os.WriteFile(wrapper, []byte("#!/bin/sh\necho \"$*\" >> \""+log+"\"\nshift\nexec \"$@\"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	helper := New(WithWrapper(wrapper, "-u", stub.binary))
+	creds := &credentials.Credentials{ServerURL: "https://wrapped.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, err := helper.Get(creds.ServerURL); err != nil || secret != "bar" {
+		t.Fatalf("expected the credentials to be read through the wrapper, actual %q, %v", secret, err)
+	}
+
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-u " + stub.binary + " insert -f " + GOPASS_FOLDER + "/" + EncodeServerURL(creds.ServerURL) + "/foo"
+	if !containsCall(strings.Split(strings.TrimSpace(string(b)), "\n"), expected) {
+		t.Errorf("expected the wrapper arguments to precede those of gopass, actual: %q", b)
+	}
+
+	t.Setenv(gopassWrapperEnv, wrapper+" -u "+stub.binary)
+	if _, secret, err := New().Get(creds.ServerURL); err != nil || secret != "bar" {
+		t.Errorf("expected %s to be used, actual %q, %v", gopassWrapperEnv, secret, err)
+	}
+
+	if err := New(WithWrapper()).checkInitialized(); err == nil || !strings.Contains(err.Error(), "must not be empty") {
+		t.Errorf("expected an empty wrapper to be rejected, actual: %v", err)
+	}
+	if err := New(WithWrapper("missing-wrapper-"+t.Name(), "gopass")).checkInitialized(); !errors.Is(err, ErrGopassNotInstalled) {
+		t.Errorf("expected a missing wrapper to be reported, actual: %v", err)
+	}
+}
+
+func TestGopassFolderFromEnv(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassFolderEnv, "ci//docker/")
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	if _, err := os.Stat(filepath.Join(stub.store, "ci", "docker", encoded, creds.Username+".gpg")); err != nil {
+		t.Fatalf("expected secret below overridden folder: %v", err)
+	}
+
+	credsList, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credsList[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected %s in list, actual: %v", creds.ServerURL, credsList)
+	}
+
+	if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Fatalf("expected secret %q, actual: %q (%v)", creds.Secret, s, err)
+	}
+
+	if err := helper.Delete(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+}
+
+func TestGopassFolderDefault(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassFolderEnv, "")
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER, encoded, creds.Username+".gpg")); err != nil {
+		t.Fatalf("expected secret below default folder: %v", err)
+	}
+}
+
+func TestGopassFolderInvalid(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	for _, folder := range []string{"..", "../escape", "ci/../../escape", "/abs", "."} {
+		t.Setenv(gopassFolderEnv, folder)
+
+		err := helper.Add(&credentials.Credentials{
+			ServerURL: "https://stub.docker.io/v1",
+			Username:  "stub-username",
+			Secret:    "stub-password",
+		})
+		if err == nil {
+			t.Errorf("expected folder %q to be rejected", folder)
+		}
+		if _, err := helper.List(); err == nil {
+			t.Errorf("expected folder %q to be rejected by List", folder)
+		}
+	}
+}
+
+func TestGopassGetAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		usernames []string
+	}{
+		{name: "two usernames", usernames: []string{"personal", "bot"}},
+		{name: "three usernames", usernames: []string{"personal", "bot", "ci"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newStubGopass(t, stubScript)
+			helper := Gopass{}
+
+			serverURL := "https://stub.docker.io/v1"
+			for _, username := range tc.usernames {
+				if err := helper.Add(&credentials.Credentials{
+					ServerURL: serverURL,
+					Username:  username,
+					Secret:    username + "-secret",
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			all, err := helper.GetAll(serverURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != len(tc.usernames) {
+				t.Fatalf("expected %d usernames, actual: %v", len(tc.usernames), all)
+			}
+			for _, username := range tc.usernames {
+				if all[username] != username+"-secret" {
+					t.Errorf("invalid secret for %s: %q", username, all[username])
+				}
+			}
+
+			for _, username := range tc.usernames {
+				u, s, _, err := helper.get(serverURL, username, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if u != username || s != username+"-secret" {
+					t.Errorf("expected exact match for %s, actual: %s/%s", username, u, s)
+				}
+			}
+		})
+	}
+}
+
+func TestGopassGetAllMissing(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	if _, err := helper.GetAll("https://missing.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+}
+
+func TestGopassInitTimeout(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("ls", `	if [ -f "`+dir+`/hang" ]; then
+		exec sleep 5
+	fi`))
+	if err := os.WriteFile(filepath.Join(dir, "hang"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	helper := New(WithInitTimeout(100 * time.Millisecond))
+	start := time.Now()
+	if helper.CheckInitialized() {
+		t.Fatal("expected a hanging check not to succeed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the check to fail once its deadline passed, took %s", elapsed)
+	}
+	if err := helper.checkInitialized(); !errors.Is(err, ErrGopassNotInitialized) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the check to time out, actual: %v", err)
+	}
+
+	t.Setenv(gopassInitTimeoutEnv, "soon")
+	if err := New().checkInitialized(); err == nil || !strings.Contains(err.Error(), gopassInitTimeoutEnv) {
+		t.Errorf("expected an invalid %s to be rejected, actual: %v", gopassInitTimeoutEnv, err)
+	}
+
+	// Once the check succeeds, it is not run again within its TTL.
+	if err := os.Remove(filepath.Join(dir, "hang")); err != nil {
+		t.Fatal(err)
+	}
+	if !helper.CheckInitialized() {
+		t.Fatal("expected gopass to be initialized")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hang"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	calls := len(stub.calls(t))
+	start = time.Now()
+	if !helper.CheckInitialized() || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("expected the cached result to be returned immediately, took %s", time.Since(start))
+	}
+	if len(stub.calls(t)) != calls {
+		t.Errorf("expected gopass not to be run again, calls: %q", stub.calls(t))
+	}
+}
+
+func TestGopassTimeout(t *testing.T) {
+	newStubGopass(t, overrideStub("show", "\texec sleep 5"))
+	t.Setenv(gopassTimeoutEnv, "100ms")
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, _, err := helper.Get(creds.ServerURL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, actual: %v", err)
+	}
+	if !strings.Contains(err.Error(), "gopass show") {
+		t.Errorf("expected error to name the operation, actual: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected Get to be aborted, took %s", elapsed)
+	}
+}
+
+func TestGopassTimeoutInvalid(t *testing.T) {
+	newStubGopass(t, stubScript)
+	t.Setenv(gopassTimeoutEnv, "soon")
+	helper := Gopass{}
+
+	if _, err := helper.List(); err == nil || !strings.Contains(err.Error(), gopassTimeoutEnv) {
+		t.Fatalf("expected invalid timeout error, actual: %v", err)
+	}
+}
+
+func TestGopassError(t *testing.T) {
+	newStubGopass(t, overrideStub("insert", `	echo "  could not encrypt: $(cat)" >&2
+	echo "  second line" >&2
+	exit 3`))
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	err := helper.Add(creds)
+
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) {
+		t.Fatalf("expected GopassError, actual: %v", err)
+	}
+	if gopassErr.ExitCode != 3 {
+		t.Errorf("expected exit code 3, actual: %d", gopassErr.ExitCode)
+	}
+	if gopassErr.Args[0] != "insert" {
+		t.Errorf("expected insert args, actual: %q", gopassErr.Args)
+	}
+	if !strings.HasPrefix(gopassErr.Stderr, "could not encrypt: "+redacted) || !strings.HasSuffix(gopassErr.Stderr, "\n  second line") {
+		t.Errorf("unexpected stderr: %q", gopassErr.Stderr)
+	}
+	if strings.Contains(err.Error(), creds.Secret) {
+		t.Errorf("error leaks the secret: %v", err)
+	}
+}
+
+func TestGopassMetadata(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.AddWithMetadata(creds, map[string]string{"hint": "robot account"}); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	content, err := os.ReadFile(filepath.Join(stub.store, GOPASS_FOLDER, encoded, creds.Username+".gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "stub-password\nhint: robot account\nserver_url: https://stub.docker.io/v1\n"; string(content) != expected {
+		t.Fatalf("unexpected secret content: %q", content)
+	}
+
+	got, metadata, err := helper.GetWithMetadata(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *creds {
+		t.Errorf("expected %+v, actual: %+v", creds, got)
+	}
+	if metadata["hint"] != "robot account" {
+		t.Errorf("expected hint metadata, actual: %v", metadata)
+	}
+	if metadata[metadataServerURL] != creds.ServerURL {
+		t.Errorf("expected server URL metadata, actual: %v", metadata)
+	}
+
+	if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Fatalf("expected secret %q, actual: %q (%v)", creds.Secret, s, err)
+	}
+}
+
+func TestGopassMetadataInvalid(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	for _, metadata := range []map[string]string{
+		{metadataServerURL: "https://other.docker.io"},
+		{"bad:key": "value"},
+		{"key": "multi\nline"},
+	} {
+		if err := helper.AddWithMetadata(creds, metadata); err == nil {
+			t.Errorf("expected metadata %v to be rejected", metadata)
+		}
+	}
+}
+
+func TestGopassDirCached(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := helper.Get(creds.ServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var configCalls int
+	for _, call := range stub.calls(t) {
+		if call == "config mounts.path" {
+			configCalls++
+		}
+	}
+	if configCalls != 1 {
+		t.Fatalf("expected store directory to be resolved once, actual: %d", configCalls)
+	}
+
+	resetCache()
+	if _, _, err := helper.Get(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(t); calls[len(calls)-2] != "config mounts.path" {
+		t.Fatalf("expected store directory to be resolved after reset, calls: %q", calls)
+	}
+}
+
+func TestGopassMount(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassMountEnv, "team")
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	if _, err := os.Stat(filepath.Join(stub.store, "team", GOPASS_FOLDER, encoded, creds.Username+".gpg")); err != nil {
+		t.Fatalf("expected secret below mount: %v", err)
+	}
+
+	credsList, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credsList) != 1 || credsList[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected only %s in list, actual: %v", creds.ServerURL, credsList)
+	}
+
+	if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Fatalf("expected secret %q, actual: %q (%v)", creds.Secret, s, err)
+	}
+
+	if err := helper.Delete(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+
+	calls := stub.calls(t)
+	for _, expected := range []string{
+		"config mounts.team.path",
+		"insert -f team/" + GOPASS_FOLDER + "/" + encoded + "/" + creds.Username,
+		"rm -rf team/" + GOPASS_FOLDER + "/" + encoded,
+	} {
+		if !containsCall(calls, expected) {
+			t.Errorf("expected call %q, calls: %q", expected, calls)
+		}
+	}
+}
+
+func TestGopassMountDefault(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassMountEnv, "")
+	helper := Gopass{}
+
+	if _, err := helper.List(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(t); !containsCall(calls, "config mounts.path") {
+		t.Fatalf("expected root store to be used, calls: %q", calls)
+	}
+}
+
+// containsCall reports whether call is one of calls.
+func containsCall(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGopassListSkipsInvalidServers(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := base64.URLEncoding.EncodeToString([]byte("https://empty.docker.io"))
+	for _, dir := range []string{empty, "not base64!", "garbage"} {
+		if err := os.MkdirAll(filepath.Join(stub.store, GOPASS_FOLDER, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(stub.store, GOPASS_FOLDER, "garbage", "user.gpg"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credsList, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credsList) != 1 || credsList[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected only %s in list, actual: %v", creds.ServerURL, credsList)
+	}
+}
+
+func TestGopassDeleteUser(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	serverURL := "https://stub.docker.io/v1"
+	for _, username := range []string{"personal", "bot"} {
+		if err := helper.Add(&credentials.Credentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := helper.DeleteUser(serverURL, "missing"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+
+	if err := helper.DeleteUser(serverURL, "bot"); err != nil {
+		t.Fatal(err)
+	}
+	all, err := helper.GetAll(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all["personal"] != "personal-secret" {
+		t.Fatalf("expected only personal to remain, actual: %v", all)
+	}
+
+	if err := helper.DeleteUser(serverURL, "personal"); err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.URLEncoding.EncodeToString([]byte(serverURL))
+	if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER, encoded)); !os.IsNotExist(err) {
+		t.Fatalf("expected server folder to be removed, actual: %v", err)
+	}
+	if _, _, err := helper.Get(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+}
+
+func TestGopassDeleteRemovesAllUsers(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	serverURL := "https://stub.docker.io/v1"
+	for _, username := range []string{"personal", "bot"} {
+		if err := helper.Add(&credentials.Credentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := helper.Delete(serverURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := helper.GetAll(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found, actual: %v", err)
+	}
+}
+
+func TestGopassAddInvalidUsername(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	for _, username := range []string{
+		"",
+		"null\x00byte",
+		"line\nbreak",
+	} {
+		err := helper.Add(&credentials.Credentials{
+			ServerURL: "https://stub.docker.io/v1",
+			Username:  username,
+			Secret:    "stub-password",
+		})
+		if err == nil {
+			t.Errorf("expected username %q to be rejected", username)
+		}
+		if err := helper.DeleteUser("https://stub.docker.io/v1", username); err == nil {
+			t.Errorf("expected username %q to be rejected by DeleteUser", username)
+		}
+	}
+
+	if err := helper.Add(&credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "",
+		Secret:    "stub-password",
+	}); !credentials.IsCredentialsMissingUsername(err) {
+		t.Errorf("expected missing username error, actual: %v", err)
+	}
+
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "insert") {
+			t.Fatalf("expected no secret to be written, calls: %q", stub.calls(t))
+		}
+	}
+
+	if err := helper.Add(&credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "user@example.com",
+		Secret:    "stub-password",
+	}); err != nil {
+		t.Fatalf("expected email username to be accepted: %v", err)
+	}
+}
+
+func TestGopassEncodedUsernames(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+	serverURL := "https://encoded.docker.io"
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL(serverURL))
+
+	usernames := []string{
+		"team/robot account",
+		"first last",
+		".",
+		"..",
+		"../../../etc/something",
+		`windows\username`,
+		".hidden",
+		encodedUsernamePrefix + "literal",
+	}
+	for _, username := range usernames {
+		name := usernameName(username)
+		if err := helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: username, Secret: "secret of " + username}); err != nil {
+			t.Fatalf("%q: %v", username, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+".gpg")); err != nil {
+			t.Errorf("%q: expected the credentials to be stored as %s: %v", username, name, err)
+		}
+
+		username, secret, err := helper.Get(serverURL + "#" + username)
+		if err != nil || secret != "secret of "+username {
+			t.Errorf("%q: expected the credentials to be found, actual %q, %v", username, secret, err)
+		}
+	}
+	if usernameName("first last") != "first last" {
+		t.Errorf("expected usernames usable as a name to be stored as is")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(usernames) {
+		t.Errorf("expected every username to be stored in the server folder, actual: %v", entries)
+	}
+
+	all, err := helper.GetAll(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range usernames {
+		if all[username] != "secret of "+username {
+			t.Errorf("%q: expected GetAll to report the username, actual: %q", username, all)
+		}
+	}
+
+	if list, err := New(WithPreferredUsernames("team/robot account")).List(); err != nil || list[serverURL] != "team/robot account" {
+		t.Errorf("expected List to report the username from metadata, actual: %v, %v", list, err)
+	}
+	creds, _, err := helper.GetWithMetadata(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := all[creds.Username]; !ok || creds.Secret != "secret of "+creds.Username {
+		t.Errorf("expected the username from metadata, actual: %+v", creds)
+	}
+
+	if err := helper.DeleteUser(serverURL, "team/robot account"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(serverURL + "#team/robot account"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected the username to be deleted, actual: %v", err)
+	}
+
+	// Credentials stored under an encoded-looking name without the username
+	// metadata keep the name as username.
+	legacy := encodedUsernamePrefix + "bGVnYWN5"
+	if err := os.RemoveAll(filepath.Join(stub.store, GOPASS_FOLDER)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacy+".gpg"), []byte("legacy-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if username, secret, err := helper.Get(serverURL); err != nil || username != legacy || secret != "legacy-secret" {
+		t.Errorf("expected the name to be used as username, actual %q/%q, %v", username, secret, err)
+	}
+}
+
+// stubPinentry speaks just enough of the Assuan protocol to hand out a fixed
+// passphrase.
+const stubPinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r cmd rest; do
+	case "$cmd" in
+	GETPIN)
+		echo "D hunter%252"
+		echo "OK"
+		;;
+	BYE)
+		echo "OK closing connection"
+		exit 0
+		;;
+	*) echo "OK" ;;
+	esac
+done
+`
+
+// stubGpg unlocks the stub store if it is given the expected passphrase.
+const stubGpg = `#!/bin/sh
+echo "$*" > "@DIR@/gpg.args"
+read -r passphrase
+if [ "$passphrase" != "hunter%2" ]; then
+	echo "gpg: signing failed: Bad passphrase" >&2
+	exit 2
+fi
+touch "@DIR@/unlocked"
+`
+
+func TestGopassPinentryUnlock(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("show", `	if [ ! -f "`+dir+`/unlocked" ]; then
+		echo "gpg: public key decryption failed: Inappropriate ioctl for device" >&2
+		echo "gpg: decryption failed: No secret key" >&2
+		exit 1
+	fi
+	head -n 1 "$store/$target.gpg"`))
+	if err := os.WriteFile(filepath.Join(stub.store, ".gpg-id"), []byte("7D851EB72D73BDA0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPinentry, oldGpg := pinentryProgram, gpgProgram
+	t.Cleanup(func() { pinentryProgram, gpgProgram = oldPinentry, oldGpg })
+	pinentryProgram = filepath.Join(dir, "pinentry")
+	gpgProgram = filepath.Join(dir, "gpg")
+	if err := os.WriteFile(pinentryProgram, []byte(stubPinentry), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gpgProgram, []byte(strings.ReplaceAll(stubGpg, "@DIR@", dir)), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	helper := Gopass{}
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(gopassUsePinentryEnv, "")
+	if _, _, err := helper.Get(creds.ServerURL); !isLocked(err) {
+		t.Fatalf("expected locked error without pinentry, actual: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gpg.args")); !os.IsNotExist(err) {
+		t.Fatal("expected gpg not to be invoked without pinentry")
+	}
+
+	_, s, err := New(WithPinentry()).Get(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != creds.Secret {
+		t.Errorf("invalid secret: %s", s)
+	}
+	if err := os.Remove(filepath.Join(dir, "unlocked")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(gopassUsePinentryEnv, "1")
+	_, s, err = helper.Get(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != creds.Secret {
+		t.Errorf("invalid secret: %s", s)
+	}
+
+	// No passphrase unlocks a missing key, so none is prompted for.
+	missing := &GopassError{Stderr: "gpg: encrypted with 3072-bit RSA key, ID 7D851EB72D73BDA0\ngpg: decryption failed: No secret key"}
+	if isLocked(missing) {
+		t.Error("expected a missing key not to be reported as locked")
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, "gpg.args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "--local-user 7D851EB72D73BDA0") {
+		t.Errorf("expected store key to be unlocked, gpg args: %s", args)
+	}
+
+	// The recipients of the credentials folder take precedence over those of
+	// the store.
+	if err := os.WriteFile(filepath.Join(stub.store, GOPASS_FOLDER, ".gpg-id"), []byte("0xFOLDER\n0xOTHER\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "unlocked")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	args, err = os.ReadFile(filepath.Join(dir, "gpg.args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "--local-user 0xFOLDER") {
+		t.Errorf("expected the key of the credentials folder to be unlocked, gpg args: %s", args)
+	}
+}
+
+func TestAssuanEscape(t *testing.T) {
+	if escaped := assuanEscape("100%\nsure\r"); escaped != "100%25%0Asure%0D" {
+		t.Fatalf("unexpected escaping: %q", escaped)
+	}
+}
+
+func TestGopassNew(t *testing.T) {
+	personal := newStubGopass(t, stubScript)
+	team := newStubGopass(t, stubScript)
+	t.Setenv(gopassBinaryEnv, filepath.Join(t.TempDir(), "missing-gopass"))
+
+	personalHelper := New(WithBinary(personal.binary))
+	teamHelper := New(WithBinary(team.binary), WithFolder("ci/docker"), WithMount("team"), WithTimeout(time.Second))
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := personalHelper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if err := teamHelper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	if _, err := os.Stat(filepath.Join(personal.store, GOPASS_FOLDER, encoded, creds.Username+".gpg")); err != nil {
+		t.Errorf("expected secret in personal store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(team.store, "team", "ci", "docker", encoded, creds.Username+".gpg")); err != nil {
+		t.Errorf("expected secret in team mount: %v", err)
+	}
+
+	for _, helper := range []*Gopass{personalHelper, teamHelper} {
+		if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+			t.Errorf("expected secret %q, actual: %q (%v)", creds.Secret, s, err)
+		}
+	}
+
+	if (Gopass{}).CheckInitialized() {
+		t.Error("expected zero value to use the binary from the environment")
+	}
+}
+
+func TestGopassNewInvalidOptions(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	for _, opt := range []Option{WithFolder("../escape"), WithMount("/abs")} {
+		if err := New(WithBinary(stub.binary), opt).Add(creds); err == nil {
+			t.Error("expected invalid option to be rejected")
+		}
+	}
+}
+
+func TestGopassInitializationPerInstance(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("ls", `	if [ -f "`+dir+`/broken" ]; then
+		echo "gopass store is broken" >&2
+		exit 1
+	fi`))
+
+	zero := Gopass{}
+	first := New(WithBinary(stub.binary))
+	if !zero.CheckInitialized() || !first.CheckInitialized() {
+		t.Fatal("expected stub gopass to be initialized")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !first.CheckInitialized() {
+		t.Error("expected initialization to be cached by the instance")
+	}
+	if !(Gopass{}).CheckInitialized() {
+		t.Error("expected zero values to share the default instance")
+	}
+	if New(WithBinary(stub.binary)).CheckInitialized() {
+		t.Error("expected a fresh instance to check initialization again")
+	}
+}
+
+func TestGopassHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("ls", `	if [ -f "`+dir+`/broken" ]; then
+		echo "gpg-agent is gone" >&2
+		exit 2
+	fi`))
+	helper := New(WithBinary(stub.binary))
+
+	if !helper.CheckInitialized() {
+		t.Fatal("expected stub gopass to be initialized")
+	}
+	if err := helper.HealthCheck(); err != nil {
+		t.Fatalf("expected healthy gopass: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var gopassErr *GopassError
+	if err := helper.HealthCheck(); !errors.As(err, &gopassErr) || gopassErr.ExitCode != 2 {
+		t.Fatalf("expected health check to fail, actual: %v", err)
+	}
+	if !helper.CheckInitialized() {
+		t.Error("expected CheckInitialized to remain cached")
+	}
+}
+
+func TestGopassReadOnly(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("option", func(t *testing.T) {
+		testReadOnly(t, stub, New(WithReadOnly()), creds)
+	})
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv(gopassReadOnlyEnv, "1")
+		testReadOnly(t, stub, New(), creds)
+	})
+}
+
+func testReadOnly(t *testing.T, stub *stubGopass, helper *Gopass, creds *credentials.Credentials) {
+	t.Helper()
+
+	if err := helper.Add(creds); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected Add to be refused, actual: %v", err)
+	}
+	if err := helper.Delete(creds.ServerURL); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected Delete to be refused, actual: %v", err)
+	}
+	if err := helper.DeleteUser(creds.ServerURL, creds.Username); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected DeleteUser to be refused, actual: %v", err)
+	}
+
+	if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Errorf("expected secret %q, actual: %q (%v)", creds.Secret, s, err)
+	}
+	if credsList, err := helper.List(); err != nil || credsList[creds.ServerURL] != creds.Username {
+		t.Errorf("expected %s in list, actual: %v (%v)", creds.ServerURL, credsList, err)
+	}
+
+	// Only the insert made while setting up the test may have been run.
+	var mutations int
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "insert") || strings.HasPrefix(call, "rm") {
+			mutations++
+		}
+	}
+	if mutations != 1 {
+		t.Errorf("expected no mutating gopass call, calls: %q", stub.calls(t))
+	}
+}
+
+func TestGopassGlobalArgs(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+
+	t.Setenv(gopassGlobalArgsEnv, "--yes  --nosync")
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := New(WithGlobalArgs("--yes")).Get(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))
+	for _, expected := range []string{
+		"--yes --nosync ls --flat " + GOPASS_FOLDER,
+		"--yes --nosync insert -f " + GOPASS_FOLDER + "/" + encoded + "/" + creds.Username,
+		"--yes show -n " + GOPASS_FOLDER + "/" + encoded + "/" + creds.Username,
+	} {
+		if !containsCall(stub.calls(t), expected) {
+			t.Errorf("expected call %q, calls: %q", expected, stub.calls(t))
+		}
+	}
+}
+
+func TestGopassGlobalArgsInvalid(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	for _, args := range [][]string{{"show"}, {"--"}, {"-"}, {"--store", "x"}, {"--yes\n"}} {
+		if New(WithBinary(stub.binary), WithGlobalArgs(args...)).CheckInitialized() {
+			t.Errorf("expected global args %q to be rejected", args)
+		}
+	}
+}
+
+func TestGopassNoAutoSync(t *testing.T) {
+	t.Setenv("GOPASS_NO_AUTOSYNC", "")
+	stub := newStubGopass(t, strings.Replace(stubScript, "store=", `echo "$1 ${GOPASS_NO_AUTOSYNC:-unset}" >> "@LOG@.env"
+store=`, 1))
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+
+	tests := []struct {
+		name     string
+		helper   *Gopass
+		expected string
+	}{
+		{name: "default", helper: New(), expected: "true"},
+		{name: "autosync", helper: New(WithAutoSync()), expected: "unset"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.Remove(stub.log + ".env"); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+
+			if err := tc.helper.Add(creds); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := tc.helper.Get(creds.ServerURL); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.helper.Delete(creds.ServerURL); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(stub.log + ".env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var writes int
+			for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				cmd, value, _ := strings.Cut(line, " ")
+				expected := "unset"
+				if cmd == "insert" || cmd == "rm" {
+					expected = tc.expected
+					writes++
+				}
+				if value != expected {
+					t.Errorf("expected GOPASS_NO_AUTOSYNC %s for %s, actual: %s", expected, cmd, value)
+				}
+			}
+			if writes != 2 {
+				t.Errorf("expected an insert and a rm, actual: %s", b)
+			}
+		})
+	}
+}
+
+func TestGopassLogger(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	var logged []string
+	helper := New(WithBinary(stub.binary), WithLogger(func(msg string, keyvals ...interface{}) {
+		logged = append(logged, fmt.Sprintln(append([]interface{}{msg}, keyvals...)...))
+	}))
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	var show bool
+	for _, line := range logged {
+		if strings.Contains(line, creds.Secret) {
+			t.Errorf("log leaks the secret: %s", line)
+		}
+		if strings.Contains(line, "subcommand show") && strings.Contains(line, "duration") {
+			show = true
+		}
+	}
+	if !show {
+		t.Errorf("expected show to be logged, logged: %q", logged)
+	}
+}
+
+func TestGopassListGitBackedStore(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	folder := filepath.Join(stub.store, GOPASS_FOLDER)
+	for _, dir := range []string{".git/objects", "abcd", "YWJj="} {
+		if err := os.MkdirAll(filepath.Join(folder, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{".gpg-id", ".git/HEAD", "abcd/user.gpg", "YWJj=/user.gpg"} {
+		if err := os.WriteFile(filepath.Join(folder, file), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	credsList, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "abcd" decodes to binary garbage and "YWJj=" is not canonical padding.
+	if len(credsList) != 1 || credsList[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected only %s in list, actual: %v", creds.ServerURL, credsList)
+	}
+}
+
+func TestDecodeServerURL(t *testing.T) {
+	for _, serverURL := range []string{"https://stub.docker.io/v1", "stub.docker.io:5000", "ünïcode.example"} {
+		decoded, err := DecodeServerURL(EncodeServerURL(serverURL))
+		if err != nil || decoded != serverURL {
+			t.Errorf("expected %q to round-trip, actual: %q, %v", serverURL, decoded, err)
+		}
+	}
+	for _, name := range []string{"", ".git", ".gpg-id", "not base64!", "abcd", "YWJj="} {
+		if decoded, err := DecodeServerURL(name); err == nil {
+			t.Errorf("expected %q to be skipped, actual: %q", name, decoded)
+		}
+	}
+}
+
+func TestGopassLegacyFallback(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	current := &credentials.Credentials{
+		ServerURL: "https://current.docker.io/v1",
+		Username:  "current-username",
+		Secret:    "current-password",
+	}
+	if err := New().Add(current); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := &credentials.Credentials{
+		ServerURL: "https://legacy.docker.io/v1",
+		Username:  "legacy-username",
+		Secret:    "legacy-password",
+	}
+	legacyDir := filepath.Join(stub.store, GOPASS_FOLDER, "https:", "legacy.docker.io", "v1")
+	if err := os.MkdirAll(legacyDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacyDir, legacy.Username+".gpg"), []byte(legacy.Secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := New().Get(legacy.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found without fallback, actual: %v", err)
+	}
+
+	t.Setenv(gopassLegacyFallbackEnv, "1")
+	for _, helper := range []*Gopass{New(), New(WithLegacyFallback())} {
+		for _, creds := range []*credentials.Credentials{current, legacy} {
+			u, s, err := helper.Get(creds.ServerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u != creds.Username || s != creds.Secret {
+				t.Errorf("expected %s/%s, actual: %s/%s", creds.Username, creds.Secret, u, s)
+			}
+		}
+
+		for _, serverURL := range []string{"https://missing.docker.io", "../../escape"} {
+			if _, _, err := helper.Get(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+				t.Errorf("expected credentials not found for %s, actual: %v", serverURL, err)
+			}
+		}
+	}
+}
+
+// memoryHelper is an in-memory credentials.Helper, keyed by server URL.
+type memoryHelper map[string]*credentials.Credentials
+
+func (m memoryHelper) Add(creds *credentials.Credentials) error {
+	m[creds.ServerURL] = creds
+	return nil
+}
+
+func (m memoryHelper) Delete(serverURL string) error {
+	delete(m, serverURL)
+	return nil
+}
+
+func (m memoryHelper) Get(serverURL string) (string, string, error) {
+	creds, ok := m[serverURL]
+	if !ok {
+		return "", "", credentials.NewErrCredentialsNotFound()
+	}
+	if creds.Secret == "" {
+		return "", "", errors.New("secret is locked")
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+func (m memoryHelper) List() (map[string]string, error) {
+	resp := make(map[string]string, len(m))
+	for serverURL, creds := range m {
+		resp[serverURL] = creds.Username
+	}
+	return resp, nil
+}
+
+func TestGopassImportFrom(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := New()
+
+	existing := &credentials.Credentials{
+		ServerURL: "https://existing.docker.io",
+		Username:  "existing-username",
+		Secret:    "existing-password",
+	}
+	if err := helper.Add(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	src := memoryHelper{}
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://one.docker.io", Username: "one-username", Secret: "one-password"},
+		{ServerURL: "https://two.docker.io", Username: "two-username", Secret: "two-password"},
+		{ServerURL: existing.ServerURL, Username: existing.Username, Secret: "imported-password"},
+		{ServerURL: "https://locked.docker.io", Username: "locked-username"},
+		{ServerURL: "https://invalid.docker.io", Username: "invalid\nusername", Secret: "invalid-password"},
+	} {
+		_ = src.Add(creds)
+	}
+
+	n, err := helper.ImportFrom(src, false)
+	if n != 2 {
+		t.Errorf("expected 2 credentials to be imported, actual: %d", n)
+	}
+	if err == nil {
+		t.Fatal("expected import errors")
+	}
+	for _, serverURL := range []string{"https://locked.docker.io", "https://invalid.docker.io"} {
+		if !strings.Contains(err.Error(), serverURL) {
+			t.Errorf("expected an error for %s, actual: %v", serverURL, err)
+		}
+	}
+	var joined *joinedError
+	if !errors.As(err, &joined) || len(joined.errs) != 2 {
+		t.Errorf("expected exactly two errors, actual: %v", err)
+	}
+
+	for serverURL, secret := range map[string]string{
+		"https://one.docker.io": "one-password",
+		"https://two.docker.io": "two-password",
+		existing.ServerURL:      existing.Secret,
+	} {
+		_, s, err := helper.Get(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != secret {
+			t.Errorf("expected %s for %s, actual: %s", secret, serverURL, s)
+		}
+	}
+	if _, _, err := helper.Get("https://locked.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected locked credentials not to be imported, actual: %v", err)
+	}
+
+	delete(src, "https://locked.docker.io")
+	delete(src, "https://invalid.docker.io")
+	n, err = helper.ImportFrom(src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 credentials to be imported, actual: %d", n)
+	}
+	if _, s, err := helper.Get(existing.ServerURL); err != nil || s != "imported-password" {
+		t.Errorf("expected existing credentials to be overwritten, actual: %s, %v", s, err)
+	}
+}
+
+func TestGopassExport(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	all := []*credentials.Credentials{
+		{ServerURL: "https://one.docker.io", Username: "one-a", Secret: "one-a-password"},
+		{ServerURL: "https://one.docker.io", Username: "one-b", Secret: "one-b-password"},
+		{ServerURL: "https://two.docker.io", Username: "two", Secret: "two-password"},
+	}
+	for _, creds := range all {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exported, err := helper.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != len(all) {
+		t.Fatalf("expected %d credentials, actual: %d", len(all), len(exported))
+	}
+	for i, creds := range all {
+		if *exported[i] != *creds {
+			t.Errorf("expected %+v, actual: %+v", *creds, *exported[i])
+		}
+	}
+
+	// Make the secrets of one server unreadable.
+	two := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte("https://two.docker.io")))
+	if err := os.Remove(filepath.Join(two, "two.gpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(two, "two.gpg"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err = helper.Export()
+	if err == nil || !strings.Contains(err.Error(), "https://two.docker.io") {
+		t.Errorf("expected an error for https://two.docker.io, actual: %v", err)
+	}
+	if len(exported) != 2 || exported[0].Username != "one-a" || exported[1].Username != "one-b" {
+		t.Errorf("expected the credentials of https://one.docker.io, actual: %v", exported)
+	}
+}
+
+func TestNormalizeServerURL(t *testing.T) {
+	for _, tc := range []struct {
+		serverURL, normalized, host string
+	}{
+		{"https://index.docker.io/v1/", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"https://index.docker.io/v1", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"index.docker.io", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"docker.io", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"https://registry-1.docker.io/", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"HTTPS://Index.Docker.IO/v1/", "https://index.docker.io/v1", "index.docker.io/v1"},
+		{"https://Registry.Example.com:5000/Path//", "https://registry.example.com:5000/Path", "registry.example.com:5000/Path"},
+		{"http://registry.example.com", "http://registry.example.com", "registry.example.com"},
+		{"ftp://registry.example.com", "ftp://registry.example.com", "ftp://registry.example.com"},
+	} {
+		if actual := normalizeServerURL(tc.serverURL, normalizeNone); actual != tc.serverURL {
+			t.Errorf("expected %s to be left unchanged, actual: %s", tc.serverURL, actual)
+		}
+		if actual := normalizeServerURL(tc.serverURL, normalizeURL); actual != tc.normalized {
+			t.Errorf("expected %s to be normalized to %s, actual: %s", tc.serverURL, tc.normalized, actual)
+		}
+		if actual := normalizeServerURL(tc.serverURL, normalizeHost); actual != tc.host {
+			t.Errorf("expected %s to be normalized to %s, actual: %s", tc.serverURL, tc.host, actual)
+		}
+	}
+}
+
+func TestGopassNormalization(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := New(WithNormalization(false))
+
+	if err := helper.Add(&credentials.Credentials{
+		ServerURL: "https://index.docker.io/v1/",
+		Username:  "hub-username",
+		Secret:    "hub-password",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serverURL := range []string{"index.docker.io", "docker.io", "https://index.docker.io/v1"} {
+		u, s, err := helper.Get(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != "hub-username" || s != "hub-password" {
+			t.Errorf("expected hub-username/hub-password for %s, actual: %s/%s", serverURL, u, s)
+		}
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list["https://index.docker.io/v1"] != "hub-username" {
+		t.Errorf("expected a single normalized server URL, actual: %v", list)
+	}
+
+	if _, _, err := New().Get("index.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found without normalization, actual: %v", err)
+	}
+
+	if err := helper.Delete("docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get("https://index.docker.io/v1/"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials to be deleted, actual: %v", err)
+	}
+
+	t.Setenv(gopassNormalizeEnv, "bogus")
+	if _, _, err := New().Get("docker.io"); err == nil || !strings.Contains(err.Error(), gopassNormalizeEnv) {
+		t.Errorf("expected an invalid normalization error, actual: %v", err)
+	}
+}
+
+func TestGopassMigrateNormalized(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	route := WithRoute("*.corp.example.com", "team", "")
+	legacy := New(route)
+
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://index.docker.io/v1/", Username: "hub", Secret: "hub-password"},
+		{ServerURL: "index.docker.io", Username: "hub", Secret: "conflicting-password"},
+		{ServerURL: "index.docker.io", Username: "other", Secret: "other-password"},
+		{ServerURL: "https://registry.example.com/", Username: "example", Secret: "example-password"},
+		{ServerURL: "https://registry.corp.example.com/", Username: "corp", Secret: "corp-password"},
+	} {
+		if err := legacy.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := legacy.MigrateNormalized(); err == nil {
+		t.Error("expected migrating without normalization to fail")
+	}
+
+	t.Setenv(gopassNormalizeEnv, "1")
+	helper := New(route)
+	moved, err := helper.MigrateNormalized()
+	if moved != 4 {
+		t.Errorf("expected 4 credentials to be moved, actual: %d", moved)
+	}
+	if err == nil || !strings.Contains(err.Error(), "hub") {
+		t.Errorf("expected a conflict for the hub username, actual: %v", err)
+	}
+
+	all, err := helper.GetAll("docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["other"] != "other-password" || all["hub"] == "" {
+		t.Errorf("expected the Docker Hub credentials to be merged, actual: %v", all)
+	}
+	if _, s, err := helper.Get("https://registry.example.com"); err != nil || s != "example-password" {
+		t.Errorf("expected example-password, actual: %s, %v", s, err)
+	}
+	if _, s, err := helper.Get("https://registry.corp.example.com"); err != nil || s != "corp-password" {
+		t.Errorf("expected corp-password, actual: %s, %v", s, err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, "team", GOPASS_FOLDER, EncodeServerURL("https://registry.corp.example.com/"))); !os.IsNotExist(err) {
+		t.Errorf("expected the routed credentials to be migrated, actual: %v", err)
+	}
+
+	list, err := legacy.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list["https://registry.example.com/"] != "" || list["https://registry.corp.example.com/"] != "" {
+		t.Errorf("expected only the conflicting folder to be left, actual: %v", list)
+	}
+}
+
+func TestGopassConcurrentWrites(t *testing.T) {
+	// The stub fails any write started while another one is in progress.
+	locked := func(body string) string {
+		return `	if ! mkdir "$store.lock" 2>/dev/null; then
+		echo "concurrent write" >&2
+		exit 1
+	fi
+	sleep 0.01
+` + body + `
+	rmdir "$store.lock"`
+	}
+	script := overrideStub("insert", locked(`	mkdir -p "$(dirname "$store/$target")" && cat > "$store/$target.gpg"`))
+	script = strings.Replace(script, "case \"$cmd\" in\n", "case \"$cmd\" in\nrm)\n"+locked(`	rm -rf "$store/$target" "$store/$target.gpg"`)+"\n\t;;\n", 1)
+	newStubGopass(t, script)
+	helper := New()
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serverURL := fmt.Sprintf("https://server%d.docker.io", i)
+			errs <- helper.Add(&credentials.Credentials{
+				ServerURL: serverURL,
+				Username:  "username",
+				Secret:    "password",
+			})
+			if i%2 == 0 {
+				errs <- helper.Delete(serverURL)
+			}
+		}(i)
+	}
+
+	// Reads proceed while writes are in progress.
+	if _, err := helper.List(); err != nil {
+		t.Error(err)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != n/2 {
+		t.Errorf("expected %d server URLs, actual: %v", n/2, list)
+	}
+	for i := 1; i < n; i += 2 {
+		if list[fmt.Sprintf("https://server%d.docker.io", i)] != "username" {
+			t.Errorf("expected server%d to be stored, actual: %v", i, list)
+		}
+	}
+}
+
+func TestGopassGetUsernameFragment(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := New()
+
+	serverURL := "https://fragment.docker.io/v1"
+	for _, username := range []string{"first", "second"} {
+		if err := helper.Add(&credentials.Credentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, s, err := helper.Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "first" || s != "first-secret" {
+		t.Errorf("expected the first username without a fragment, actual: %s/%s", u, s)
+	}
+
+	for _, username := range []string{"first", "second"} {
+		u, s, err := helper.Get(serverURL + "#" + username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != username || s != username+"-secret" {
+			t.Errorf("expected %s/%s-secret, actual: %s/%s", username, username, u, s)
+		}
+	}
+
+	if _, _, err := helper.Get(serverURL + "#missing"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found for a missing username, actual: %v", err)
+	}
+	if _, _, err := helper.Get("https://missing.docker.io#first"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found for a missing server URL, actual: %v", err)
+	}
+	if _, _, err := helper.Get(serverURL + "#../first"); err == nil {
+		t.Error("expected an invalid username to be rejected")
+	}
+}
+
+func TestGopassRetry(t *testing.T) {
+	dir := t.TempDir()
+	// The stub fails the first two inserts as if another git process held
+	// the index lock.
+	stub := newStubGopass(t, overrideStub("insert", `	attempts="`+dir+`/attempts"
+	echo x >> "$attempts"
+	if [ "$(wc -l < "$attempts")" -le 2 ]; then
+		echo "fatal: Unable to create '.git/index.lock': File exists." >&2
+		exit 1
+	fi
+	mkdir -p "$(dirname "$store/$target")" && cat > "$store/$target.gpg"`))
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://retry.docker.io",
+		Username:  "retry-username",
+		Secret:    "retry-password",
+	}
+
+	if err := New().Add(creds); !strings.Contains(fmt.Sprint(err), "index.lock") {
+		t.Fatalf("expected no retries by default, actual: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "attempts")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(gopassRetriesEnv, "2")
+	t.Setenv(gopassRetryDelayEnv, "1ms")
+	if err := New().Add(creds); err != nil {
+		t.Fatalf("expected the insert to be retried: %v", err)
+	}
+	if _, s, err := New().Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Errorf("expected %s, actual: %s, %v", creds.Secret, s, err)
+	}
+
+	inserts := 0
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "insert ") {
+			inserts++
+		}
+	}
+	if inserts != 4 {
+		t.Errorf("expected 4 inserts, actual: %d", inserts)
+	}
+}
+
+func TestGopassSecretWhitespace(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	for _, secret := range []string{
+		"ends-with-space ",
+		" starts-with-space",
+		"-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		"first\r\nsecond\r\n",
+		"trailing-newlines\n\n",
+	} {
+		creds := &credentials.Credentials{
+			ServerURL: "https://whitespace.docker.io",
+			Username:  "whitespace-username",
+			Secret:    secret,
+		}
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, s, err := helper.Get(creds.ServerURL); err != nil || s != secret {
+			t.Errorf("expected %q, actual: %q, %v", secret, s, err)
+		}
+		if all, err := helper.GetAll(creds.ServerURL); err != nil || all[creds.Username] != secret {
+			t.Errorf("expected %q, actual: %q, %v", secret, all[creds.Username], err)
+		}
+		if c, _, err := helper.GetWithMetadata(creds.ServerURL); err != nil || c.Secret != secret {
+			t.Errorf("expected %q, actual: %+v, %v", secret, c, err)
+		}
+	}
+
+	// Multi-line secrets are kept on a single line of the gopass secret.
+	encoded := base64.URLEncoding.EncodeToString([]byte("https://whitespace.docker.io"))
+	content, err := os.ReadFile(filepath.Join(stub.store, GOPASS_FOLDER, encoded, "whitespace-username.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "\n"+metadataSecretEncoding+": "+secretEncodingBase64+"\n") {
+		t.Errorf("expected the secret to be base64 encoded, actual: %q", content)
+	}
+
+	if err := helper.AddWithMetadata(&credentials.Credentials{
+		ServerURL: "https://whitespace.docker.io",
+		Username:  "whitespace-username",
+		Secret:    "secret",
+	}, map[string]string{metadataSecretEncoding: "none"}); err == nil {
+		t.Error("expected the secret encoding metadata key to be reserved")
+	}
+}
+
+func TestGopassListPaths(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassMountEnv, "team")
+	helper := New()
+
+	all := map[string]string{
+		"https://one.docker.io/v1": "one-username",
+		"https://two.docker.io":    "two-username",
+	}
+	for serverURL, username := range all {
+		if err := helper.Add(&credentials.Credentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{".git", "not base64!"} {
+		if err := os.MkdirAll(filepath.Join(stub.store, "team", GOPASS_FOLDER, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := helper.ListPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(all) {
+		t.Fatalf("expected %d paths, actual: %v", len(all), paths)
+	}
+	for serverURL, username := range all {
+		encoded := base64.URLEncoding.EncodeToString([]byte(serverURL))
+		expected := "team/" + GOPASS_FOLDER + "/" + encoded + "/" + username
+		if paths[serverURL] != expected {
+			t.Errorf("expected %s for %s, actual: %s", expected, serverURL, paths[serverURL])
+		}
+
+		// The path can be shown as is.
+		if _, err := helper.runGopass("", "show", "-o", paths[serverURL]); err != nil {
+			t.Errorf("unable to show %s: %v", paths[serverURL], err)
+		}
+	}
+}
+
+// stubGpgKeys is a stand-in for gpg only knowing the keys listed in
+// @DIR@/keys.
+const stubGpgKeys = `#!/bin/sh
+for key in "$@"; do :; done
+if ! grep -qx "$key" "@DIR@/keys"; then
+	echo "gpg: error reading key: No public key" >&2
+	exit 2
+fi
+`
+
+func TestGopassRecipients(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("fsck", `if [ -e "$store/.fsck-fails" ]; then echo "fsck failed" >&2; exit 1; fi`))
+	t.Setenv(gopassMountEnv, "team")
+
+	oldGpg := gpgProgram
+	t.Cleanup(func() { gpgProgram = oldGpg })
+	gpgProgram = filepath.Join(dir, "gpg")
+	if err := os.WriteFile(gpgProgram, []byte(strings.ReplaceAll(stubGpgKeys, "@DIR@", dir)), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys"), []byte("0xAAAA\n0xBBBB\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://recipients.docker.io",
+		Username:  "recipients-username",
+		Secret:    "recipients-password",
+	}
+
+	if err := New(WithRecipients("0xAAAA", "0xCCCC")).Add(creds); err == nil || !strings.Contains(err.Error(), "0xCCCC") {
+		t.Fatalf("expected unknown recipient to be rejected, actual: %v", err)
+	}
+	gpgID := filepath.Join(stub.store, "team", GOPASS_FOLDER, ".gpg-id")
+	if _, err := os.Stat(gpgID); !os.IsNotExist(err) {
+		t.Fatalf("expected no recipients to be written, actual: %v", err)
+	}
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "insert ") {
+			t.Fatalf("expected the store not to be modified, calls: %q", stub.calls(t))
+		}
+	}
+
+	t.Setenv(gopassRecipientsEnv, "0xAAAA, 0xBBBB")
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(gpgID); err != nil || string(b) != "0xAAAA\n0xBBBB\n" {
+		t.Errorf("expected the recipients to be written to the credentials folder, actual: %q, %v", b, err)
+	}
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "fsck ") {
+			t.Errorf("expected no credentials to be re-encrypted in a new folder, calls: %q", stub.calls(t))
+		}
+	}
+
+	// The recipients of the credentials folder are only written once, and
+	// those of the store are never changed.
+	t.Setenv(gopassRecipientsEnv, "0xBBBB")
+	creds.Username = "other-username"
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(gpgID); err != nil || string(b) != "0xAAAA\n0xBBBB\n" {
+		t.Errorf("expected the recipients to be left in place, actual: %q, %v", b, err)
+	}
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "recipients ") {
+			t.Errorf("expected the recipients of the store to be left untouched, calls: %q", stub.calls(t))
+		}
+	}
+
+	usernames, err := New().GetAll(creds.ServerURL)
+	if err != nil || len(usernames) != 2 {
+		t.Errorf("expected the .gpg-id file not to be listed, actual: %v, %v", usernames, err)
+	}
+
+	// Credentials stored before the recipients are written are re-encrypted
+	// for them through gopass.
+	if err := os.Remove(gpgID); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stub.store, ".fsck-fails"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New().Add(creds); err == nil || !strings.Contains(err.Error(), "fsck failed") {
+		t.Fatalf("expected the failed re-encryption to be reported, actual: %v", err)
+	}
+	if _, err := os.Stat(gpgID); !os.IsNotExist(err) {
+		t.Errorf("expected the recipients to be removed after the failed re-encryption, actual: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(stub.store, ".fsck-fails")); err != nil {
+		t.Fatal(err)
+	}
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(gpgID); err != nil || string(b) != "0xBBBB\n" {
+		t.Errorf("expected the recipients to be written to the credentials folder, actual: %q, %v", b, err)
+	}
+	if calls := stub.calls(t); !containsCall(calls, "fsck --decrypt team/"+GOPASS_FOLDER) {
+		t.Errorf("expected the credentials folder to be re-encrypted, calls: %q", calls)
+	}
+}
+
+func TestGopassDirInvalid(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, output := range map[string]string{
+		"empty":   "",
+		"missing": filepath.Join(dir, "missing"),
+		"file":    file,
+	} {
+		t.Run(name, func(t *testing.T) {
+			newStubGopass(t, overrideStub("config", "\techo '"+output+"'"))
+			helper := New()
+
+			if _, err := helper.List(); err == nil {
+				t.Error("expected List to fail")
+			}
+			_, _, err := helper.Get("https://stub.docker.io")
+			if err == nil || credentials.IsErrCredentialsNotFound(err) {
+				t.Errorf("expected Get to fail, actual: %v", err)
+			}
+		})
+	}
+}
+
+func TestGopassCRLFOutput(t *testing.T) {
+	// The stub frames every line it prints with "\r\n", as gopass does on
+	// Windows.
+	newStubGopass(t, overrideStub("show", `	sed 's/$/\r/' "$store/$target.gpg"`))
+	defer func(orig bool) { crlfOutput = orig }(crlfOutput)
+	crlfOutput = true
+
+	for i, secret := range []string{"plain-secret", "trailing-space ", "carriage\rreturn\r", "first\r\nsecond\r\n"} {
+		serverURL := fmt.Sprintf("https://crlf.docker.io/%d", i)
+		if err := New().Add(&credentials.Credentials{ServerURL: serverURL, Username: "foo", Secret: secret}); err != nil {
+			t.Fatal(err)
+		}
+
+		username, actual, err := New().Get(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "foo" || actual != secret {
+			t.Errorf("expected %q to round-trip, actual: %q for %q", secret, actual, username)
+		}
+
+		_, metadata, err := New().GetWithMetadata(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata[metadataServerURL] != serverURL {
+			t.Errorf("expected the server url metadata to be %q, actual: %q", serverURL, metadata[metadataServerURL])
+		}
+	}
+}
+
+func TestGopassHas(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://present.docker.io",
+		Username:  "present-username",
+		Secret:    "present-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	empty := base64.URLEncoding.EncodeToString([]byte("https://empty.docker.io"))
+	if err := os.MkdirAll(filepath.Join(stub.store, GOPASS_FOLDER, empty), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	for serverURL, expected := range map[string]bool{
+		creds.ServerURL:            true,
+		"https://absent.docker.io": false,
+		"https://empty.docker.io":  false,
+	} {
+		ok, err := helper.Has(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("expected Has(%s) to be %t", serverURL, expected)
+		}
+	}
+
+	if _, err := helper.Has(""); err == nil {
+		t.Error("expected a missing server URL to be rejected")
+	}
+	for _, call := range stub.calls(t) {
+		if strings.HasPrefix(call, "show ") {
+			t.Errorf("expected no secret to be shown, calls: %q", stub.calls(t))
+		}
+	}
+}
+
+func TestGopassMultipleUsernamesSelection(t *testing.T) {
+	newStubGopass(t, stubScript)
+
+	var logged []string
+	helper := New(WithLogger(func(msg string, keyvals ...interface{}) {
+		logged = append(logged, fmt.Sprintln(append([]interface{}{msg}, keyvals...)...))
+	}))
+
+	serverURL := "https://multiple.docker.io"
+	// "alice-admin.gpg" sorts before "alice.gpg" on disk.
+	for _, username := range []string{"alice-admin", "alice"} {
+		if err := helper.Add(&credentials.Credentials{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		u, s, err := helper.Get(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != "alice" || s != "alice-secret" {
+			t.Errorf("expected alice/alice-secret, actual: %s/%s", u, s)
+		}
+
+		list, err := helper.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list[serverURL] != "alice" {
+			t.Errorf("expected alice to be listed, actual: %v", list)
+		}
+	}
+
+	var warned bool
+	for _, line := range logged {
+		if strings.HasPrefix(line, "multiple usernames") && strings.Contains(line, serverURL) {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("expected multiple usernames to be logged, logged: %q", logged)
+	}
+}
+
+func TestGopassField(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	serverURL := "https://field.docker.io"
+	encoded := base64.URLEncoding.EncodeToString([]byte(serverURL))
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, encoded)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	content := "account password\nurl: https://field.docker.io\ntoken: field-token\n"
+	if err := os.WriteFile(filepath.Join(dir, "field-username.gpg"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, s, err := New().Get(serverURL); err != nil || s != "account password" {
+		t.Errorf("expected the first line by default, actual: %q, %v", s, err)
+	}
+
+	for name, helper := range map[string]*Gopass{
+		"option":      New(WithField("token")),
+		"environment": New(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if name == "environment" {
+				t.Setenv(gopassFieldEnv, "token")
+			}
+			u, s, err := helper.Get(serverURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u != "field-username" || s != "field-token" {
+				t.Errorf("expected field-username/field-token, actual: %s/%s", u, s)
+			}
+		})
+	}
+	if !containsCall(stub.calls(t), "show "+GOPASS_FOLDER+"/"+encoded+"/field-username token") {
+		t.Errorf("expected the field to be shown, calls: %q", stub.calls(t))
+	}
+
+	if _, _, err := New(WithField("missing")).Get(serverURL); err == nil {
+		t.Error("expected a missing field to fail")
+	}
+	if _, _, err := New(WithField("--clip")).Get(serverURL); err == nil {
+		t.Error("expected an invalid field to be rejected")
+	}
+}
+
+func TestGopassDeleteVerified(t *testing.T) {
+	stub := newStubGopass(t, overrideStub("rm", "\t:"))
+	helper := New()
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://leftover.docker.io",
+		Username:  "leftover-username",
+		Secret:    "leftover-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := helper.Delete(creds.ServerURL); err == nil || !strings.Contains(err.Error(), creds.ServerURL) {
+		t.Errorf("expected the leftover credentials to be reported, actual: %v", err)
+	}
+	if !containsCall(stub.calls(t), "rm -rf "+GOPASS_FOLDER+"/"+base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))) {
+		t.Errorf("expected rm to be called, calls: %q", stub.calls(t))
+	}
+
+	if err := helper.Delete("https://missing.docker.io"); err != nil {
+		t.Errorf("expected deleting missing credentials to succeed: %v", err)
+	}
+}
+
+func TestGopassInitCheckScoped(t *testing.T) {
+	dir := t.TempDir()
+	// The stub fails to list missing folders like gopass, and the whole
+	// store once broken.
+	stub := newStubGopass(t, overrideStub("ls", `	if [ -f "`+dir+`/broken" ]; then
+		echo "gpg-agent is gone" >&2
+		exit 2
+	fi
+	if [ "$target" != "" ] && [ ! -d "$store/$target" ]; then
+		echo "Error: $target is not in the password store" >&2
+		exit 1
+	fi`))
+
+	folderCall := "ls --flat " + GOPASS_FOLDER
+	countCalls := func(call string) int {
+		n := 0
+		for _, c := range stub.calls(t) {
+			if c == call {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("empty store", func(t *testing.T) {
+		if err := New().checkInitialized(); err != nil {
+			t.Fatal(err)
+		}
+		if countCalls(folderCall) != 1 || countCalls("ls --flat") != 1 {
+			t.Errorf("expected the whole store to be listed, calls: %q", stub.calls(t))
+		}
+	})
+
+	t.Run("populated folder", func(t *testing.T) {
+		if err := os.MkdirAll(filepath.Join(stub.store, GOPASS_FOLDER), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := New().checkInitialized(); err != nil {
+			t.Fatal(err)
+		}
+		if countCalls(folderCall) != 2 || countCalls("ls --flat") != 1 {
+			t.Errorf("expected only the folder to be listed, calls: %q", stub.calls(t))
+		}
+
+		if err := New(WithFullInitCheck()).checkInitialized(); err != nil {
+			t.Fatal(err)
+		}
+		if countCalls(folderCall) != 2 || countCalls("ls --flat") != 2 {
+			t.Errorf("expected the whole store to be listed, calls: %q", stub.calls(t))
+		}
+	})
+
+	t.Run("failing gopass", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, "broken"), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := New().checkInitialized(); !errors.Is(err, ErrGopassNotInitialized) {
+			t.Errorf("expected ErrGopassNotInitialized, actual: %v", err)
+		}
+		if err := New().HealthCheck(); err == nil {
+			t.Error("expected the health check to fail")
+		}
+	})
+}
+
+func TestGopassMove(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	oldServerURL, newServerURL := "https://old.registry.example.com", "https://new.registry.example.com"
+	for _, username := range []string{"alice", "bob"} {
+		if err := helper.AddWithMetadata(&credentials.Credentials{
+			ServerURL: oldServerURL,
+			Username:  username,
+			Secret:    username + "-secret",
+		}, map[string]string{"note": username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := helper.Move(oldServerURL, newServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := helper.GetAll(newServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["alice"] != "alice-secret" || all["bob"] != "bob-secret" {
+		t.Errorf("expected both usernames to be moved, actual: %v", all)
+	}
+	creds, metadata, err := helper.GetWithMetadata(newServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != "alice" || metadata[metadataServerURL] != newServerURL || metadata["note"] != "alice" {
+		t.Errorf("expected the metadata to be preserved, actual: %v", metadata)
+	}
+
+	if _, _, err := helper.Get(oldServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected the old credentials to be gone, actual: %v", err)
+	}
+	oldDir := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(oldServerURL)))
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("expected the old folder to be removed, actual: %v", err)
+	}
+
+	if err := helper.Move("https://missing.docker.io", newServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found, actual: %v", err)
+	}
+}
+
+func TestGopassMoveConflict(t *testing.T) {
+	newStubGopass(t, stubScript)
+	helper := New()
+
+	oldServerURL, newServerURL := "https://old.registry.example.com", "https://new.registry.example.com"
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: oldServerURL, Username: "alice", Secret: "old-alice-secret"},
+		{ServerURL: oldServerURL, Username: "bob", Secret: "old-bob-secret"},
+		{ServerURL: newServerURL, Username: "bob", Secret: "new-bob-secret"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := helper.Move(oldServerURL, newServerURL); err == nil || !strings.Contains(err.Error(), "bob") {
+		t.Fatalf("expected a conflict for bob, actual: %v", err)
+	}
+
+	for serverURL, expected := range map[string]map[string]string{
+		oldServerURL: {"alice": "old-alice-secret", "bob": "old-bob-secret"},
+		newServerURL: {"bob": "new-bob-secret"},
+	} {
+		all, err := helper.GetAll(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(all) != fmt.Sprint(expected) {
+			t.Errorf("expected %v to be left in place for %s, actual: %v", expected, serverURL, all)
+		}
+	}
+}
+
+func TestReadableServerURLEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		serverURL, name string
+	}{
+		{"https://registry.example.com:5000/v1/", "https%3A~~registry.example.com%3A5000~v1~"},
+		{"registry.example.com", "registry.example.com"},
+		{"localhost:5000", "localhost%3A5000"},
+		{"nasa", "%6Easa"},
+		{".hidden", "%2Ehidden"},
+		{"https://user@host/a b/%7E~", "https%3A~~user%40host~a%20b~%257E%7E"},
+		{"ünïcode.example.com", "%C3%BCn%C3%AFcode.example.com"},
+	} {
+		name := encodeReadable(tc.serverURL)
+		if name != tc.name {
+			t.Errorf("expected %s to be encoded as %s, actual: %s", tc.serverURL, tc.name, name)
+		}
+		if serverURL, err := DecodeServerURL(name); err != nil || serverURL != tc.serverURL {
+			t.Errorf("expected %s to decode to %s, actual: %s, %v", name, tc.serverURL, serverURL, err)
+		}
+	}
+
+	for _, name := range []string{"%6easa", "a%2Fb", "a/b~", "%zz.", "a~%2E"} {
+		if serverURL, err := DecodeServerURL(name); err == nil {
+			t.Errorf("expected non-canonical %s not to decode, actual: %s", name, serverURL)
+		}
+	}
+}
+
+func TestGopassReadablePaths(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	legacy := &credentials.Credentials{
+		ServerURL: "https://legacy.docker.io/v1",
+		Username:  "legacy-username",
+		Secret:    "legacy-password",
+	}
+	if err := New().Add(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(gopassReadablePathsEnv, "1")
+	helper := New()
+	creds := &credentials.Credentials{
+		ServerURL: "https://registry.example.com:5000/v1",
+		Username:  "readable-username",
+		Secret:    "readable-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(stub.store, GOPASS_FOLDER, "https%3A~~registry.example.com%3A5000~v1", creds.Username+".gpg")
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("expected the credentials to be stored under a readable name: %v", err)
+	}
+
+	if _, s, err := helper.Get(creds.ServerURL); err != nil || s != creds.Secret {
+		t.Errorf("expected %s, actual: %s, %v", creds.Secret, s, err)
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[creds.ServerURL] != creds.Username || list[legacy.ServerURL] != legacy.Username {
+		t.Errorf("expected both layouts to be listed, actual: %v", list)
+	}
+}
+
+func TestGopassListRawServerURLs(t *testing.T) {
+	serverURLs := []string{
+		"https://Registry.Example.com:5000/v2/team/",
+		"http://localhost:5000",
+		"registry.example.com:443/path/with%20space",
+		"https://index.docker.io/v1/",
+		"https://[::1]:5000/nested/path?query=1",
+	}
+
+	for _, readable := range []string{"", "1"} {
+		t.Run("readable="+readable, func(t *testing.T) {
+			newStubGopass(t, stubScript)
+			t.Setenv(gopassReadablePathsEnv, readable)
+			helper := New()
+
+			for i, serverURL := range serverURLs {
+				creds := &credentials.Credentials{ServerURL: serverURL, Username: fmt.Sprintf("user-%d", i), Secret: "secret"}
+				if err := helper.Add(creds); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			list, err := helper.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(serverURLs) {
+				t.Errorf("expected %d server URLs, actual: %q", len(serverURLs), list)
+			}
+			for i, serverURL := range serverURLs {
+				if list[serverURL] != fmt.Sprintf("user-%d", i) {
+					t.Errorf("expected %q to be listed as given, actual: %q", serverURL, list)
+				}
+			}
+		})
+	}
+}
+
+func TestGopassListServers(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://b.docker.io", Username: "alice", Secret: "b-alice"},
+		{ServerURL: "https://b.docker.io", Username: "bob", Secret: "b-bob"},
+		{ServerURL: "https://a.docker.io:5000/v2", Username: "alice", Secret: "a-alice"},
+		{ServerURL: "https://c.docker.io/" + strings.Repeat("long/", 60), Username: "alice", Secret: "hashed"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"not-encoded", ".git"} {
+		if err := os.MkdirAll(filepath.Join(stub.store, GOPASS_FOLDER, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv(gopassReadablePathsEnv, "1")
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://readable.docker.io", Username: "alice", Secret: "readable"}); err != nil {
+		t.Fatal(err)
+	}
+
+	serverURLs, err := helper.ListServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://a.docker.io:5000/v2", "https://b.docker.io", "https://readable.docker.io"}
+	if strings.Join(serverURLs, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %q, actual %q", expected, serverURLs)
+	}
+}
+
+func TestGopassListByPrefix(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://registry.example.com/team-a", Username: "alice", Secret: "team-a"},
+		{ServerURL: "https://registry.example.com/team-b", Username: "bob", Secret: "team-b"},
+		{ServerURL: "https://registry.example.com.evil.io", Username: "mallory", Secret: "evil"},
+		{ServerURL: "https://other.example.com", Username: "carol", Secret: "other"},
+		{ServerURL: "https://registry.example.com/" + strings.Repeat("long/", 60), Username: "dave", Secret: "hashed"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(stub.store, GOPASS_FOLDER, "not-encoded"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := helper.ListByPrefix("https://registry.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 ||
+		servers["https://registry.example.com/team-a"] != "alice" ||
+		servers["https://registry.example.com/team-b"] != "bob" ||
+		servers["https://registry.example.com/"+strings.Repeat("long/", 60)] != "dave" {
+		t.Errorf("expected only the servers under the prefix, actual: %v", servers)
+	}
+
+	if servers, err := helper.ListByPrefix("https://missing.example.com"); err != nil || len(servers) != 0 {
+		t.Errorf("expected no servers, actual: %v, %v", servers, err)
+	}
+	all, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, err := helper.ListByPrefix(""); err != nil || len(servers) != len(all) {
+		t.Errorf("expected an empty prefix to list every server, actual: %v, %v", servers, err)
+	}
+}
+
+func TestGopassListInvalidUTF8(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	var skipped []string
+	helper := New(WithLogger(func(msg string, keyvals ...interface{}) {
+		if strings.HasSuffix(msg, " skipped") {
+			skipped = append(skipped, fmt.Sprint(keyvals...))
+		}
+	}))
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://valid.docker.io", Username: "alice", Secret: "alice-secret"},
+		{ServerURL: "https://mixed.docker.io", Username: "bob", Secret: "bob-secret"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	folder := filepath.Join(stub.store, GOPASS_FOLDER)
+	for _, p := range []string{
+		filepath.Join(folder, "caf\xe9%3A~~latin1", "carol.gpg"),
+		filepath.Join(folder, EncodeServerURL("https://mixed.docker.io"), "\xff\xfeuser.gpg"),
+		filepath.Join(folder, EncodeServerURL("https://invalid.docker.io"), "d\xe4ve.gpg"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("secret\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list["https://valid.docker.io"] != "alice" || list["https://mixed.docker.io"] != "bob" {
+		t.Errorf("expected the invalid names to be skipped, actual: %q", list)
+	}
+	for serverURL, username := range list {
+		if !utf8.ValidString(serverURL) || !utf8.ValidString(username) {
+			t.Errorf("expected only valid UTF-8 to be listed, actual: %q", list)
+		}
+	}
+	if len(skipped) != 3 || !strings.Contains(strings.Join(skipped, "\n"), "not valid UTF-8") {
+		t.Errorf("expected every skipped name to be logged, actual: %q", skipped)
+	}
+
+	if _, err := DecodeServerURL("caf\xe9%3A~~latin1"); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+		t.Errorf("expected a name that is not valid UTF-8 to be rejected, actual: %v", err)
+	}
+}
+
+func TestGopassAddFailureCleanup(t *testing.T) {
+	dir := t.TempDir()
+	stub := newStubGopass(t, overrideStub("insert", `	mkdir -p "$(dirname "$store/$target")"
+	if [ -f "`+dir+`/fail" ]; then
+		echo "gpg: signal 2 caught" >&2
+		exit 2
+	fi
+	cat > "$store/$target.gpg"`))
+	helper := New()
+
+	existing := &credentials.Credentials{ServerURL: "https://existing.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(existing); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://new.docker.io", Username: "foo", Secret: "bar"}); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL("https://new.docker.io"))); !os.IsNotExist(err) {
+		t.Errorf("expected no folder to be left behind by the failed insert: %v", err)
+	}
+
+	if err := helper.Add(&credentials.Credentials{ServerURL: existing.ServerURL, Username: "baz", Secret: "qux"}); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+	if _, secret, err := helper.Get(existing.ServerURL); err != nil || secret != "bar" {
+		t.Errorf("expected the folder of stored credentials to be kept, actual %q, %v", secret, err)
+	}
+	if list, err := helper.List(); err != nil || len(list) != 1 {
+		t.Errorf("expected only the stored credentials to be listed, actual: %v, %v", list, err)
+	}
+}
+
+func TestGopassStableUsernames(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	serverURL := "https://stable.docker.io"
+	for _, username := range []string{"zed", "mike", "alice", "bob"} {
+		if err := helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: username, Secret: username + "-secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same username stored by the age backend as well, with every
+	// secret modified at the same time.
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL(serverURL))
+	if err := os.WriteFile(filepath.Join(dir, "mike.age"), []byte("mike-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := os.Chtimes(filepath.Join(dir, entry.Name()), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, h := range []*Gopass{helper, New(WithRecentUsername())} {
+		for i := 0; i < 10; i++ {
+			list, err := h.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list[serverURL] != "alice" {
+				t.Fatalf("expected the first username in alphabetical order, actual: %v", list)
+			}
+			if username, _, err := h.Get(serverURL); err != nil || username != "alice" {
+				t.Fatalf("expected the first username in alphabetical order, actual %s, %v", username, err)
+			}
+		}
+	}
+
+	all, err := helper.GetAll(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 || all["mike"] != "mike-secret" {
+		t.Errorf("expected a username stored by several backends to be reported once, actual: %v", all)
+	}
+}
+
+func TestParseGopassVersion(t *testing.T) {
+	for out, expected := range map[string]string{
+		"gopass 1.15.11 go1.21.5 linux amd64":                                  "1.15.11",
+		"gopass 1.12.0 (cb214897) go1.16 linux amd64":                          "1.12.0",
+		"gopass 1.8.6 (f8181bbb) go1.11.5 linux amd64":                         "1.8.6",
+		"gopass v1.14.0-rc1 go1.18 darwin arm64":                               "1.14.0-rc1",
+		"gopass 1.10.1 (2c7a7f6d) go1.14.2 linux amd64\n\nYour version is old": "1.10.1",
+	} {
+		version, err := parseGopassVersion(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != expected {
+			t.Errorf("expected %s for %q, actual: %s", expected, out, version)
+		}
+	}
+
+	if _, err := parseGopassVersion("gopass (devel)"); err == nil {
+		t.Error("expected an unparsable version to be rejected")
+	}
+
+	for version, ok := range map[string]bool{
+		"1.8.6":      false,
+		"1.9.99":     false,
+		"1.10.0":     true,
+		"1.10.0-rc1": true,
+		"1.15.11":    true,
+		"2.0.0":      true,
+	} {
+		if err := checkGopassVersion(version); (err == nil) != ok {
+			t.Errorf("unexpected result checking %s: %v", version, err)
+		}
+	}
+}
+
+func TestGopassVersion(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	if version, err := New().GopassVersion(); err != nil || version != "1.15.11" {
+		t.Errorf("expected 1.15.11, actual: %s, %v", version, err)
+	}
+
+	if err := os.WriteFile(stub.binary, []byte(strings.ReplaceAll(readFile(t, stub.binary), "gopass 1.15.11", "gopass 1.8.6 (f8181bbb)")), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	err := New().checkInitialized()
+	if err == nil || !strings.Contains(err.Error(), minGopassVersion) {
+		t.Errorf("expected an old gopass to be rejected, actual: %v", err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGopassSecretExtensions(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	for ext, serverURL := range map[string]string{
+		".gpg": "https://gpg.docker.io",
+		".age": "https://age.docker.io",
+		"":     "https://plain.docker.io",
+	} {
+		dir := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(serverURL)))
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range map[string]string{
+			"username" + ext: "secret\n",
+			".gpg-id":        "0xAAAA\n",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("expected 3 server URLs, actual: %v", list)
+	}
+	for serverURL, username := range list {
+		if username != "username" {
+			t.Errorf("expected username for %s, actual: %s", serverURL, username)
+		}
+
+		all, err := helper.GetAll(serverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 {
+			t.Errorf("expected a single username for %s, actual: %v", serverURL, all)
+		}
+	}
+
+	for _, name := range []string{"username.gpg", "username.age", "username"} {
+		if actual := trimSecretExtension(name); actual != "username" {
+			t.Errorf("expected %s to be trimmed to username, actual: %s", name, actual)
+		}
+	}
+	if actual := trimSecretExtension("username.age.gpg"); actual != "username.age" {
+		t.Errorf("expected a single extension to be trimmed, actual: %s", actual)
+	}
+}
+
+func TestParseFlatListing(t *testing.T) {
+	out := strings.Join([]string{
+		"docker-credential-helpers/c2VydmVyLTE/alice",
+		"docker-credential-helpers/c2VydmVyLTE/bob",
+		"docker-credential-helpers/c2VydmVyLTI/nested/carol",
+		"docker-credential-helpers-other/c2VydmVyLTM/dave",
+		"work/docker-credential-helpers/c2VydmVyLTQ/erin",
+		"websites/example.com",
+		"docker-credential-helpers/c2VydmVyLTU/frank\r",
+		"websites/github\r",
+		"",
+	}, "\n")
+
+	for dir, expected := range map[string][]string{
+		"docker-credential-helpers":             {"c2VydmVyLTE/", "c2VydmVyLTI/", "c2VydmVyLTU/"},
+		"docker-credential-helpers/c2VydmVyLTU": {"frank"},
+		"websites/github":                       {},
+		"docker-credential-helpers/c2VydmVyLTE": {"alice", "bob"},
+		"docker-credential-helpers/c2VydmVyLTI": {"nested/"},
+		"work/docker-credential-helpers":        {"c2VydmVyLTQ/"},
+		"missing":                               {},
+	} {
+		var actual []string
+		for _, info := range parseFlatListing(out, dir) {
+			name := info.Name()
+			if info.IsDir() {
+				name += "/"
+			}
+			actual = append(actual, name)
+		}
+		if strings.Join(actual, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %q, actual %q", dir, expected, actual)
+		}
+	}
+}
+
+func TestGopassCLIUsernames(t *testing.T) {
+	stub := newStubGopass(t, overrideStub("ls", `	[ -n "$target" ] || exit 0
+	if [ ! -d "$store/$target" ]; then
+		echo "Error: Entry '$target' not found" >&2
+		exit 11
+	fi
+	cd "$store" && find "$target" -type f ! -name '.*'`))
+
+	// With the plain backend, secret files have no extension, so that a
+	// username ending in ".gpg" cannot be told from its file name.
+	serverURL := "https://plain.docker.io"
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL(serverURL))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"build.gpg": "build-secret\n",
+		"deploy":    "deploy-secret\n",
+		".gpg-id":   "key\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	helper := New(WithCLIUsernames())
+	all, err := helper.GetAll(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["build.gpg"] != "build-secret" || all["deploy"] != "deploy-secret" {
+		t.Errorf("expected the usernames gopass lists, actual: %v", all)
+	}
+	if username, secret, err := helper.Get(serverURL); err != nil || username != "build.gpg" || secret != "build-secret" {
+		t.Errorf("expected the first username gopass lists, actual %s/%s, %v", username, secret, err)
+	}
+	if list, err := helper.List(); err != nil || list[serverURL] != "build.gpg" {
+		t.Errorf("expected %s to be listed with its username, actual: %v, %v", serverURL, list, err)
+	}
+
+	expected := "ls --flat " + GOPASS_FOLDER + "/" + EncodeServerURL(serverURL)
+	if calls := stub.calls(t); !containsCall(calls, expected) {
+		t.Errorf("expected call %q, calls: %q", expected, calls)
+	}
+
+	if _, _, err := helper.Get("https://missing.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected a folder gopass does not find to hold no credentials, actual: %v", err)
+	}
+	if ok, err := helper.Has("https://missing.docker.io"); err != nil || ok {
+		t.Errorf("expected nothing to be stored, actual %v, %v", ok, err)
+	}
+}
+
+func TestGopassCLIListing(t *testing.T) {
+	stub := newStubGopass(t, overrideStub("ls", `	cd "$store" && find . -type f -name '*.gpg' | sed 's|^\./||; s|\.gpg$||'`))
+
+	helper := New(WithCLIListing())
+	creds := &credentials.Credentials{
+		ServerURL: "https://registry.example.com/v1",
+		Username:  "cli-username",
+		Secret:    "cli-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	username, secret, err := helper.Get(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != creds.Username || secret != creds.Secret {
+		t.Fatalf("expected %s/%s, actual %s/%s", creds.Username, creds.Secret, username, secret)
+	}
+
+	// Secrets gopass does not list are not credentials, even when they
+	// exist in the store directory.
+	hidden := filepath.Join(stub.store, GOPASS_FOLDER, "aGlkZGVu")
+	if err := os.MkdirAll(hidden, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hidden, "unlisted"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected only %s to be listed, actual %v", creds.ServerURL, all)
+	}
+	if _, _, err := helper.Get("hidden"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found for unlisted secrets, actual: %v", err)
+	}
+
+	if err := helper.Delete(creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get(creds.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Fatalf("expected credentials not found after deleting them, actual: %v", err)
+	}
+}
+
+func TestGopassPathSchemes(t *testing.T) {
+	for _, tc := range []struct {
+		separator string
+		path      string
+	}{
+		{separator: "", path: "aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlLmNvbS92MQ==/scheme-username.gpg"},
+		{separator: "/", path: "aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlLmNvbS92MQ==/scheme-username.gpg"},
+		{separator: "__", path: "aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlLmNvbS92MQ==__scheme-username.gpg"},
+	} {
+		t.Run("separator="+tc.separator, func(t *testing.T) {
+			stub := newStubGopass(t, stubScript)
+			helper := New(WithPathSeparator(tc.separator))
+
+			creds := &credentials.Credentials{
+				ServerURL: "https://registry.example.com/v1",
+				Username:  "scheme-username",
+				Secret:    "scheme-password",
+			}
+			other := &credentials.Credentials{
+				ServerURL: "https://other.example.com",
+				Username:  "other-username",
+				Secret:    "other-password",
+			}
+			for _, c := range []*credentials.Credentials{creds, other} {
+				if err := helper.Add(c); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER, tc.path)); err != nil {
+				t.Fatalf("expected the credentials to be stored at %s: %v", tc.path, err)
+			}
+
+			username, secret, err := helper.Get(creds.ServerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != creds.Username || secret != creds.Secret {
+				t.Fatalf("expected %s/%s, actual %s/%s", creds.Username, creds.Secret, username, secret)
+			}
+
+			all, err := helper.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 2 || all[creds.ServerURL] != creds.Username || all[other.ServerURL] != other.Username {
+				t.Fatalf("unexpected listing: %v", all)
+			}
+
+			if err := helper.Delete(creds.ServerURL); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := helper.Get(creds.ServerURL); !credentials.IsErrCredentialsNotFound(err) {
+				t.Fatalf("expected credentials not found after deleting them, actual: %v", err)
+			}
+			if _, _, err := helper.Get(other.ServerURL); err != nil {
+				t.Fatalf("expected other credentials to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestGopassPathSchemeSplitName(t *testing.T) {
+	scheme := pathScheme{separator: "__"}
+	// base64-url encoded server URLs may contain the separator themselves.
+	encoded := base64.URLEncoding.EncodeToString([]byte("https://a.example.com/??"))
+	if !strings.HasSuffix(encoded, "_") {
+		t.Fatalf("expected %s to end with an underscore", encoded)
+	}
+
+	for name, expected := range map[string][2]string{
+		encoded + "__username":  {encoded, "username"},
+		encoded + "__user__one": {encoded, "user__one"},
+		"aGVsbG8=__username":    {"aGVsbG8=", "username"},
+	} {
+		dir, username, ok := scheme.splitName(name)
+		if !ok || dir != expected[0] || username != expected[1] {
+			t.Errorf("%s: expected %q, actual %q, %q, %v", name, expected, dir, username, ok)
+		}
+	}
+
+	for _, name := range []string{"username", "aGVsbG8=__", "not-encoded__username"} {
+		if _, _, ok := scheme.splitName(name); ok {
+			t.Errorf("%s: expected not to be split", name)
+		}
+	}
+}
+
+func TestGopassPathSeparatorInvalid(t *testing.T) {
+	newStubGopass(t, stubScript)
+
+	for _, sep := range []string{"a/b", `\`, " __", ".sep"} {
+		t.Setenv(gopassPathSeparatorEnv, sep)
+		if _, _, err := New().Get("https://registry.example.com"); err == nil || !strings.Contains(err.Error(), gopassPathSeparatorEnv) {
+			t.Errorf("%q: expected an invalid separator error, actual: %v", sep, err)
+		}
+	}
+}
+
+func TestGopassNonInteractive(t *testing.T) {
+	// The stub fails as gpg does without pinentry, and waits for a
+	// passphrase otherwise.
+	newStubGopass(t, overrideStub("show", `	case "$GOPASS_GPG_OPTS" in
+	*--pinentry-mode=error*)
+		echo "gpg: decryption failed: No pinentry (opts: $GOPASS_GPG_OPTS)" >&2
+		exit 2
+		;;
+	esac
+	sleep 10`))
+	t.Setenv(gopassTimeoutEnv, "5s")
+	t.Setenv(gopassGPGOptsEnv, "--armor")
+	t.Setenv(gopassNonInteractiveEnv, "1")
+
+	creds := &credentials.Credentials{ServerURL: "https://batch.docker.io", Username: "batch-username", Secret: "batch-password"}
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, _, err := New().Get(creds.ServerURL)
+	if !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("expected the passphrase to be reported as required, actual: %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("expected gopass to fail fast, took %v", time.Since(start))
+	}
+	if !strings.Contains(err.Error(), "opts: --armor --batch --pinentry-mode=error") {
+		t.Errorf("expected the gpg options to be preserved, actual: %v", err)
+	}
+
+	t.Setenv(gopassNonInteractiveEnv, "")
+	if !New(WithNonInteractive()).nonInteractive() {
+		t.Error("expected WithNonInteractive to make the helper non-interactive")
+	}
+
+	if runtime.GOOS == "darwin" {
+		return
+	}
+	terminal := false
+	defer func(orig func() bool) { hasTerminal = orig }(hasTerminal)
+	hasTerminal = func() bool { return terminal }
+	t.Setenv(gopassNonInteractiveEnv, "auto")
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+	if !New().nonInteractive() {
+		t.Error("expected the helper to be non-interactive without terminal or display")
+	}
+	terminal = true
+	if New().nonInteractive() {
+		t.Error("expected the helper to be interactive with a terminal")
+	}
+	terminal = false
+	t.Setenv("DISPLAY", ":0")
+	if New().nonInteractive() {
+		t.Error("expected the helper to be interactive with a display")
+	}
+}
+
+func TestGopassIsLocked(t *testing.T) {
+	// While the marker of the store, or of the mount of the secret, exists,
+	// the stub fails as gpg does without pinentry, and waits for a passphrase
+	// unless pinentry is disabled.
+	stub := newStubGopass(t, overrideStub("show", `	if [ -f "@STORE@.locked" ] || [ -f "@STORE@.${target%%/*}.locked" ]; then
+		case "$GOPASS_GPG_OPTS" in
+		*--pinentry-mode=error*)
+			echo "gpg: decryption failed: No pinentry" >&2
+			exit 2
+			;;
+		esac
+		sleep 10
+	fi
+	cat "$store/$target.gpg"`))
+	t.Setenv(gopassTimeoutEnv, "5s")
+	marker := stub.store + ".locked"
+	helper := New()
+
+	if locked, err := helper.IsLocked(); err != nil || locked {
+		t.Fatalf("expected an empty store to need no unlocking, actual: %v, %v", locked, err)
+	}
+
+	creds := &credentials.Credentials{ServerURL: "https://locked.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := helper.IsLocked(); err != nil || locked {
+		t.Fatalf("expected the store to be unlocked, actual: %v, %v", locked, err)
+	}
+
+	if err := os.WriteFile(marker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if locked, err := helper.IsLocked(); err != nil || !locked {
+		t.Fatalf("expected the store to be locked, actual: %v, %v", locked, err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("expected IsLocked not to wait for a passphrase, took %v", time.Since(start))
+	}
+
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := helper.IsLocked(); err != nil || locked {
+		t.Fatalf("expected the store to be unlocked again, actual: %v, %v", locked, err)
+	}
+
+	// The folders of routes are probed as well.
+	routed := New(WithRoute("https://routed.docker.io", "team", ""))
+	if err := routed.Add(&credentials.Credentials{ServerURL: "https://routed.docker.io", Username: "foo", Secret: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stub.store+".team.locked", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := routed.IsLocked(); err != nil || !locked {
+		t.Fatalf("expected the routed mount to be locked, actual: %v, %v", locked, err)
+	}
+	if locked, err := helper.IsLocked(); err != nil || locked {
+		t.Fatalf("expected the store to be unlocked without the route, actual: %v, %v", locked, err)
+	}
+}
+
+func TestGopassListWithMetadata(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	before := time.Now().Truncate(time.Second)
+	stamped := &credentials.Credentials{ServerURL: "https://stamped.docker.io", Username: "foo", Secret: "bar"}
+	if err := New(WithCreatedAt()).Add(stamped); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	unstamped := &credentials.Credentials{ServerURL: "https://unstamped.docker.io", Username: "+b64-bot", Secret: "baz"}
+	if err := New().Add(unstamped); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(unstamped.ServerURL)), usernameName(unstamped.Username)+".gpg")
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := New().ListWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 credentials, actual: %v", infos)
+	}
+
+	info := infos[stamped.ServerURL]
+	if info.ServerURL != stamped.ServerURL || info.Username != stamped.Username {
+		t.Errorf("unexpected credentials for %s: %+v", stamped.ServerURL, info)
+	}
+	if info.CreatedAt.Before(before) || info.CreatedAt.After(after) {
+		t.Errorf("expected the credentials to be created between %v and %v, actual: %v", before, after, info.CreatedAt)
+	}
+
+	info = infos[unstamped.ServerURL]
+	if info.ServerURL != unstamped.ServerURL || info.Username != unstamped.Username {
+		t.Errorf("unexpected credentials for %s: %+v", unstamped.ServerURL, info)
+	}
+	if !info.CreatedAt.Equal(modTime) {
+		t.Errorf("expected the modification time %v to be reported, actual: %v", modTime, info.CreatedAt)
+	}
+
+	_, metadata, err := New().GetWithMetadata(stamped.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metadata[metadataCreatedAt]; !ok {
+		t.Errorf("expected the creation time to be stored, actual: %v", metadata)
+	}
+	if err := New().AddWithMetadata(stamped, map[string]string{metadataCreatedAt: "yesterday"}); err == nil {
+		t.Error("expected the created_at field to be reserved")
+	}
+}
+
+func TestGopassRekey(t *testing.T) {
+	// The stub fails to re-encrypt while the first marker exists, and to
+	// decrypt secrets while the second one does.
+	script := overrideStub("fsck", `	if [ -f "@STORE@.fsck-fails" ]; then
+		echo "failed to re-encrypt secrets" >&2
+		exit 1
+	fi`)
+	script = strings.Replace(script, "fsck)\n", `show)
+	if [ -f "@STORE@.show-fails" ]; then
+		echo "gpg: decryption failed: No secret key" >&2
+		exit 2
+	fi
+	cat "$store/$target.gpg"
+	;;
+fsck)
+`, 1)
+	stub := newStubGopass(t, script)
+	helper := New()
+
+	if err := helper.Rekey(); err != nil {
+		t.Fatalf("expected an empty store to be rekeyed, actual: %v", err)
+	}
+	if calls := stub.calls(t); !containsCall(calls, "fsck --decrypt "+GOPASS_FOLDER) {
+		t.Fatalf("expected the credentials folder to be re-encrypted, actual: %q", calls)
+	}
+
+	creds := &credentials.Credentials{ServerURL: "https://rekey.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(t); !containsCall(calls, "show -n "+GOPASS_FOLDER+"/"+base64.URLEncoding.EncodeToString([]byte(creds.ServerURL))+"/foo") {
+		t.Errorf("expected a credential to be read back, actual: %q", calls)
+	}
+
+	if err := os.WriteFile(stub.store+".fsck-fails", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := helper.Rekey()
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) || !strings.Contains(err.Error(), "unable to re-encrypt the credentials in "+GOPASS_FOLDER) {
+		t.Fatalf("expected the re-encryption failure to be reported, actual: %v", err)
+	}
+
+	if err := os.Remove(stub.store + ".fsck-fails"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stub.store+".show-fails", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Rekey(); err == nil || !strings.Contains(err.Error(), "once re-encrypted") {
+		t.Fatalf("expected the decryption failure to be reported, actual: %v", err)
+	}
+	if err := os.Remove(stub.store + ".show-fails"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The folders of routes are re-encrypted with the store of their mount
+	// locked, and fallback folders are left untouched.
+	routed := New(WithFallbackFolders("legacy"), WithRoute("https://routed.docker.io", "team", ""), WithLockTimeout(200*time.Millisecond))
+	if err := routed.Add(&credentials.Credentials{ServerURL: "https://routed.docker.io", Username: "foo", Secret: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	lock := filepath.Join(stub.store, "team", lockFileName)
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := routed.Rekey(); !errors.Is(err, ErrStoreBusy) {
+		t.Errorf("expected the store of the routed mount to be locked, actual: %v", err)
+	}
+	if err := os.Remove(lock); err != nil {
+		t.Fatal(err)
+	}
+	before := len(stub.calls(t))
+	if err := routed.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls(t)[before:]
+	if !containsCall(calls, "fsck --decrypt "+GOPASS_FOLDER) || !containsCall(calls, "fsck --decrypt team/"+GOPASS_FOLDER) {
+		t.Errorf("expected the credentials and routed folders to be re-encrypted, actual: %q", calls)
+	}
+	if containsCall(calls, "fsck --decrypt legacy") {
+		t.Errorf("expected the fallback folder to be left untouched, actual: %q", calls)
+	}
+
+	if err := New(WithReadOnly()).Rekey(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected read-only helpers not to rekey, actual: %v", err)
+	}
+}
+
+func TestGopassInteractivePrompt(t *testing.T) {
+	// The stub consumes the secret, then asks a question as gopass does,
+	// failing when no answer can be read.
+	newStubGopass(t, overrideStub("insert", `	cat >/dev/null
+	printf 'Recipient not found. Do you want to add one? [y/N]: '
+	read -r answer || exit 1`))
+	t.Setenv(gopassTimeoutEnv, "5s")
+	helper := Gopass{}
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	}
+
+	start := time.Now()
+	err := helper.Add(creds)
+	var gopassErr *GopassError
+	if !errors.As(err, &gopassErr) {
+		t.Fatalf("expected a gopass error, actual: %v", err)
+	}
+	if gopassErr.Prompt != "Recipient not found. Do you want to add one? [y/N]:" {
+		t.Errorf("expected the prompt to be reported, actual: %q", gopassErr.Prompt)
+	}
+	if !strings.Contains(err.Error(), "non-interactively") {
+		t.Errorf("expected the error to explain the prompt, actual: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected gopass to read EOF rather than wait for an answer, took %s", elapsed)
+	}
+}
+
+func TestGopassInteractivePromptTimeout(t *testing.T) {
+	// The stub keeps asking, as a prompt retrying on EOF would.
+	newStubGopass(t, overrideStub("insert", `	while true; do
+		printf 'Overwrite? [y/N]: '
+		read -r answer
+		sleep 0.01
+	done`))
+	t.Setenv(gopassTimeoutEnv, "100ms")
+	helper := Gopass{}
+
+	err := helper.Add(&credentials.Credentials{
+		ServerURL: "https://stub.docker.io/v1",
+		Username:  "stub-username",
+		Secret:    "stub-password",
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, actual: %v", err)
+	}
+	if !strings.Contains(err.Error(), `waiting for an answer to "Overwrite? [y/N]:"`) {
+		t.Errorf("expected the error to name the prompt, actual: %v", err)
+	}
+}
+
+func TestGopassHomedir(t *testing.T) {
+	// gopass reports store paths relative to its home directory.
+	stub := newStubGopass(t, overrideStub("config", `	[ -n "$GOPASS_HOMEDIR" ] || exit 1
+	echo "~/store"`))
+	t.Setenv(gopassHomedirEnv, filepath.Dir(stub.store))
+	helper := New()
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://homedir.docker.io",
+		Username:  "homedir-username",
+		Secret:    "homedir-password",
+	}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[creds.ServerURL] != creds.Username {
+		t.Fatalf("expected %s to be listed from the store below GOPASS_HOMEDIR, actual: %v", creds.ServerURL, all)
+	}
+
+	// Switching the home directory switches the store.
+	t.Setenv(gopassHomedirEnv, t.TempDir())
+	if _, err := helper.List(); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("expected the store below the new GOPASS_HOMEDIR to be used, actual: %v", err)
+	}
+}
+
+func TestGopassDirFallback(t *testing.T) {
+	newStubGopass(t, overrideStub("config", `	[ "$GOPASS_CONFIG_EMPTY" = "1" ] && exit 0
+	echo "unknown key" >&2
+	exit 1`))
+
+	homedir, home := t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(gopassHomedirEnv, homedir)
+	t.Setenv(xdgDataHomeEnv, "")
+	homedirStore := filepath.Join(homedir, defaultStoreDir)
+	homeStore := filepath.Join(home, defaultStoreDir)
+
+	gopassDir := func() (string, string, error) {
+		var source string
+		helper := New(WithLogger(func(msg string, keyvals ...interface{}) {
+			if msg == "gopass store directory resolved" {
+				source = fmt.Sprint(keyvals[1])
+			}
+		}))
+		dir, err := helper.getGopassDir()
+		return dir, source, err
+	}
+
+	if _, _, err := gopassDir(); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("expected the lookup to fail without a default store, actual: %v", err)
+	}
+
+	if err := os.MkdirAll(homeStore, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if dir, source, err := gopassDir(); err != nil || dir != homeStore || source != "default store location" {
+		t.Errorf("expected the default store location to be used, actual: %s (%s), %v", dir, source, err)
+	}
+
+	if err := os.MkdirAll(homedirStore, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, empty := range []string{"", "1"} {
+		t.Setenv("GOPASS_CONFIG_EMPTY", empty)
+		if dir, source, err := gopassDir(); err != nil || dir != homedirStore || source != gopassHomedirEnv {
+			t.Errorf("expected the store below GOPASS_HOMEDIR to be preferred, actual: %s (%s), %v", dir, source, err)
+		}
+	}
+
+	// Mounts have no default location.
+	t.Setenv(gopassMountEnv, "work")
+	if _, _, err := gopassDir(); err == nil {
+		t.Error("expected the lookup of a mount to fail")
+	}
+}
+
+func TestGopassDirFallbackXDG(t *testing.T) {
+	newStubGopass(t, overrideStub("config", `	echo "unknown key" >&2
+	exit 1`))
+
+	home, data := t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(gopassHomedirEnv, "")
+	homeStore := filepath.Join(home, defaultStoreDir)
+	dataStore := filepath.Join(data, "gopass", "stores", "root")
+	for _, dir := range []string{homeStore, dataStore} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		dataHome string
+		expected string
+	}{
+		{data, dataStore},
+		{"", homeStore},
+		{"relative/data", homeStore},
+	} {
+		t.Setenv(xdgDataHomeEnv, c.dataHome)
+		if dir, err := New().getGopassDir(); err != nil || dir != c.expected {
+			t.Errorf("expected %s with %s=%q, actual: %s, %v", c.expected, xdgDataHomeEnv, c.dataHome, dir, err)
+		}
+	}
+
+	// XDG_DATA_HOME does not fall back to the home directory.
+	t.Setenv(xdgDataHomeEnv, t.TempDir())
+	if _, err := New().getGopassDir(); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("expected the lookup to fail without a store below %s, actual: %v", xdgDataHomeEnv, err)
+	}
+
+	// GOPASS_HOMEDIR takes precedence over XDG_DATA_HOME.
+	homedir := t.TempDir()
+	homedirStore := filepath.Join(homedir, defaultStoreDir)
+	if err := os.MkdirAll(homedirStore, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(gopassHomedirEnv, homedir)
+	t.Setenv(xdgDataHomeEnv, data)
+	if dir, err := New().getGopassDir(); err != nil || dir != homedirStore {
+		t.Errorf("expected %s to be preferred, actual: %s, %v", homedirStore, dir, err)
+	}
+}
+
+func TestGopassCount(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	if count, err := helper.Count(); err != nil || count != 0 {
+		t.Fatalf("expected an empty store to hold no credentials, actual: %d, %v", count, err)
+	}
+
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: "https://one.docker.io", Username: "alice", Secret: "secret"},
+		{ServerURL: "https://two.docker.io", Username: "alice", Secret: "secret"},
+		{ServerURL: "https://two.docker.io", Username: "bob", Secret: "secret"},
+		{ServerURL: "https://three.docker.io", Username: "alice", Secret: "secret"},
+		{ServerURL: "https://three.docker.io", Username: "bob", Secret: "secret"},
+		{ServerURL: "https://three.docker.io", Username: "carol", Secret: "secret"},
+	} {
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Folders that were not created by the helper, and hidden files, are
+	// not credentials.
+	folder := filepath.Join(stub.store, GOPASS_FOLDER)
+	if err := os.MkdirAll(filepath.Join(folder, "not-base64!"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "not-base64!", "user.gpg"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, base64.URLEncoding.EncodeToString([]byte("https://one.docker.io")), ".gpg-id"), []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(stub.calls(t))
+	count, err := helper.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Errorf("expected 6 credentials, actual: %d", count)
+	}
+	for _, call := range stub.calls(t)[before:] {
+		if strings.HasPrefix(call, "show") {
+			t.Errorf("expected nothing to be decrypted, calls: %q", stub.calls(t)[before:])
+		}
+	}
+}
+
+func TestGopassNoOverwrite(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://overwrite.docker.io",
+		Username:  "overwrite-username",
+		Secret:    "first-password",
+	}
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting is the default.
+	creds.Secret = "second-password"
+	if err := New().Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, secret, err := New().Get(creds.ServerURL); err != nil || secret != "second-password" {
+		t.Fatalf("expected the secret to be overwritten, actual: %s, %v", secret, err)
+	}
+
+	helper := New(WithNoOverwrite())
+	creds.Secret = "third-password"
+	if err := helper.Add(creds); !errors.Is(err, ErrCredentialsExist) {
+		t.Fatalf("expected credentials exist, actual: %v", err)
+	}
+	if _, secret, err := helper.Get(creds.ServerURL); err != nil || secret != "second-password" {
+		t.Fatalf("expected the secret to be protected, actual: %s, %v", secret, err)
+	}
+
+	other := &credentials.Credentials{
+		ServerURL: creds.ServerURL,
+		Username:  "other-username",
+		Secret:    "other-password",
+	}
+	if err := helper.Add(other); err != nil {
+		t.Fatal(err)
+	}
+	calls := stub.calls(t)
+	if last := calls[len(calls)-1]; !strings.HasPrefix(last, "insert ") || strings.Contains(last, " -f ") {
+		t.Errorf("expected the insert not to be forced, actual: %q", last)
+	}
+
+	t.Setenv(gopassNoOverwriteEnv, "1")
+	if err := New().Add(other); !errors.Is(err, ErrCredentialsExist) {
+		t.Errorf("expected %s to protect credentials, actual: %v", gopassNoOverwriteEnv, err)
+	}
+}
+
+func TestGopassErrorsNeverContainSecrets(t *testing.T) {
+	const sentinel = "s3ntinel-secret-value"
+	multiLine := "first-" + sentinel + "\nsecond-" + sentinel
+	// Secrets spanning several lines are sent to gopass base64 encoded.
+	encoded := base64.StdEncoding.EncodeToString([]byte(multiLine))
+
+	// Once the leaky marker exists, the stub fails every command but ls and
+	// config, echoing its input to stderr and stdout as questions, and the
+	// secrets it holds to stdout.
+	dir := t.TempDir()
+	leaky := filepath.Join(dir, "leaky")
+	stub := newStubGopass(t, strings.Replace(stubScript, "case \"$cmd\" in\n", `if [ -f "`+leaky+`" ]; then
+	case "$cmd" in
+	ls|config) ;;
+	show)
+		head -n 1 "$store/$target.gpg" | sed 's/$/ [y\/N]/'
+		exit 1
+		;;
+	*)
+		input="$(cat)"
+		printf '%s\n' "$input" >&2
+		printf '%s\n' "$input" | sed 's/$/ [y\/N]/'
+		exit 1
+		;;
+	esac
+fi
+case "$cmd" in
+`, 1))
+
+	var logged []string
+	helper := New(WithLogger(func(msg string, keyvals ...interface{}) {
+		logged = append(logged, fmt.Sprint(append([]interface{}{msg}, keyvals...)...))
+	}), WithNormalization(false))
+
+	serverURL := "https://sentinel.docker.io"
+	for _, creds := range []*credentials.Credentials{
+		{ServerURL: serverURL, Username: "a-single", Secret: sentinel},
+		{ServerURL: serverURL, Username: "b-multi", Secret: multiLine},
+		{ServerURL: "HTTPS://Unnormalized.docker.io", Username: "a-single", Secret: sentinel},
+	} {
+		if err := New().Add(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(leaky, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := memoryHelper{}
+	_ = src.Add(&credentials.Credentials{ServerURL: "https://import.docker.io", Username: "a-single", Secret: sentinel})
+
+	var errs []error
+	check := func(err error) {
+		errs = append(errs, err)
+	}
+	check(helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: "a-single", Secret: sentinel}))
+	check(helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: "b-multi", Secret: multiLine}))
+	check(helper.AddWithMetadata(&credentials.Credentials{ServerURL: serverURL, Username: "a-single", Secret: sentinel}, map[string]string{"note": "metadata"}))
+	_, _, err := helper.Get(serverURL)
+	check(err)
+	_, _, err = helper.Get(serverURL + "#b-multi")
+	check(err)
+	_, _, err = helper.GetWithMetadata(serverURL)
+	check(err)
+	_, err = helper.GetAll(serverURL)
+	check(err)
+	_, err = helper.Export()
+	check(err)
+	_, err = helper.ImportFrom(src, true)
+	check(err)
+	check(helper.Move(serverURL, "https://moved.docker.io"))
+	_, err = helper.MigrateNormalized()
+	check(err)
+	check(helper.DeleteUser(serverURL, "a-single"))
+	check(helper.Delete(serverURL))
+	check(helper.Sync())
+	_, err = helper.Has(serverURL)
+	check(err)
+	_, err = helper.List()
+	check(err)
+	_, err = helper.ListPaths()
+	check(err)
+	_, err = helper.Count()
+	check(err)
+
+	failures := 0
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		failures++
+		if strings.Contains(err.Error(), sentinel) || strings.Contains(err.Error(), encoded) {
+			t.Errorf("expected the secret to be redacted, actual: %v", err)
+		}
+	}
+	if failures < 10 {
+		t.Errorf("expected the stub to fail most operations, actual errors: %v", errs)
+	}
+	for _, msg := range logged {
+		if strings.Contains(msg, sentinel) || strings.Contains(msg, encoded) {
+			t.Errorf("expected the secret not to be logged, actual: %s", msg)
+		}
+	}
+
+	for _, call := range stub.calls(t) {
+		if strings.Contains(call, sentinel) {
+			t.Errorf("expected the secret never to be passed as an argument, actual: %s", call)
+		}
+	}
+}
+
+func TestGopassListUsernameSelection(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	serverURL := "https://selection.docker.io"
+	for _, username := range []string{"alice", "bot", "carol"} {
+		if err := New().Add(&credentials.Credentials{ServerURL: serverURL, Username: username, Secret: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bot is the most recently modified, alice the least.
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(serverURL)))
+	now := time.Now()
+	for username, age := range map[string]time.Duration{"alice": 3 * time.Hour, "bot": time.Hour, "carol": 2 * time.Hour} {
+		if err := os.Chtimes(filepath.Join(dir, username+".gpg"), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		helper   *Gopass
+		env      map[string]string
+		expected string
+	}{
+		{name: "first", helper: New(), expected: "alice"},
+		{name: "recent", helper: New(WithRecentUsername()), expected: "bot"},
+		{name: "recent env", helper: New(), env: map[string]string{gopassListUsernameEnv: "recent"}, expected: "bot"},
+		{name: "preferred", helper: New(WithPreferredUsernames("dave", "carol")), expected: "carol"},
+		{name: "preferred env", helper: New(), env: map[string]string{gopassPreferredUsernamesEnv: "dave, carol"}, expected: "carol"},
+		{name: "preferred missing", helper: New(WithRecentUsername(), WithPreferredUsernames("dave")), expected: "bot"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			all, err := tc.helper.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := all[serverURL]; actual != tc.expected {
+				t.Errorf("expected %q, actual %q", tc.expected, actual)
+			}
+
+			paths, err := tc.helper.ListPaths()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(paths[serverURL], "/"+tc.expected) {
+				t.Errorf("expected the path of %s, actual %s", tc.expected, paths[serverURL])
+			}
+		})
+	}
+
+	t.Setenv(gopassListUsernameEnv, "newest")
+	if _, err := New().List(); err == nil || !strings.Contains(err.Error(), gopassListUsernameEnv) {
+		t.Errorf("expected an invalid selection to be rejected, actual: %v", err)
+	}
+}
+
+func TestGopassListUsernameSelectionFlat(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithRecentUsername(), WithPathSeparator("__"))
+
+	serverURL := "https://selection.docker.io"
+	for _, username := range []string{"alice", "bob"} {
+		if err := helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: username, Secret: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-time.Hour)
+	p := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(serverURL))+"__bob.gpg")
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[serverURL] != "alice" {
+		t.Errorf("expected alice, actual %q", all[serverURL])
+	}
+}
+
+func TestGopassLongServerURL(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		helper *Gopass
+	}{
+		{name: "nested", helper: New()},
+		{name: "readable", helper: New(WithReadablePaths())},
+		{name: "flat", helper: New(WithPathSeparator("__"))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newStubGopass(t, stubScript)
+			helper := tc.helper
+
+			serverURL := "https://registry.docker.io/" + strings.Repeat("very-long-repository-name/", 10)
+			if len(base64.URLEncoding.EncodeToString([]byte(serverURL))) <= 255 {
+				t.Fatal("expected the encoded server URL to exceed 255 bytes")
+			}
+
+			creds := &credentials.Credentials{ServerURL: serverURL, Username: "foo", Secret: "secret"}
+			if err := helper.Add(creds); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(filepath.Join(stub.store, GOPASS_FOLDER))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), hashedPrefix) || len(entries[0].Name()) > 255 {
+				t.Fatalf("expected credentials stored under a hashed name, actual %v", entries)
+			}
+
+			username, secret, err := helper.Get(serverURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != "foo" || secret != "secret" {
+				t.Errorf("expected foo/secret, actual %s/%s", username, secret)
+			}
+
+			all, err := helper.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if all[serverURL] != "foo" {
+				t.Errorf("expected %s to be listed, actual %v", serverURL, all)
+			}
+
+			count, err := helper.Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 {
+				t.Errorf("expected 1 credential, actual %d", count)
+			}
+
+			if err := helper.Delete(serverURL); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := helper.Get(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+				t.Errorf("expected the credentials to be deleted, actual: %v", err)
+			}
+		})
+	}
+}
+
+func TestGopassPerUser(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	oldUser := currentUser
+	t.Cleanup(func() { currentUser = oldUser })
+	as := func(name string) {
+		currentUser = func() (string, error) { return name, nil }
+	}
+
+	helper := New(WithPerUser())
+	for _, name := range []string{"alice", "bob"} {
+		as(name)
+		creds := &credentials.Credentials{ServerURL: "https://" + name + ".docker.io", Username: name, Secret: name + "-secret"}
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+		if err := helper.Add(&credentials.Credentials{ServerURL: "https://shared.docker.io", Username: name, Secret: name + "-secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		as(name)
+		all, err := helper.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 || all["https://"+name+".docker.io"] != name || all["https://shared.docker.io"] != name {
+			t.Errorf("%s: expected only their own credentials to be listed, actual %v", name, all)
+		}
+
+		username, secret, err := helper.Get("https://shared.docker.io")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != name || secret != name+"-secret" {
+			t.Errorf("%s: expected their own credentials, actual %s/%s", name, username, secret)
+		}
+
+		dir := filepath.Join(stub.store, GOPASS_FOLDER, name, base64.URLEncoding.EncodeToString([]byte("https://shared.docker.io")))
+		if _, err := os.Stat(filepath.Join(dir, name+".gpg")); err != nil {
+			t.Errorf("%s: expected credentials stored in their subfolder: %v", name, err)
+		}
+	}
+
+	as("alice")
+	if err := helper.Delete("https://shared.docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	as("bob")
+	if _, _, err := helper.Get("https://shared.docker.io"); err != nil {
+		t.Errorf("expected the credentials of bob to be kept, actual: %v", err)
+	}
+
+	all, err := New().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected credentials stored per user not to be listed, actual %v", all)
+	}
+
+	t.Setenv(gopassPerUserEnv, "1")
+	if _, _, err := New().Get("https://bob.docker.io"); err != nil {
+		t.Errorf("expected %s to store credentials per user, actual: %v", gopassPerUserEnv, err)
+	}
+
+	as("../alice")
+	if _, err := New().List(); err == nil {
+		t.Error("expected a user name escaping the folder to be rejected")
+	}
+}
+
+func TestGopassPruneParents(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	oldUser := currentUser
+	t.Cleanup(func() { currentUser = oldUser })
+	currentUser = func() (string, error) { return "alice", nil }
+
+	userDir := filepath.Join(stub.store, GOPASS_FOLDER, "alice")
+	for _, c := range []struct {
+		helper *Gopass
+		delete func(h *Gopass, serverURL string) error
+		pruned bool
+	}{
+		{New(WithPerUser()), func(h *Gopass, serverURL string) error { return h.Delete(serverURL) }, false},
+		{New(WithPerUser(), WithPruneParents()), func(h *Gopass, serverURL string) error { return h.Delete(serverURL) }, true},
+		{New(WithPerUser(), WithPruneParents()), func(h *Gopass, serverURL string) error { return h.DeleteUser(serverURL, "foo") }, true},
+	} {
+		for _, serverURL := range []string{"https://one.docker.io", "https://two.docker.io"} {
+			if err := c.helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: "foo", Secret: "bar"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := c.delete(c.helper, "https://one.docker.io"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(userDir); err != nil {
+			t.Errorf("expected the subfolder holding credentials to be kept: %v", err)
+		}
+
+		if err := c.delete(c.helper, "https://two.docker.io"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(userDir); os.IsNotExist(err) != c.pruned {
+			t.Errorf("expected the empty subfolder to be removed: %v, actual: %v", c.pruned, err)
+		}
+		if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER)); err != nil {
+			t.Errorf("expected the configured folder to be kept: %v", err)
+		}
+		if err := os.RemoveAll(userDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGopassCat(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithCat())
+
+	secret := "\x00binary\r\nsecret\n\x00\n\r\n"
+	creds := &credentials.Credentials{ServerURL: "https://cat.docker.io", Username: "foo", Secret: secret}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(creds.ServerURL)), "foo.gpg")
+	if stored := readFile(t, p); stored != secret {
+		t.Errorf("expected the secret to be stored byte for byte, actual %q", stored)
+	}
+
+	username, actual, err := helper.Get(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "foo" || actual != secret {
+		t.Errorf("expected foo/%q, actual %s/%q", secret, username, actual)
+	}
+
+	all, err := helper.GetAll(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all["foo"] != secret {
+		t.Errorf("expected %q, actual %q", secret, all["foo"])
+	}
+
+	t.Setenv(gopassUseCatEnv, "1")
+	if _, actual, err := New().Get(creds.ServerURL); err != nil || actual != secret {
+		t.Errorf("expected %s to read secrets through gopass cat, actual %q: %v", gopassUseCatEnv, actual, err)
+	}
+
+	moved := "https://moved-cat.docker.io"
+	if err := helper.Move(creds.ServerURL, moved); err != nil {
+		t.Fatal(err)
+	}
+	p = filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(moved)), "foo.gpg")
+	if stored := readFile(t, p); stored != secret {
+		t.Errorf("expected the secret to be moved byte for byte, actual %q", stored)
+	}
+	if err := helper.Move(moved, creds.ServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := helper.AddWithMetadata(creds, map[string]string{"note": "x"}); err == nil {
+		t.Error("expected metadata to be rejected")
+	}
+	if err := helper.Add(&credentials.Credentials{ServerURL: creds.ServerURL, Username: "bar"}); err == nil {
+		t.Error("expected an empty secret to be rejected")
+	}
+}
+
+func TestGopassGetErrors(t *testing.T) {
+	stub := newStubGopass(t, overrideStub("show", `	echo "gpg: decryption failed: No secret key" >&2
+	exit 1`))
+	helper := New()
+
+	if _, _, err := helper.Get("https://missing.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found for a missing folder, actual: %v", err)
+	}
+
+	empty := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte("https://empty.docker.io")))
+	if err := os.MkdirAll(empty, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(empty, ".gpg-id"), []byte("7D851EB72D73BDA0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := helper.Get("https://empty.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found for a folder without usernames, actual: %v", err)
+	}
+
+	creds := &credentials.Credentials{ServerURL: "https://locked.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, getErr := helper.Get(creds.ServerURL)
+	_, _, metadataErr := helper.GetWithMetadata(creds.ServerURL)
+	_, allErr := helper.GetAll(creds.ServerURL)
+	for name, err := range map[string]error{"Get": getErr, "GetWithMetadata": metadataErr, "GetAll": allErr} {
+		if credentials.IsErrCredentialsNotFound(err) {
+			t.Errorf("%s: expected a decryption failure not to be credentials not found", name)
+		}
+
+		var readErr *ReadError
+		if !errors.As(err, &readErr) {
+			t.Fatalf("%s: expected a ReadError, actual: %v", name, err)
+		}
+		if readErr.ServerURL != creds.ServerURL || readErr.Username != "foo" {
+			t.Errorf("%s: expected the credentials of foo for %s, actual %s for %s", name, creds.ServerURL, readErr.Username, readErr.ServerURL)
+		}
+
+		var gopassErr *GopassError
+		if !errors.As(err, &gopassErr) || !strings.Contains(gopassErr.Stderr, "decryption failed") {
+			t.Errorf("%s: expected the gopass error to be wrapped, actual: %v", name, err)
+		}
+	}
+}
+
+func TestGopassLockFile(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithLockTimeout(200 * time.Millisecond))
+	creds := &credentials.Credentials{ServerURL: "https://lock.docker.io", Username: "foo", Secret: "bar"}
+
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+	lock := filepath.Join(stub.store, lockFileName)
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock file to be removed once added, actual: %v", err)
+	}
+
+	if err := os.WriteFile(lock, []byte("manual edit\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before := len(stub.calls(t))
+	if err := helper.Add(creds); !errors.Is(err, ErrStoreBusy) {
+		t.Errorf("expected the store to be busy, actual: %v", err)
+	}
+	if err := helper.Delete(creds.ServerURL); !errors.Is(err, ErrStoreBusy) {
+		t.Errorf("expected the store to be busy, actual: %v", err)
+	}
+	if err := helper.Move(creds.ServerURL, "https://moved-lock.docker.io"); !errors.Is(err, ErrStoreBusy) {
+		t.Errorf("expected the store to be busy, actual: %v", err)
+	}
+	if calls := stub.calls(t)[before:]; len(calls) != 0 {
+		t.Errorf("expected gopass not to be run while the store is locked, actual: %q", calls)
+	}
+	if _, err := New(WithLockTimeout(200*time.Millisecond), WithNormalization(false)).MigrateNormalized(); !errors.Is(err, ErrStoreBusy) {
+		t.Errorf("expected the store to be busy, actual: %v", err)
+	}
+	if readFile(t, lock) != "manual edit\n" {
+		t.Error("expected the lock file of another writer to be left in place")
+	}
+
+	if _, _, err := helper.Get(creds.ServerURL); err != nil {
+		t.Errorf("expected reads not to be locked, actual: %v", err)
+	}
+	if err := New().Delete(creds.ServerURL); err != nil {
+		t.Errorf("expected the store not to be locked by default, actual: %v", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { _ = os.Remove(lock) })
+	if err := helper.Add(creds); err != nil {
+		t.Errorf("expected the lock to be acquired once released, actual: %v", err)
+	}
+
+	t.Setenv(gopassLockTimeoutEnv, "soon")
+	if err := New().Add(creds); err == nil || !strings.Contains(err.Error(), gopassLockTimeoutEnv) {
+		t.Errorf("expected an invalid lock timeout to be rejected, actual: %v", err)
+	}
+}
+
+func TestGopassListMissingStore(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+
+	all, err := New().List()
+	if err != nil {
+		t.Fatalf("expected a store without credentials folder to be listed, actual: %v", err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected no credentials, actual %v", all)
+	}
+
+	// The store directory is resolved once, so the store going missing
+	// afterwards is reported as well.
+	helper := New()
+	if _, err := helper.List(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(stub.store); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*Gopass{helper, New()} {
+		if _, err := h.List(); !errors.Is(err, ErrStoreNotFound) || !strings.Contains(err.Error(), stub.store) {
+			t.Errorf("expected the missing store to be reported, actual: %v", err)
+		}
+		if _, err := h.Count(); !errors.Is(err, ErrStoreNotFound) {
+			t.Errorf("expected the missing store to be reported, actual: %v", err)
+		}
+	}
+}
+
+func TestGopassExpiry(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithRoute("https://routed.docker.io", "team", ""))
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		creds     *credentials.Credentials
+		expiresAt time.Time
+	}{
+		{creds: &credentials.Credentials{ServerURL: "https://expired.docker.io", Username: "alice", Secret: "secret"}, expiresAt: past},
+		{creds: &credentials.Credentials{ServerURL: "https://expired.docker.io", Username: "bob", Secret: "secret"}, expiresAt: past},
+		{creds: &credentials.Credentials{ServerURL: "https://mixed.docker.io", Username: "alice", Secret: "expired"}, expiresAt: past},
+		{creds: &credentials.Credentials{ServerURL: "https://mixed.docker.io", Username: "bob", Secret: "future"}, expiresAt: future},
+		{creds: &credentials.Credentials{ServerURL: "https://never.docker.io", Username: "alice", Secret: "never"}},
+		{creds: &credentials.Credentials{ServerURL: "https://routed.docker.io", Username: "alice", Secret: "routed"}, expiresAt: past},
+	} {
+		var err error
+		if tc.expiresAt.IsZero() {
+			err = helper.Add(tc.creds)
+		} else {
+			err = helper.AddWithExpiry(tc.creds, tc.expiresAt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, metadata, err := helper.GetWithMetadata("https://mixed.docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata[metadataExpiresAt] != past.UTC().Format(time.RFC3339) {
+		t.Errorf("expected the expiry to be stored, actual %q", metadata[metadataExpiresAt])
+	}
+
+	// Expired credentials are found unless configured otherwise.
+	if _, secret, err := helper.Get("https://mixed.docker.io"); err != nil || secret != "expired" {
+		t.Errorf("expected expired credentials to be found by default, actual %q: %v", secret, err)
+	}
+	hiding := New(WithHideExpired())
+	if _, _, err := hiding.Get("https://mixed.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected expired credentials not to be found, actual: %v", err)
+	}
+	if _, secret, err := hiding.Get("https://mixed.docker.io#bob"); err != nil || secret != "future" {
+		t.Errorf("expected unexpired credentials to be found, actual %q: %v", secret, err)
+	}
+	t.Setenv(gopassHideExpiredEnv, "1")
+	if _, secret, err := New().Get("https://never.docker.io"); err != nil || secret != "never" {
+		t.Errorf("expected credentials without expiry to be found, actual %q: %v", secret, err)
+	}
+
+	pruned, err := helper.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 4 {
+		t.Errorf("expected 4 expired credentials to be pruned, actual %d", pruned)
+	}
+
+	all, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["https://mixed.docker.io"] != "bob" || all["https://never.docker.io"] != "alice" {
+		t.Errorf("expected only unexpired credentials to be left, actual %v", all)
+	}
+	expiredDir := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte("https://expired.docker.io")))
+	if _, err := os.Stat(expiredDir); !os.IsNotExist(err) {
+		t.Errorf("expected the folder of the pruned server to be removed, actual: %v", err)
+	}
+	routedDir := filepath.Join(stub.store, "team", GOPASS_FOLDER, EncodeServerURL("https://routed.docker.io"))
+	if _, err := os.Stat(routedDir); !os.IsNotExist(err) {
+		t.Errorf("expected the routed credentials to be pruned, actual: %v", err)
+	}
+
+	if pruned, err := helper.Prune(); err != nil || pruned != 0 {
+		t.Errorf("expected nothing left to prune, actual %d: %v", pruned, err)
+	}
+	if err := helper.AddWithMetadata(&credentials.Credentials{ServerURL: "https://never.docker.io", Username: "carol", Secret: "secret"}, map[string]string{metadataExpiresAt: "tomorrow"}); err == nil {
+		t.Error("expected the expiry metadata key to be reserved")
+	}
+	if _, err := New(WithReadOnly()).Prune(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected read-only helpers not to prune, actual: %v", err)
+	}
+}
+
+func TestGopassUsernameDirs(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithUsernameDirs())
+
+	serverURL := "https://dirs.docker.io"
+	for _, username := range []string{"alice", "bob"} {
+		if err := helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: username, Secret: username + "-secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(serverURL)))
+	if readFile(t, filepath.Join(dir, "alice", "credential.gpg")) == "" {
+		t.Fatal("expected the credentials to be stored in the folder of the username")
+	}
+	// Other files may be stored next to the credentials, and folders without
+	// credentials are not usernames.
+	for _, name := range []string{filepath.Join("alice", "notes.gpg"), filepath.Join("carol", "notes.gpg")} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("notes\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	username, secret, err := helper.Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || secret != "alice-secret" {
+		t.Errorf("expected alice/alice-secret, actual %s/%s", username, secret)
+	}
+	all, err := helper.GetAll(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["bob"] != "bob-secret" {
+		t.Errorf("expected alice and bob, actual %v", all)
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[serverURL] != "alice" {
+		t.Errorf("expected %s to be listed with alice, actual %v", serverURL, list)
+	}
+	paths, err := helper.ListPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(paths[serverURL], "/alice/credential") {
+		t.Errorf("expected the path of the credential leaf, actual %s", paths[serverURL])
+	}
+
+	// The default layout is read as before.
+	if err := New().Add(&credentials.Credentials{ServerURL: "https://flat.docker.io", Username: "dave", Secret: "dave-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if username, secret, err := New().Get("https://flat.docker.io"); err != nil || username != "dave" || secret != "dave-secret" {
+		t.Errorf("expected dave/dave-secret with the default layout, actual %s/%s: %v", username, secret, err)
+	}
+	t.Setenv(gopassUsernameDirsEnv, "1")
+	if username, _, err := New().Get(serverURL + "#bob"); err != nil || username != "bob" {
+		t.Errorf("expected %s to store usernames in folders, actual %s: %v", gopassUsernameDirsEnv, username, err)
+	}
+
+	if err := helper.DeleteUser(serverURL, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bob")); !os.IsNotExist(err) {
+		t.Errorf("expected the empty folder of bob to be removed, actual: %v", err)
+	}
+	if err := helper.DeleteUser(serverURL, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, filepath.Join(dir, "alice", "notes.gpg")) != "notes\n" {
+		t.Error("expected the notes of alice to be kept")
+	}
+	if _, _, err := helper.Get(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected no credentials to be left, actual: %v", err)
+	}
+
+	if _, err := New(WithUsernameDirs(), WithPathSeparator("__")).List(); err == nil {
+		t.Error("expected username folders to require the nested layout")
+	}
+}
+
+func TestGopassResolveAliases(t *testing.T) {
+	serverURL := "https://aliased.docker.io"
+	aliased := GOPASS_FOLDER + "/" + EncodeServerURL(serverURL) + "/alice"
+	// The stub lists nothing, but resolves the path of alice to another one,
+	// as a gopass alias would.
+	stub := newStubGopass(t, overrideStub("show", `	case "$target" in
+	`+aliased+`) cat "$store/elsewhere/alice.gpg" ;;
+	*/locked) echo "gpg: decryption failed: No secret key" >&2; exit 1 ;;
+	*) echo "Error: failed to retrieve secret '$target': entry is not in the password store" >&2; exit 11 ;;
+	esac`))
+	if err := os.MkdirAll(filepath.Join(stub.store, "elsewhere"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stub.store, "elsewhere", "alice.gpg"), []byte("aliased-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := New().Get(serverURL + "#alice"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected aliases not to be resolved by default, actual: %v", err)
+	}
+
+	before := len(stub.calls(t))
+	helper := New(WithResolveAliases())
+	username, secret, err := helper.Get(serverURL + "#alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || secret != "aliased-secret" {
+		t.Errorf("expected alice/aliased-secret, actual %s/%s", username, secret)
+	}
+
+	if _, _, err := helper.Get(serverURL + "#bob"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected an entry gopass does not find to be not found, actual: %v", err)
+	}
+	if _, _, err := helper.Get(serverURL); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected nothing to be found without username, actual: %v", err)
+	}
+
+	var readErr *ReadError
+	if _, _, err := helper.Get(serverURL + "#locked"); !errors.As(err, &readErr) || credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected other gopass failures not to be not found, actual: %v", err)
+	}
+
+	for _, call := range stub.calls(t)[before:] {
+		if strings.HasPrefix(call, "config") {
+			t.Errorf("expected the store directory never to be read, actual call: %s", call)
+		}
+	}
+
+	t.Setenv(gopassResolveAliasesEnv, "1")
+	if _, secret, err := New().Get(serverURL + "#alice"); err != nil || secret != "aliased-secret" {
+		t.Errorf("expected %s to resolve aliases, actual %q: %v", gopassResolveAliasesEnv, secret, err)
+	}
+}
+
+func TestGopassStderrOnSuccess(t *testing.T) {
+	// Every invocation warns on stderr, and succeeds.
+	newStubGopass(t, strings.Replace(stubScript, "store=", `echo "WARNING: gopass sync is deprecated [y/N]" >&2
+store=`, 1))
+	helper := New()
+
+	creds := &credentials.Credentials{ServerURL: "https://stderr.docker.io", Username: "foo", Secret: "bar"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatalf("expected warnings not to fail adding, actual: %v", err)
+	}
+	username, secret, err := helper.Get(creds.ServerURL)
+	if err != nil {
+		t.Fatalf("expected warnings not to fail getting, actual: %v", err)
+	}
+	if username != "foo" || secret != "bar" {
+		t.Errorf("expected stderr to be ignored, actual %s/%q", username, secret)
+	}
+	if all, err := helper.List(); err != nil || all[creds.ServerURL] != "foo" {
+		t.Errorf("expected warnings not to fail listing, actual %v: %v", all, err)
+	}
+	if err := helper.Delete(creds.ServerURL); err != nil {
+		t.Errorf("expected warnings not to fail deleting, actual: %v", err)
+	}
+}
+
+func TestGopassErrorStdout(t *testing.T) {
+	// sync prints progress before failing, and show the secret.
+	newStubGopass(t, strings.Replace(stubScript, "case \"$cmd\" in\n", "case \"$cmd\" in\n"+`sync)
+	echo "pulled 3 commits from origin"
+	echo "git push failed" >&2
+	exit 1
+	;;
+show)
+	echo "stub-password"
+	echo "gpg: decryption failed" >&2
+	exit 2
+	;;
+`, 1))
+	helper := New()
+
+	var gopassErr *GopassError
+	err := helper.Sync()
+	if !errors.As(err, &gopassErr) || gopassErr.Stdout != "pulled 3 commits from origin" {
+		t.Fatalf("expected the output of gopass to be reported, actual: %v", err)
+	}
+	if !strings.Contains(err.Error(), "pulled 3 commits from origin") {
+		t.Errorf("expected the output in the error message, actual: %v", err)
+	}
+
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://stdout.docker.io", Username: "foo", Secret: "stub-password"}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = helper.Get("https://stdout.docker.io")
+	if !errors.As(err, &gopassErr) || gopassErr.Stdout != redacted {
+		t.Fatalf("expected the output of show to be redacted, actual: %v", err)
+	}
+	if strings.Contains(err.Error(), "stub-password") {
+		t.Errorf("expected the secret not to be reported, actual: %v", err)
+	}
+}
+
+func TestGopassCompact(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New(WithRoute("https://routed.docker.io", "team", ""))
+
+	creds := &credentials.Credentials{ServerURL: "https://kept.docker.io", Username: "kept-username", Secret: "kept-password"}
+	if err := helper.Add(creds); err != nil {
+		t.Fatal(err)
+	}
+
+	folder := filepath.Join(stub.store, "docker-credential-helpers")
+	empty := []string{EncodeServerURL("https://empty.docker.io"), hashServerURL("https://empty.docker.io")}
+	kept := []string{
+		EncodeServerURL(creds.ServerURL),
+		".git",
+		"not-encoded",
+		EncodeServerURL("https://notes.docker.io"),
+	}
+	for _, dir := range append(append([]string{}, empty...), kept[1:]...) {
+		if err := os.MkdirAll(filepath.Join(folder, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(folder, kept[3], "notes"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, kept[3], "notes", "readme.gpg"), []byte("notes\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	routed := filepath.Join(stub.store, "team", GOPASS_FOLDER, EncodeServerURL("https://routed.docker.io"))
+	if err := os.MkdirAll(routed, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := helper.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(empty)+1 {
+		t.Errorf("expected %d folders to be removed, actual %d", len(empty)+1, removed)
+	}
+	if _, err := os.Stat(routed); !os.IsNotExist(err) {
+		t.Errorf("expected the empty routed folder to be removed, actual: %v", err)
+	}
+	for _, dir := range empty {
+		if _, err := os.Stat(filepath.Join(folder, dir)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, actual: %v", dir, err)
+		}
+	}
+	for _, dir := range kept {
+		if _, err := os.Stat(filepath.Join(folder, dir)); err != nil {
+			t.Errorf("expected %s to be kept, actual: %v", dir, err)
+		}
+	}
+
+	if removed, err := helper.Compact(); err != nil || removed != 0 {
+		t.Errorf("expected nothing left to compact, actual %d, %v", removed, err)
+	}
+	if username, secret, err := helper.Get(creds.ServerURL); err != nil || username != creds.Username || secret != creds.Secret {
+		t.Errorf("expected the credentials to be kept, actual %s/%s, %v", username, secret, err)
+	}
+
+	t.Setenv(gopassReadOnlyEnv, "1")
+	if _, err := helper.Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected read-only helpers not to compact, actual: %v", err)
+	}
+}
+
+func TestGopassFallbackFolders(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	personal, shared := New(WithFolder("personal")), New(WithFolder("team/shared"))
+
+	for _, add := range []struct {
+		helper *Gopass
+		creds  *credentials.Credentials
+	}{
+		{personal, &credentials.Credentials{ServerURL: "https://both.docker.io", Username: "personal-username", Secret: "personal-password"}},
+		{shared, &credentials.Credentials{ServerURL: "https://both.docker.io", Username: "shared-username", Secret: "shared-password"}},
+		{shared, &credentials.Credentials{ServerURL: "https://shared.docker.io", Username: "shared-username", Secret: "shared-only"}},
+	} {
+		if err := add.helper.Add(add.creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv(gopassFallbackFoldersEnv, "team/shared, personal")
+	helper := New(WithFolder("personal"))
+
+	if username, secret, err := helper.Get("https://both.docker.io"); err != nil || username != "personal-username" || secret != "personal-password" {
+		t.Errorf("expected the personal credentials to override the shared ones, actual %s/%s, %v", username, secret, err)
+	}
+	if username, secret, err := helper.Get("https://shared.docker.io"); err != nil || username != "shared-username" || secret != "shared-only" {
+		t.Errorf("expected to fall back to the shared credentials, actual %s/%s, %v", username, secret, err)
+	}
+	if username, _, err := helper.Get("https://both.docker.io#shared-username"); err != nil || username != "shared-username" {
+		t.Errorf("expected to fall back to the shared folder for a username, actual %s, %v", username, err)
+	}
+	if creds, _, err := helper.GetWithMetadata("https://shared.docker.io"); err != nil || creds.Secret != "shared-only" {
+		t.Errorf("expected to fall back to the shared credentials, actual %+v, %v", creds, err)
+	}
+	if _, _, err := helper.Get("https://missing.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected credentials not found, actual: %v", err)
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list["https://both.docker.io"] != "personal-username" || list["https://shared.docker.io"] != "shared-username" {
+		t.Errorf("expected the folders to be merged, personal credentials first, actual: %v", list)
+	}
+
+	// Only the first folder is written to.
+	if err := helper.Delete("https://shared.docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Add(&credentials.Credentials{ServerURL: "https://new.docker.io", Username: "new-username", Secret: "new-password"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, "personal", EncodeServerURL("https://new.docker.io"), "new-username.gpg")); err != nil {
+		t.Errorf("expected the credentials to be added to the personal folder: %v", err)
+	}
+	t.Setenv(gopassFallbackFoldersEnv, "")
+	if _, _, err := shared.Get("https://shared.docker.io"); err != nil {
+		t.Errorf("expected the shared credentials not to be deleted, actual: %v", err)
+	}
+	if _, _, err := shared.Get("https://new.docker.io"); !credentials.IsErrCredentialsNotFound(err) {
+		t.Errorf("expected nothing to be added to the shared folder, actual: %v", err)
+	}
+
+	t.Setenv(gopassFallbackFoldersEnv, "../outside")
+	if _, _, err := helper.Get("https://both.docker.io"); err == nil || !strings.Contains(err.Error(), gopassFallbackFoldersEnv) {
+		t.Errorf("expected an invalid fallback folder to be rejected, actual: %v", err)
+	}
+}
+
+func TestGopassRoutes(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	t.Setenv(gopassRoutesEnv, "*.corp.example.com=team: https://ci.docker.io=:ci/docker")
+	helper := New()
+
+	for _, expected := range []struct {
+		serverURL string
+		path      string
+	}{
+		{"https://registry.corp.example.com", filepath.Join("team", GOPASS_FOLDER)},
+		{"https://ci.docker.io", filepath.Join("ci", "docker")},
+		{"https://other.docker.io", GOPASS_FOLDER},
+	} {
+		creds := &credentials.Credentials{ServerURL: expected.serverURL, Username: "foo", Secret: "bar"}
+		if err := helper.Add(creds); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(stub.store, expected.path, EncodeServerURL(expected.serverURL), "foo.gpg")); err != nil {
+			t.Errorf("expected the credentials of %s to be stored in %s: %v", expected.serverURL, expected.path, err)
+		}
+		if username, secret, err := helper.Get(expected.serverURL); err != nil || username != "foo" || secret != "bar" {
+			t.Errorf("expected to get the credentials of %s, actual %s/%s, %v", expected.serverURL, username, secret, err)
+		}
+		if ok, err := helper.Has(expected.serverURL); err != nil || !ok {
+			t.Errorf("expected %s to be stored, actual %v, %v", expected.serverURL, ok, err)
+		}
+	}
+
+	list, err := helper.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("expected the credentials of every route to be listed, actual: %v", list)
+	}
+	if servers, err := helper.ListServers(); err != nil || len(servers) != 3 {
+		t.Errorf("expected the servers of every route to be listed, actual: %v, %v", servers, err)
+	}
+	if count, err := helper.Count(); err != nil || count != 3 {
+		t.Errorf("expected the credentials of every route to be counted, actual: %d, %v", count, err)
+	}
+	paths, err := helper.ListPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := paths["https://registry.corp.example.com"]; p != "team/"+GOPASS_FOLDER+"/"+EncodeServerURL("https://registry.corp.example.com")+"/foo" {
+		t.Errorf("expected the path of the routed credentials to include the mount, actual: %v", paths)
+	}
+
+	// Routed credentials already stored are not imported again.
+	src := memoryHelper{}
+	_ = src.Add(&credentials.Credentials{ServerURL: "https://registry.corp.example.com", Username: "foo", Secret: "imported"})
+	if n, err := helper.ImportFrom(src, false); err != nil || n != 0 {
+		t.Errorf("expected the routed credentials to be skipped, actual: %d, %v", n, err)
+	}
+	if _, s, err := helper.Get("https://registry.corp.example.com"); err != nil || s != "bar" {
+		t.Errorf("expected the routed credentials to be left untouched, actual: %s, %v", s, err)
+	}
+
+	// Moving credentials to a routed server URL moves them to its folder,
+	// and back.
+	if err := helper.Move("https://other.docker.io", "https://moved.corp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, "team", GOPASS_FOLDER, EncodeServerURL("https://moved.corp.example.com"), "foo.gpg")); err != nil {
+		t.Errorf("expected the moved credentials to be stored in the team mount: %v", err)
+	}
+	if _, _, err := helper.Get("https://moved.corp.example.com"); err != nil {
+		t.Errorf("expected to get the moved credentials: %v", err)
+	}
+	if err := helper.Move("https://moved.corp.example.com", "https://other.docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL("https://other.docker.io"), "foo.gpg")); err != nil {
+		t.Errorf("expected the credentials to be moved back to the default folder: %v", err)
+	}
+
+	if err := helper.DeleteUser("https://ci.docker.io", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, "ci", "docker", EncodeServerURL("https://ci.docker.io"))); !os.IsNotExist(err) {
+		t.Errorf("expected the routed username to be deleted from the ci/docker folder: %v", err)
+	}
+	if err := helper.Delete("https://registry.corp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stub.store, "team", GOPASS_FOLDER, EncodeServerURL("https://registry.corp.example.com"))); !os.IsNotExist(err) {
+		t.Errorf("expected the routed credentials to be deleted from the team mount: %v", err)
+	}
+	if _, _, err := helper.Get("https://other.docker.io"); err != nil {
+		t.Errorf("expected the unrouted credentials to remain: %v", err)
+	}
+
+	for _, routes := range []string{"missing-equals", "[=team:", "*.example.com=:", "*.example.com=../escape:"} {
+		t.Setenv(gopassRoutesEnv, routes)
+		if _, _, err := New().Get("https://registry.example.com"); err == nil || credentials.IsErrCredentialsNotFound(err) {
+			t.Errorf("expected an error for %s %q, actual: %v", gopassRoutesEnv, routes, err)
+		}
+	}
+}
+
+func TestGopassReconcile(t *testing.T) {
+	listing := filepath.Join(t.TempDir(), "listing")
+	stub := newStubGopass(t, overrideStub("ls", `	cat "`+listing+`" 2>/dev/null || true`))
+	helper := New()
+
+	for _, serverURL := range []string{"https://both.docker.io", "https://disk.docker.io"} {
+		if err := helper.Add(&credentials.Credentials{ServerURL: serverURL, Username: "foo", Secret: "bar"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(stub.store, GOPASS_FOLDER, EncodeServerURL("https://both.docker.io"), ".gpg-id"), []byte("key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	both := GOPASS_FOLDER + "/" + EncodeServerURL("https://both.docker.io") + "/foo"
+	disk := GOPASS_FOLDER + "/" + EncodeServerURL("https://disk.docker.io") + "/foo"
+	remote := GOPASS_FOLDER + "/" + EncodeServerURL("https://remote.docker.io") + "/foo"
+	if err := os.WriteFile(listing, []byte(both+"\n"+remote+"\nother/secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := helper.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != remote {
+		t.Errorf("expected %s to be reported as added, actual: %q", remote, added)
+	}
+	if len(removed) != 1 || removed[0] != disk {
+		t.Errorf("expected %s to be reported as removed, actual: %q", disk, removed)
+	}
+	if _, _, err := helper.Get("https://disk.docker.io"); err != nil {
+		t.Errorf("expected Reconcile not to modify the store, actual: %v", err)
+	}
+
+	if err := os.WriteFile(listing, []byte(both+"\n"+disk+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if added, removed, err := helper.Reconcile(); err != nil || len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no discrepancies, actual %q, %q, %v", added, removed, err)
+	}
+}
+
+func TestGopassMultilineInsert(t *testing.T) {
+	// The stub only stores the first line of secrets not inserted as
+	// multi-line blocks.
+	stub := newStubGopass(t, overrideStub("insert", `	mkdir -p "$(dirname "$store/$target")"
+	case " $* " in
+	*" --multiline "*) cat > "$store/$target.gpg" ;;
+	*) head -n 1 > "$store/$target.gpg" ;;
+	esac`))
+	t.Setenv(gopassMultilineInsertEnv, "1")
+	helper := New()
+
+	creds := &credentials.Credentials{
+		ServerURL: "https://multiline.docker.io",
+		Username:  "multiline-username",
+		Secret:    "-----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----",
+	}
+	if err := helper.AddWithMetadata(creds, map[string]string{"owner": "build team", "rotated": "2024-01-01"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(t); !containsCall(calls, "insert --multiline -f "+GOPASS_FOLDER+"/"+EncodeServerURL(creds.ServerURL)+"/"+creds.Username) {
+		t.Errorf("expected the secret to be inserted as a multi-line block, calls: %q", calls)
+	}
+
+	if _, secret, err := helper.Get(creds.ServerURL); err != nil || secret != creds.Secret {
+		t.Errorf("expected %q, actual %q, %v", creds.Secret, secret, err)
+	}
+	read, metadata, err := helper.GetWithMetadata(creds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Secret != creds.Secret || metadata["owner"] != "build team" || metadata["rotated"] != "2024-01-01" || metadata[metadataServerURL] != creds.ServerURL {
+		t.Errorf("expected the secret and metadata to round-trip, actual %q, %v", read.Secret, metadata)
+	}
+
+	t.Setenv(gopassNoOverwriteEnv, "1")
+	if err := helper.Add(&credentials.Credentials{ServerURL: creds.ServerURL, Username: "other-username", Secret: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.calls(t); !strings.HasPrefix(calls[len(calls)-1], "insert --multiline ") || strings.Contains(calls[len(calls)-1], " -f ") {
+		t.Errorf("expected a multi-line insert refusing to overwrite, actual: %q", calls[len(calls)-1])
+	}
+}
+
+func TestGopassIdentityToken(t *testing.T) {
+	stub := newStubGopass(t, stubScript)
+	helper := New()
+
+	password := &credentials.Credentials{
+		ServerURL: "https://password.docker.io",
+		Username:  "password-username",
+		Secret:    "password-secret",
+	}
+	if err := helper.Add(password); err != nil {
+		t.Fatal(err)
+	}
+	creds, token, err := helper.GetWithIdentityToken(password.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != password.Username || creds.Secret != password.Secret || token != "" {
+		t.Errorf("expected %s/%s without a token, actual %s/%s, %q", password.Username, password.Secret, creds.Username, creds.Secret, token)
+	}
+
+	tokenCreds := &credentials.Credentials{
+		ServerURL: "https://token.docker.io",
+		Username:  "token-username",
+		Secret:    "token-password",
+	}
+	if err := helper.AddWithIdentityToken(tokenCreds, "eyJhbGciOi.token:value"); err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, filepath.Join(stub.store, GOPASS_FOLDER, base64.URLEncoding.EncodeToString([]byte(tokenCreds.ServerURL)), tokenCreds.Username+".gpg"))
+	if !strings.HasPrefix(content, "token-password\n") || !strings.Contains(content, "\nidentity_token: eyJhbGciOi.token:value\n") {
+		t.Errorf("expected the password on the first line and the token in a field, actual: %q", content)
+	}
+
+	creds, token, err = helper.GetWithIdentityToken(tokenCreds.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Secret != tokenCreds.Secret || token != "eyJhbGciOi.token:value" {
+		t.Errorf("expected %s and its token, actual %s, %q", tokenCreds.Secret, creds.Secret, token)
+	}
+	if _, secret, err := helper.Get(tokenCreds.ServerURL); err != nil || secret != tokenCreds.Secret {
+		t.Errorf("expected Get to return the password, actual %s, %v", secret, err)
+	}
+
+	if err := helper.AddWithIdentityToken(tokenCreds, "multi\nline"); err == nil {
+		t.Error("expected a multi-line token to be rejected")
+	}
+	if err := helper.AddWithMetadata(tokenCreds, map[string]string{metadataIdentityToken: "token"}); err == nil {
+		t.Error("expected the identity_token metadata key to be reserved")
+	}
+}
+
+func TestGopassInitTTL(t *testing.T) {
+	broken := filepath.Join(t.TempDir(), "broken")
+	newStubGopass(t, overrideStub("ls", `	if [ -f "`+broken+`" ]; then
+		echo "store is not initialized" >&2
+		exit 1
+	fi`))
+	helper := New(WithInitTTL(200 * time.Millisecond))
+
+	if !helper.CheckInitialized() {
+		t.Fatal("expected gopass to be initialized")
+	}
+	if err := os.WriteFile(broken, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !helper.CheckInitialized() {
+		t.Fatal("expected the result to be cached within the TTL")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if helper.CheckInitialized() {
+		t.Fatal("expected gopass to be checked again once the TTL expired")
+	}
+
+	if err := os.Remove(broken); err != nil {
+		t.Fatal(err)
+	}
+	if !helper.CheckInitialized() {
+		t.Fatal("expected gopass to be initialized again")
+	}
+
+	t.Setenv(gopassInitTTLEnv, "later")
+	if New().CheckInitialized() {
+		t.Error("expected an invalid TTL to be rejected")
+	}
+}
@@ -0,0 +1,28 @@
+package gopass
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sync runs `gopass sync`, pulling and pushing the changes of a git-backed
+// store. As adding and deleting credentials does not autosync by default,
+// callers writing many credentials in a row may sync once at the end. A
+// failing sync returns a *GopassError holding the error output of gopass.
+func (g Gopass) Sync() (err error) {
+	defer g.observe("Sync", time.Now(), &err)
+
+	if err := g.checkWritable("sync"); err != nil {
+		return err
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	// Pulling may change any credentials.
+	defer g.config().cache.clear()
+
+	if _, err := g.runGopass("", "sync"); err != nil {
+		return fmt.Errorf("unable to sync the store: %w", err)
+	}
+	return nil
+}
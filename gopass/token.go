@@ -0,0 +1,39 @@
+package gopass
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+// AddWithIdentityToken adds new credentials to the keychain along with an
+// identity token, as used by registries authenticating with tokens. The
+// password is stored on the first line of the secret and the identity token
+// in its identity_token field, so that both are read back by
+// GetWithIdentityToken.
+func (g Gopass) AddWithIdentityToken(creds *credentials.Credentials, identityToken string) (err error) {
+	defer g.observe("AddWithIdentityToken", time.Now(), &err)
+
+	if identityToken == "" {
+		return errors.New("missing identity token")
+	}
+	if strings.ContainsAny(identityToken, "\r\n") {
+		return errors.New("invalid identity token: must be a single line")
+	}
+	return g.add(creds, map[string]string{metadataIdentityToken: identityToken})
+}
+
+// GetWithIdentityToken returns the credentials to use for a given registry
+// server URL, along with the identity token stored alongside their password.
+// The identity token is empty for credentials stored without one.
+func (g Gopass) GetWithIdentityToken(serverURL string) (creds *credentials.Credentials, identityToken string, err error) {
+	defer g.observe("GetWithIdentityToken", time.Now(), &err)
+
+	creds, metadata, err := g.getWithMetadata(serverURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return creds, metadata[metadataIdentityToken], nil
+}
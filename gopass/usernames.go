@@ -0,0 +1,62 @@
+package gopass
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// metadataUsername is the metadata key holding the username of credentials
+// stored under an encoded name.
+const metadataUsername = "username"
+
+// encodedUsernamePrefix prefixes the names of the secrets holding the
+// credentials of usernames that cannot be used as a secret name as is.
+const encodedUsernamePrefix = "+b64-"
+
+// usernameName returns the name of the secret holding the credentials of
+// username: the username itself, or encodedUsernamePrefix followed by its
+// base64-url encoding for usernames holding path separators, usernames that
+// would make hidden or relative names, and usernames that would be mistaken
+// for encoded ones.
+func usernameName(username string) string {
+	if username == "." || username == ".." || strings.ContainsAny(username, "/\\") ||
+		strings.HasPrefix(username, ".") || strings.HasPrefix(username, encodedUsernamePrefix) {
+		return encodedUsernamePrefix + base64.RawURLEncoding.EncodeToString([]byte(username))
+	}
+	return username
+}
+
+// isEncodedUsername reports whether the secret name may have been returned by
+// usernameName for a username other than itself.
+func isEncodedUsername(name string) bool {
+	return strings.HasPrefix(name, encodedUsernamePrefix)
+}
+
+// storedUsername returns the username of the credentials stored under the
+// secret name in loc. The username is read from the metadata of secrets
+// stored under an encoded name, which decrypts the secret, and is the name
+// itself otherwise, or if the metadata does not hold it, as for credentials
+// stored before usernames were encoded.
+func (g Gopass) storedUsername(loc serverLocation, name string) (string, error) {
+	if !isEncodedUsername(name) || g.useCat() {
+		return name, nil
+	}
+
+	_, metadata, err := g.showSecretWithMetadata(loc.secretPath(name))
+	if err != nil {
+		return "", err
+	}
+	if username := metadata[metadataUsername]; username != "" {
+		return username, nil
+	}
+	return name, nil
+}
+
+// usernameFromMetadata returns the username of the credentials stored under
+// the secret name, given their metadata, as storedUsername does.
+func usernameFromMetadata(name string, metadata map[string]string) string {
+	if username := metadata[metadataUsername]; isEncodedUsername(name) && username != "" {
+		return username
+	}
+	return name
+}
@@ -0,0 +1,64 @@
+package gopass
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// minGopassVersion is the oldest gopass release the helper is known to work
+// with. Older releases lack some of the subcommands and flags it relies on.
+const minGopassVersion = "1.10.0"
+
+// gopassVersionPattern matches the version in the output of
+// `gopass version`, such as "gopass 1.15.11 go1.21.5 linux amd64" or
+// "gopass 1.8.6 (f8181bbb) go1.11.5 linux amd64".
+var gopassVersionPattern = regexp.MustCompile(`\bv?(\d+)\.(\d+)\.(\d+)([-+][0-9A-Za-z.+-]*)?`)
+
+// GopassVersion returns the version of the installed gopass, such as
+// "1.15.11".
+func (g Gopass) GopassVersion() (version string, err error) {
+	defer g.observe("GopassVersion", time.Now(), &err)
+
+	out, err := g.runGopass("", "version")
+	if err != nil {
+		return "", err
+	}
+	return parseGopassVersion(out)
+}
+
+// parseGopassVersion returns the version in the output of `gopass version`.
+func parseGopassVersion(out string) (string, error) {
+	m := gopassVersionPattern.FindStringSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unable to parse gopass version from %q", out)
+	}
+	return m[1] + "." + m[2] + "." + m[3] + m[4], nil
+}
+
+// checkGopassVersion returns an error if version is older than
+// minGopassVersion.
+func checkGopassVersion(version string) error {
+	if compareVersions(version, minGopassVersion) < 0 {
+		return fmt.Errorf("gopass %s is too old: version %s or later is required", version, minGopassVersion)
+	}
+	return nil
+}
+
+// compareVersions compares the major, minor and patch numbers of two versions
+// returned by parseGopassVersion, ignoring pre-release and build suffixes.
+func compareVersions(a, b string) int {
+	ma, mb := gopassVersionPattern.FindStringSubmatch(a), gopassVersionPattern.FindStringSubmatch(b)
+	for i := 1; i <= 3; i++ {
+		x, _ := strconv.Atoi(ma[i])
+		y, _ := strconv.Atoi(mb[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package gopass
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// gopassWrapperEnv is the environment variable holding the whitespace
+// separated command gopass is run through, such as "sudo -u ci gopass", to
+// which the gopass arguments are appended.
+const gopassWrapperEnv = "GOPASS_WRAPPER"
+
+// wrapper returns the configured command, or that of gopassWrapperEnv, that
+// gopass is run through, or nil if gopass is run directly.
+func (g Gopass) wrapper() ([]string, error) {
+	name, argv := "wrapper", g.config().wrapper
+	if argv == nil {
+		name, argv = gopassWrapperEnv, strings.Fields(os.Getenv(gopassWrapperEnv))
+		if len(argv) == 0 {
+			return nil, nil
+		}
+	}
+
+	if len(argv) == 0 {
+		return nil, errors.New("invalid wrapper: must not be empty")
+	}
+	for _, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, "\x00\r\n") {
+			return nil, fmt.Errorf("invalid %s argument %q: must be a single line", name, arg)
+		}
+	}
+	return argv, nil
+}